@@ -4,21 +4,24 @@ import (
 	connection "ItShare/client/internal"
 	"ItShare/helper"
 	"ItShare/utils"
-	"bufio"
 	"flag"
 	"fmt"
 	"os"
 	"strings"
+	"time"
 )
 
+// How long the client listens for server beacons, longer than servers wait between them
+const discoveryTimeout = 3 * time.Second
+
 func promptForServerAddress() string {
-	reader := bufio.NewReader(os.Stdin)
-	
 	for {
 		fmt.Println(utils.InfoColor("Enter server address (format host:port):"))
 		fmt.Print(utils.CommandColor(">>> "))
-		address, _ := reader.ReadString('\n')
-		address = strings.TrimSpace(address)
+		address, err := connection.ReadLine()
+		if err != nil {
+			os.Exit(1)
+		}
 		
 		if !strings.Contains(address, ":") {
 			fmt.Println(utils.ErrorColor("❌ Invalid address format. Please use host:port (e.g., localhost:8080)"))
@@ -34,8 +37,8 @@ func promptForServerAddress() string {
 			fmt.Print(utils.CommandColor(">>> "))
 			
 			fmt.Print(errMsg)
-			retry, _ := reader.ReadString('\n')
-			retry = strings.TrimSpace(strings.ToLower(retry))
+			retry, _ := connection.ReadLine()
+			retry = strings.ToLower(retry)
 			
 			if retry != "y" && retry != "yes" {
 				os.Exit(1)
@@ -46,17 +49,63 @@ func promptForServerAddress() string {
 	}
 }
 
+// discoverServer looks for servers on the local network and lets the user pick one.
+// It returns an empty address when none answered or the user wants to type one in.
+func discoverServer() string {
+	servers, err := connection.DiscoverServers(discoveryTimeout)
+	if err != nil {
+		fmt.Println(utils.WarningColor("⚠ Could not scan for servers: " + err.Error()))
+		return ""
+	}
+	if len(servers) == 0 {
+		fmt.Println(utils.WarningColor("⚠ No servers found on the local network"))
+		return ""
+	}
+	address, err := connection.SelectServer(servers)
+	if err != nil {
+		return ""
+	}
+	return address
+}
+
 func main() {
 	serverAddr := flag.String("server", "", "Server address in format host:port")
+	direct := flag.Bool("direct", false, "Offer direct peer-to-peer connections for outgoing transfers")
+	singlePass := flag.Bool("single-pass", false, "Hash outgoing files while sending them and send the checksum after the data")
+	streams := flag.Int("streams", 1, "Parallel data connections to split large outgoing files over, when the receiver agrees")
+	maxSends := flag.Int("max-sends", 2, "How many outgoing transfers run at once, the rest wait in a queue")
+	useTLS := flag.Bool("tls", true, "Connect to the server over TLS, pinning its certificate on first use")
+	limit := flag.String("limit", "off", "Bandwidth all outgoing transfers share, such as 5MB/s")
+	allowUnencrypted := flag.Bool("allow-unencrypted", false, "Transfer files in the clear with peers that publish no identity key, instead of refusing")
+	onCancel := flag.String("on-cancel", string(connection.RemovePartial), "What to do with partial data of cancelled transfers: remove or keep")
 	flag.Parse()
+
+	if err := connection.SetCancelPolicy(*onCancel); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error: " + err.Error()))
+		return
+	}
+	if err := connection.SetGlobalLimit(*limit); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error: --limit: " + err.Error()))
+		return
+	}
+
+	connection.SetTLSMode(*useTLS)
+	connection.SetAllowUnencrypted(*allowUnencrypted)
+	connection.SetDirectMode(*direct)
+	connection.SetSinglePassMode(*singlePass)
+	connection.SetStreams(*streams)
+	connection.SetMaxActiveSends(*maxSends)
 	
 	utils.PrintBanner()
 	
 	// If server address not provided via command line, ask user
 	address := *serverAddr
+	if address == "" {
+		address = discoverServer()
+	}
 	if address == "" {
 		address = promptForServerAddress()
-	} else {
+	} else if *serverAddr != "" {
 		fmt.Println(utils.InfoColor("Connecting to server at " + address + "..."))
 		
 		// Check if server is available
@@ -70,40 +119,19 @@ func main() {
 	}
 	
 	conn, err := connection.Connect(address)
-		if err != nil {
-		if err.Error() == "reconnect" {
-			goto startChat 
-		} else {
-			fmt.Println(utils.ErrorColor("❌ Error connecting to server:"), err)
-			return
-		}
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error connecting to server:"), err)
+		return
 	}
 
 	defer connection.Close(conn)
 
-	fmt.Println(utils.InfoColor("Please login to continue:"))
-	err = connection.UserInput("Username", conn)
+	err = connection.Login(conn, address)
 	if err != nil {
-		if err.Error() == "reconnect" {
-			goto startChat
-		} else {
-			fmt.Println(utils.ErrorColor("❌ Error during login:"), err)
-			return
-		}
+		fmt.Println(utils.ErrorColor("❌ Error during login:"), err)
+		return
 	}
 
-
-	err = connection.UserInput("Store File Path", conn)
-	if err != nil {
-		if err.Error() == "reconnect" {
-			goto startChat
-		} else {
-			fmt.Println(utils.ErrorColor("❌ Error setting file path:"), err)
-			return
-		}
-	}
-	
-startChat:
 	fmt.Println(utils.HeaderColor("\n✨ Welcome to DrizLink - P2P File Sharing! ✨"))
 	fmt.Println(utils.InfoColor("------------------------------------------------"))
 	fmt.Println(utils.SuccessColor("✅ Successfully connected to server!"))
@@ -111,6 +139,7 @@ startChat:
 	fmt.Println(utils.InfoColor("------------------------------------------------"))
 
 	go connection.ReadLoop(conn)
+	connection.ResumePendingTransfers(conn)
 	connection.WriteLoop(conn)
 
 }
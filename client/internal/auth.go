@@ -0,0 +1,53 @@
+package connection
+
+import (
+	"ItShare/helper"
+	"ItShare/utils"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Credentials are what the client logs in to a server with. They are read from
+// credentials.json in the config directory, keyed by server address, which users write
+// themselves; anything missing there is asked for.
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func credentialsFile() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "credentials.json"), nil
+}
+
+// loadCredentials returns the credentials configured for a server, empty when there are none
+func loadCredentials(address string) Credentials {
+	path, err := credentialsFile()
+	if err != nil {
+		return Credentials{}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println(utils.WarningColor("⚠ Could not read your credentials:"), err)
+		}
+		return Credentials{}
+	}
+	credentials := make(map[string]Credentials)
+	if err := json.Unmarshal(data, &credentials); err != nil {
+		fmt.Println(utils.WarningColor("⚠ Ignoring corrupt credentials file "+path+":"), err)
+		return Credentials{}
+	}
+	return credentials[address]
+}
+
+// promptPassword asks for the password of the server without echoing it
+func promptPassword(address string) (string, error) {
+	fmt.Println("Enter the password of " + address + ": ")
+	return helper.ReadPassword(stdin)
+}
@@ -0,0 +1,245 @@
+package connection
+
+import (
+	"ItShare/protocol"
+	"ItShare/utils"
+	"fmt"
+	"os"
+	"time"
+)
+
+// A running transfer is cancelled with /CANCEL on its data channel, which reaches the
+// peer ahead of the channel closing, and through the server with /TRANSFER_CANCEL,
+// which also covers transfers that are interrupted or still waiting for an answer.
+// A receiver that cancels reads on until the sender has closed the channel, since
+// closing it with data still unread could drop the request.
+
+// How long a receiver that cancelled waits for the sender to close the data channel
+const cancelDrainTimeout = 5 * time.Second
+
+// CancelPolicy decides what happens to the data a receiver already has when a transfer is cancelled
+type CancelPolicy string
+
+const (
+	// RemovePartial deletes the partial file, or the entries of a folder received so far
+	RemovePartial CancelPolicy = "remove"
+	// KeepPartial leaves the received data in the store path, without resuming it later
+	KeepPartial CancelPolicy = "keep"
+)
+
+var cancelPolicy = RemovePartial
+
+// SetCancelPolicy sets what is done with partial data of cancelled transfers
+func SetCancelPolicy(policy string) error {
+	switch CancelPolicy(policy) {
+	case RemovePartial, KeepPartial:
+		cancelPolicy = CancelPolicy(policy)
+		return nil
+	}
+	return fmt.Errorf("unknown cancel policy %q, use %s or %s", policy, RemovePartial, KeepPartial)
+}
+
+// HandleCancelTransfer handles the /cancel command. A running transfer is stopped on
+// both sides, an unfinished one is forgotten along with its partial data, a pending
+// offer is rejected and an offer still waiting for an answer is withdrawn. A queued
+// send is just taken out of the queue.
+func HandleCancelTransfer(conn *protocol.Conn, transferID string) {
+	// The recipient has not heard of a send that is still queued
+	if transfer, queued := dequeueSend(transferID); queued {
+		fmt.Printf("%s Queued transfer %s of '%s' cancelled\n",
+			utils.WarningColor("🚫"),
+			utils.CommandColor(transferID),
+			utils.InfoColor(transfer.Name))
+		return
+	}
+
+	pendingOffersMutex.Lock()
+	_, offered := pendingOffers[transferID]
+	pendingOffersMutex.Unlock()
+	if offered {
+		HandleRejectOffer(conn, transferID)
+		return
+	}
+
+	// The server knows the recipient of an unanswered offer and tells it
+	if deliverReply("transfer:"+transferID, fmt.Sprintf("/TRANSFER_DENIED %s cancelled", transferID)) {
+		notifyCancel(conn, transferID, "")
+		fmt.Println(utils.WarningColor("🚫 Offer withdrawn:"), utils.CommandColor(transferID))
+		return
+	}
+
+	// A send still preparing its offer stops before making it
+	if transfer, starting := withdrawStartingSend(transferID); starting {
+		fmt.Printf("%s Transfer %s of '%s' cancelled\n",
+			utils.WarningColor("🚫"),
+			utils.CommandColor(transferID),
+			utils.InfoColor(transfer.Name))
+		return
+	}
+
+	if transfer, exists := GetTransfer(transferID); exists {
+		if !markCancelled(transfer) {
+			fmt.Printf("%s Transfer %s is already %s\n",
+				utils.WarningColor("⚠"),
+				utils.CommandColor(transferID),
+				utils.WarningColor(transfer.Status.String()))
+			return
+		}
+		if err := signalPeer(transferID, "/CANCEL"); err != nil {
+			closeDataChannel(transferID)
+		}
+		notifyCancel(conn, transferID, transfer.Recipient)
+		if transfer.Direction == "send" {
+			closeDataChannel(transferID)
+		}
+		fmt.Printf("%s Transfer %s of '%s' cancelled\n",
+			utils.WarningColor("🚫"),
+			utils.CommandColor(transferID),
+			utils.InfoColor(transfer.Name))
+		return
+	}
+
+	if record, exists := getOutgoingTransfer(transferID); exists {
+		removeOutgoingTransfer(transferID)
+		notifyCancel(conn, transferID, record.RecipientId)
+		fmt.Printf("%s Unfinished transfer %s of '%s' cancelled\n",
+			utils.WarningColor("🚫"),
+			utils.CommandColor(transferID),
+			utils.InfoColor(record.Name))
+		return
+	}
+
+	if session := CurrentSession(); session != nil {
+		if partial, exists := findPartial(session.StoreFilePath, transferID); exists {
+			notifyCancel(conn, transferID, partial.SenderId)
+			fmt.Printf("%s Unfinished transfer %s of '%s' cancelled\n",
+				utils.WarningColor("🚫"),
+				utils.CommandColor(transferID),
+				utils.InfoColor(partial.FileName))
+			discardPartial(session.StoreFilePath, partial)
+			return
+		}
+	}
+
+	fmt.Println(utils.ErrorColor("❌ Transfer not found:"), utils.CommandColor(transferID))
+}
+
+// handlePeerCancel stops or forgets a transfer the other side cancelled
+func handlePeerCancel(peerId, transferID string) {
+	pendingOffersMutex.Lock()
+	offer, offered := pendingOffers[transferID]
+	if offered && offer.SenderId == peerId {
+		delete(pendingOffers, transferID)
+	}
+	pendingOffersMutex.Unlock()
+	if offered && offer.SenderId == peerId {
+		takeDirectOffer(transferID)
+		fmt.Printf("%s %s withdrew the offer of '%s'\n",
+			utils.WarningColor("🚫"),
+			utils.UserColor(peerId),
+			utils.InfoColor(offer.Name))
+		return
+	}
+
+	if transfer, exists := GetTransfer(transferID); exists {
+		if transfer.Recipient == peerId && cancelledByPeer(transferID) {
+			closeDataChannel(transferID)
+		}
+		return
+	}
+
+	if record, exists := getOutgoingTransfer(transferID); exists && record.RecipientId == peerId {
+		removeOutgoingTransfer(transferID)
+		fmt.Printf("%s Unfinished transfer %s of '%s' cancelled by %s\n",
+			utils.WarningColor("🚫"),
+			utils.CommandColor(transferID),
+			utils.InfoColor(record.Name),
+			utils.UserColor(peerId))
+		return
+	}
+
+	session := CurrentSession()
+	if session == nil {
+		return
+	}
+	if partial, exists := findPartial(session.StoreFilePath, transferID); exists && partial.SenderId == peerId {
+		fmt.Printf("%s Unfinished transfer %s of '%s' cancelled by %s\n",
+			utils.WarningColor("🚫"),
+			utils.CommandColor(transferID),
+			utils.InfoColor(partial.FileName),
+			utils.UserColor(peerId))
+		discardPartial(session.StoreFilePath, partial)
+	}
+}
+
+// cancelledByPeer stops a running transfer the other side cancelled, reporting false
+// when it had already ended
+func cancelledByPeer(transferID string) bool {
+	transfer, exists := GetTransfer(transferID)
+	if !exists || !markCancelled(transfer) {
+		return false
+	}
+	fmt.Printf("%s Transfer %s of '%s' cancelled by %s\n",
+		utils.WarningColor("\n🚫"),
+		utils.CommandColor(transferID),
+		utils.InfoColor(transfer.Name),
+		utils.UserColor(transfer.Recipient))
+	return true
+}
+
+// notifyCancel asks the server to end a transfer for the other side as well. The server
+// finds the peer of a transfer it relays, peerId covers the ones it no longer knows.
+func notifyCancel(conn *protocol.Conn, transferID, peerId string) {
+	command := "/TRANSFER_CANCEL " + transferID
+	if peerId != "" {
+		command += " " + peerId
+	}
+	if err := conn.SendCommand(command); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error telling the other side about the cancellation:"), err)
+	}
+}
+
+// markCancelled moves a running transfer to Cancelled, reporting false once it has already ended
+func markCancelled(transfer *Transfer) bool {
+	transfer.PauseLock.Lock()
+	defer transfer.PauseLock.Unlock()
+	if transfer.Status != Active && transfer.Status != Paused {
+		return false
+	}
+	transfer.Status = Cancelled
+	if transfer.ProgressBar != nil {
+		transfer.ProgressBar.SetPaused(false)
+	}
+	transfer.notifyChanged()
+	return true
+}
+
+// isCancelled reports whether either side cancelled a transfer
+func isCancelled(transfer *Transfer) bool {
+	transfer.PauseLock.Lock()
+	defer transfer.PauseLock.Unlock()
+	return transfer.Status == Cancelled
+}
+
+// discardPartial applies the cancel policy to a partial file. A kept file loses its
+// sidecar, so it is not offered for resuming anymore.
+func discardPartial(storeFilePath string, partial *PartialTransfer) {
+	if cancelPolicy == KeepPartial {
+		os.Remove(sidecarPath(storeFilePath, partial.FileName))
+		fmt.Println(utils.InfoColor("   The partial file was kept as"), utils.InfoColor(partialPath(storeFilePath, partial.FileName)))
+		return
+	}
+	removePartial(storeFilePath, partial)
+	fmt.Println(utils.InfoColor("   The partial file was removed"))
+}
+
+// discardFolder applies the cancel policy to the entries of a folder received so far.
+// A folder that existed before the transfer is never removed.
+func discardFolder(destPath string, existed bool) {
+	if cancelPolicy == KeepPartial || existed {
+		fmt.Println(utils.InfoColor("   Entries received so far were kept in"), utils.InfoColor(destPath))
+		return
+	}
+	os.RemoveAll(destPath)
+	fmt.Println(utils.InfoColor("   Entries received so far were removed"))
+}
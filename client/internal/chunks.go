@@ -0,0 +1,341 @@
+package connection
+
+import (
+	"ItShare/helper"
+	"ItShare/protocol"
+	"ItShare/utils"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A file travels as fixed-size chunks. Before any data the sender announces the
+// digest of every chunk and the checksum of the whole file on the data channel:
+//
+//	/MANIFEST <algorithm> <chunkSize> <chunkCount>
+//	/CHUNK_HASHES <hex> <hex> ...      (repeated until every chunk is listed)
+//	/CHECKSUM <algorithm>:<hex>
+//
+// In single-pass mode the file is hashed while it is streamed, so the header says
+// "trailer" instead of a count and the digests follow the data:
+//
+//	/MANIFEST <algorithm> <chunkSize> trailer
+//	<data>
+//	/CHUNK_HASHES <hex> <hex> ...
+//	/CHECKSUM <algorithm>:<hex>
+//
+// On encrypted transfers each of these lines goes as "/SEALED <base64>", so the digests
+// reveal nothing about the file to the relay.
+//
+// Once the data has been streamed the receiver answers on the same channel with
+// /CHUNKS_OK, /CHUNKS_RETRY <index>... or /CHUNKS_FAILED <reason>. Each chunk sent
+// again is preceded by /CHUNK <index>.
+
+// Digests per /CHUNK_HASHES frame, which keeps frames well below protocol.MaxPayloadSize
+const manifestBatch = 1024
+
+// Rounds of retransmission a receiver asks for before giving up on a file
+const maxChunkRetries = 3
+
+// errChunksUnverified means chunks still failed verification after every retry
+var errChunksUnverified = errors.New("chunks still corrupted after retransmission")
+
+// singlePassMode makes this client hash the files it sends while streaming them
+var singlePassMode bool
+
+// SetSinglePassMode turns single-pass hashing on or off for outgoing files
+func SetSinglePassMode(enabled bool) {
+	singlePassMode = enabled
+}
+
+// sendManifest announces the chunk digests and checksum of a file on its data channel
+func sendManifest(conn *protocol.Conn, transferID string, manifest *helper.ChunkManifest, checksum string) error {
+	err := sendSealedCommand(conn, transferID, fmt.Sprintf("/MANIFEST %s %d %d", manifest.Algorithm, manifest.ChunkSize, manifest.Count()))
+	if err != nil {
+		return err
+	}
+	if err := sendChunkHashes(conn, transferID, manifest); err != nil {
+		return err
+	}
+	return sendSealedCommand(conn, transferID, "/CHECKSUM "+checksum)
+}
+
+// sendTrailer sends the digests of a file that was hashed while it was streamed
+func sendTrailer(conn *protocol.Conn, transferID string, manifest *helper.ChunkManifest, checksum helper.Checksum) error {
+	if err := sendChunkHashes(conn, transferID, manifest); err != nil {
+		return err
+	}
+	return sendSealedCommand(conn, transferID, "/CHECKSUM "+checksum.String())
+}
+
+func sendChunkHashes(conn *protocol.Conn, transferID string, manifest *helper.ChunkManifest) error {
+	for start := 0; start < manifest.Count(); start += manifestBatch {
+		end := min(start+manifestBatch, manifest.Count())
+		digests := make([]string, 0, end-start)
+		for _, digest := range manifest.Chunks[start:end] {
+			digests = append(digests, hex.EncodeToString(digest))
+		}
+		if err := sendSealedCommand(conn, transferID, "/CHUNK_HASHES "+strings.Join(digests, " ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveRetransmissions waits for the receiver's verdict after the data was streamed
+// and sends again the chunks it asks for, until it has all of them
+func serveRetransmissions(conn *protocol.Conn, replies *peerReplies, file *os.File, manifest *helper.ChunkManifest, transferID string) error {
+	for {
+		frame, err := replies.Receive()
+		if err != nil {
+			return err
+		}
+		if frame.Type == protocol.FrameError {
+			return errors.New(string(frame.Payload))
+		}
+		if frame.Type != protocol.FrameCommand {
+			continue
+		}
+
+		args := strings.Fields(string(frame.Payload))
+		if len(args) == 0 {
+			continue
+		}
+		switch args[0] {
+		case "/CHUNKS_OK":
+			return nil
+		case "/CHUNKS_FAILED":
+			return errChunksUnverified
+		case "/CHUNKS_RETRY":
+			fmt.Printf("%s Resending %d corrupted chunk(s) of transfer %s\n",
+				utils.WarningColor("\n🔁"), len(args)-1, utils.CommandColor(transferID))
+			for _, arg := range args[1:] {
+				index, err := strconv.Atoi(arg)
+				if err != nil || index < 0 || index >= manifest.Count() {
+					return fmt.Errorf("receiver asked for invalid chunk %q", arg)
+				}
+				if err := sendSealedCommand(conn, transferID, fmt.Sprintf("/CHUNK %d", index)); err != nil {
+					return err
+				}
+				offset, length := manifest.ChunkRange(index)
+				if _, err := io.Copy(newDataWriter(conn, transferID, offset, offset+length), io.NewSectionReader(file, offset, length)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// nextCommand returns the next command frame on the data channel. Only commands
+// are expected between the chunks, so data arriving here is a protocol error. On an
+// encrypted transfer every command of the sender must be sealed, only the pause,
+// resume and cancel requests that either side may send go in the clear.
+func (r *dataReader) nextCommand() ([]string, error) {
+	for {
+		frame, err := r.conn.Receive()
+		if err != nil {
+			return nil, ErrTransferInterrupted
+		}
+		switch frame.Type {
+		case protocol.FrameCommand:
+			if applyPeerCommand(r.transferID, string(frame.Payload)) {
+				continue
+			}
+			args := strings.Fields(string(frame.Payload))
+			if len(args) == 2 && args[0] == "/SEALED" {
+				if args, err = r.openCommand(args[1]); err != nil {
+					return nil, err
+				}
+			} else if r.cipher != nil && len(args) > 0 {
+				return nil, fmt.Errorf("unsealed %s on an encrypted transfer", args[0])
+			}
+			if len(args) > 0 {
+				return args, nil
+			}
+		case protocol.FrameError:
+			return nil, errors.New(string(frame.Payload))
+		case protocol.FrameData:
+			return nil, fmt.Errorf("unexpected data on the data channel")
+		}
+	}
+}
+
+// openCommand decrypts a command sent with sendSealedCommand, which must be the next
+// one the sender sealed
+func (r *dataReader) openCommand(encoded string) ([]string, error) {
+	if r.cipher == nil {
+		return nil, fmt.Errorf("sealed command on a transfer that is not encrypted")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, protocol.ErrDataAuthentication
+	}
+	command, err := protocol.OpenCommand(r.cipher, r.transferID, r.opened, sealed)
+	if err != nil {
+		return nil, err
+	}
+	r.opened++
+	return strings.Fields(command), nil
+}
+
+// readManifest reads the chunk manifest that precedes the data of a file of size bytes.
+// With trailer set the digests are still to come after the data, see receiveTrailer.
+func (r *dataReader) readManifest(size int64) (manifest *helper.ChunkManifest, trailer bool, err error) {
+	args, err := r.nextCommand()
+	if err != nil {
+		return nil, false, err
+	}
+	if args[0] != "/MANIFEST" || len(args) != 4 {
+		return nil, false, fmt.Errorf("expected a chunk manifest, got %s", args[0])
+	}
+	algorithm, err := helper.ParseHashAlgorithm(args[1])
+	if err != nil {
+		return nil, false, err
+	}
+	chunkSize, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || chunkSize <= 0 {
+		return nil, false, fmt.Errorf("invalid chunk size %q", args[2])
+	}
+	count := int((size + chunkSize - 1) / chunkSize)
+
+	if args[3] == "trailer" {
+		return &helper.ChunkManifest{Algorithm: algorithm, ChunkSize: chunkSize, Size: size}, true, nil
+	}
+	if args[3] != strconv.Itoa(count) {
+		return nil, false, fmt.Errorf("manifest does not describe a file of %d bytes", size)
+	}
+	chunks, err := r.readChunkHashes(count)
+	if err != nil {
+		return nil, false, err
+	}
+	manifest, err = helper.NewChunkManifest(algorithm, chunkSize, size, chunks)
+	return manifest, false, err
+}
+
+// receiveTrailer reads the digests sent after the data and checks the chunks against them.
+// The checksum of the whole file is recorded for the final verification.
+func receiveTrailer(data *dataReader, verifier *helper.ChunkVerifier, partial *PartialTransfer) error {
+	header := verifier.Manifest()
+	chunks, err := data.readChunkHashes(int((header.Size + header.ChunkSize - 1) / header.ChunkSize))
+	if err != nil {
+		return err
+	}
+	manifest, err := helper.NewChunkManifest(header.Algorithm, header.ChunkSize, header.Size, chunks)
+	if err != nil {
+		return err
+	}
+	if err := verifier.Expect(manifest); err != nil {
+		return err
+	}
+	if err := receiveChecksum(data, partial); err != nil {
+		return err
+	}
+	fmt.Println(utils.InfoColor("\n📋 Original checksum:"), utils.InfoColor(partial.Checksum))
+	return nil
+}
+
+// receiveChecksum reads the checksum of the whole file that ends the digests and records
+// it for the final verification. A resumed file must still have the checksum it started with.
+func receiveChecksum(data *dataReader, partial *PartialTransfer) error {
+	args, err := data.nextCommand()
+	if err != nil {
+		return err
+	}
+	if args[0] != "/CHECKSUM" || len(args) != 2 {
+		return fmt.Errorf("expected the file checksum, got %s", args[0])
+	}
+	checksum, err := helper.ParseChecksum(args[1])
+	if err != nil {
+		return err
+	}
+	if partial.Checksum != "" && partial.Checksum != checksum.String() {
+		return fmt.Errorf("the sender's checksum changed since the transfer started")
+	}
+	partial.Checksum = checksum.String()
+	return nil
+}
+
+func (r *dataReader) readChunkHashes(count int) ([][]byte, error) {
+	chunks := make([][]byte, 0, count)
+	for len(chunks) < count {
+		args, err := r.nextCommand()
+		if err != nil {
+			return nil, err
+		}
+		if args[0] != "/CHUNK_HASHES" || len(chunks)+len(args)-1 > count {
+			return nil, fmt.Errorf("malformed chunk manifest")
+		}
+		for _, text := range args[1:] {
+			digest, err := hex.DecodeString(text)
+			if err != nil {
+				return nil, fmt.Errorf("malformed chunk manifest")
+			}
+			chunks = append(chunks, digest)
+		}
+	}
+	return chunks, nil
+}
+
+// repairChunks asks the sender for the chunks that failed verification and writes
+// them into place until every chunk matches the manifest
+func repairChunks(data *dataReader, file *os.File, manifest *helper.ChunkManifest, failed []int) error {
+	for round := 0; len(failed) > 0; round++ {
+		if round == maxChunkRetries {
+			_ = data.conn.SendCommand(fmt.Sprintf("/CHUNKS_FAILED %d chunk(s) still corrupted", len(failed)))
+			return errChunksUnverified
+		}
+
+		fmt.Printf("%s %d chunk(s) failed verification, asking for them again\n",
+			utils.WarningColor("\n🔁"), len(failed))
+		indices := make([]string, len(failed))
+		for i, index := range failed {
+			indices[i] = strconv.Itoa(index)
+		}
+		if err := data.conn.SendCommand("/CHUNKS_RETRY " + strings.Join(indices, " ")); err != nil {
+			return ErrTransferInterrupted
+		}
+
+		var stillFailed []int
+		for _, index := range failed {
+			ok, err := receiveChunk(data, file, manifest, index)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				stillFailed = append(stillFailed, index)
+			}
+		}
+		failed = stillFailed
+	}
+	// The file is complete even if the sender misses this, it forgets the transfer
+	// once it offers to resume it
+	_ = data.conn.SendCommand("/CHUNKS_OK")
+	return nil
+}
+
+// receiveChunk writes one retransmitted chunk at its offset and reports whether it verified
+func receiveChunk(data *dataReader, file *os.File, manifest *helper.ChunkManifest, index int) (bool, error) {
+	args, err := data.nextCommand()
+	if err != nil {
+		return false, err
+	}
+	if args[0] != "/CHUNK" || len(args) != 2 || args[1] != strconv.Itoa(index) {
+		return false, fmt.Errorf("expected chunk %d from the sender", index)
+	}
+
+	h, err := helper.NewHash(manifest.Algorithm)
+	if err != nil {
+		return false, err
+	}
+	offset, length := manifest.ChunkRange(index)
+	data.expect(offset, offset+length)
+	if _, err := io.CopyN(io.MultiWriter(io.NewOffsetWriter(file, offset), h), data, length); err != nil {
+		return false, err
+	}
+	return manifest.Verify(index, h.Sum(nil)), nil
+}
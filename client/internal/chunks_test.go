@@ -0,0 +1,104 @@
+package connection
+
+import (
+	"ItShare/helper"
+	"ItShare/protocol"
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// repairTest runs repairChunks on a file with its second chunk corrupted, while the
+// sender's side of the data channel answers each request with the chunk send returns
+func repairTest(t *testing.T, send func(round int) []byte) ([]byte, []string, error) {
+	t.Helper()
+	original := bytes.Repeat([]byte("0123456789"), 3)
+	builder, _ := helper.NewManifestBuilder(helper.SHA256, 8, int64(len(original)))
+	if _, err := builder.Write(original); err != nil {
+		t.Fatal(err)
+	}
+	manifest, _ := builder.Manifest()
+
+	path := filepath.Join(t.TempDir(), "file.bin")
+	corrupted := bytes.Clone(original)
+	corrupted[10] ^= 0xff
+	if err := os.WriteFile(path, corrupted, 0600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	receiverSide, senderSide := net.Pipe()
+	defer receiverSide.Close()
+	requests := make(chan []string, 1)
+	go func() {
+		defer close(requests)
+		defer senderSide.Close()
+		var seen []string
+		sender := protocol.NewConn(senderSide)
+		for round := 0; ; round++ {
+			frame, err := sender.Receive()
+			if err != nil {
+				return
+			}
+			seen = append(seen, string(frame.Payload))
+			if string(frame.Payload) != "/CHUNKS_RETRY 1" {
+				requests <- seen
+				return
+			}
+			offset, length := manifest.ChunkRange(1)
+			_ = sender.SendCommand("/CHUNK 1")
+			_, _ = protocol.NewDataWriter(sender, "a1b2c3d4").Write(send(round)[offset : offset+length])
+		}
+	}()
+
+	err = repairChunks(newDataReader(protocol.NewConn(receiverSide), "a1b2c3d4"), file, manifest, []int{1})
+	seen := <-requests
+	repaired, readErr := os.ReadFile(path)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if !bytes.Equal(repaired[:8], original[:8]) || !bytes.Equal(repaired[16:], original[16:]) {
+		t.Fatal("chunks that verified were overwritten")
+	}
+	return repaired[8:16], seen, err
+}
+
+func TestRepairChunksRewritesFailedChunk(t *testing.T) {
+	original := bytes.Repeat([]byte("0123456789"), 3)
+	garbled := bytes.Repeat([]byte("x"), len(original))
+	// The first retransmission is corrupted too, the second one is good
+	chunk, seen, err := repairTest(t, func(round int) []byte {
+		if round == 0 {
+			return garbled
+		}
+		return original
+	})
+	if err != nil {
+		t.Fatalf("repairChunks() error = %v", err)
+	}
+	if !bytes.Equal(chunk, original[8:16]) {
+		t.Fatalf("chunk 1 = %q after repair, want %q", chunk, original[8:16])
+	}
+	want := []string{"/CHUNKS_RETRY 1", "/CHUNKS_RETRY 1", "/CHUNKS_OK"}
+	if !slices.Equal(seen, want) {
+		t.Fatalf("receiver sent %q, want %q", seen, want)
+	}
+}
+
+func TestRepairChunksGivesUp(t *testing.T) {
+	garbled := bytes.Repeat([]byte("x"), 30)
+	_, seen, err := repairTest(t, func(int) []byte { return garbled })
+	if err != errChunksUnverified {
+		t.Fatalf("repairChunks() error = %v, want %v", err, errChunksUnverified)
+	}
+	if len(seen) != maxChunkRetries+1 || seen[len(seen)-1] != "/CHUNKS_FAILED 1 chunk(s) still corrupted" {
+		t.Fatalf("receiver sent %q, want %d retries then /CHUNKS_FAILED", seen, maxChunkRetries)
+	}
+}
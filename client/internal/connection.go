@@ -4,60 +4,188 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
-	"net"
 	"os"
 	"strconv"
 	"strings"
 	"time"
+	"ItShare/protocol"
 	"ItShare/utils"
 )
 
-func Connect(address string) (net.Conn, error) {
-	conn, err := net.Dial("tcp", address)
+// Connect opens the control connection to the server, see dialServer
+func Connect(address string) (*protocol.Conn, error) {
+	return dialServer(address, true)
+}
+
+func Close(conn *protocol.Conn) {
+	conn.Close()
+}
+
+// stdin is shared by every prompt so buffered input is never lost between readers
+var stdin = bufio.NewReader(os.Stdin)
+
+// readLine reads one trimmed line from the terminal
+func readLine() (string, error) {
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// ReadLine reads one trimmed line from the terminal for prompts outside this package
+func ReadLine() (string, error) {
+	return readLine()
+}
+
+// Login resumes the session saved for address, or asks for a username and store path
+// and saves the token the server issues
+func Login(conn *protocol.Conn, address string) error {
+	if saved, ok := LoadSession(address); ok {
+		resumed, err := resumeSession(conn, address, saved)
+		if err != nil {
+			return err
+		}
+		if resumed {
+			return announceClient(conn)
+		}
+		ClearSession(address)
+		fmt.Println(utils.WarningColor("⚠ Your saved session has expired, please log in again"))
+	}
+
+	fmt.Println(utils.InfoColor("Please login to continue:"))
+	credentials := loadCredentials(address)
+	username := credentials.Username
+	if username == "" {
+		var err error
+		if username, err = UserInput("Username"); err != nil {
+			return err
+		}
+	}
+
+	storeFilePath, err := UserInput("Store File Path")
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if err := conn.SendCommand("/LOGIN " + username + " " + storeFilePath); err != nil {
+		return fmt.Errorf("error in write login: %v", err)
+	}
+
+	// The server may ask for a password before it answers with /SESSION <token> <userId>
+	for {
+		frame, err := conn.Receive()
+		if err != nil {
+			return err
+		}
+		if frame.Type == protocol.FrameError {
+			return errors.New(string(frame.Payload))
+		}
+		message := string(frame.Payload)
+		if message == "/AUTH_REQUIRED" || message == "/AUTH_FAILED" {
+			password := credentials.Password
+			// A configured password is only tried once
+			credentials.Password = ""
+			if message == "/AUTH_FAILED" {
+				fmt.Println(utils.ErrorColor("❌ Wrong password"))
+			}
+			if password == "" {
+				if password, err = promptPassword(address); err != nil {
+					return err
+				}
+			}
+			if err := conn.SendCommand("/PASSWORD " + password); err != nil {
+				return fmt.Errorf("error in write password: %v", err)
+			}
+			continue
+		}
+		if !strings.HasPrefix(message, "/SESSION ") {
+			continue
+		}
+		parts := strings.Fields(message)
+		if len(parts) != 3 {
+			return fmt.Errorf("invalid session reply from server")
+		}
+		session := &Session{
+			Token:         parts[1],
+			UserId:        parts[2],
+			Username:      username,
+			StoreFilePath: storeFilePath,
+		}
+		setCurrentSession(address, session)
+		if err := SaveSession(address, session); err != nil {
+			fmt.Println(utils.WarningColor("⚠ Could not save session, you will need to log in again next time:"), err)
+		}
+		fmt.Println(utils.InfoColor("Your user ID is"), utils.CommandColor(session.UserId))
+		return announceClient(conn)
 	}
-	return conn, nil
 }
 
-func Close(conn net.Conn) {
-	conn.Close()
+// announceClient tells the server which checksums this client supports and publishes its key
+func announceClient(conn *protocol.Conn) error {
+	if err := announceHashes(conn); err != nil {
+		return err
+	}
+	return announceIdentity(conn)
 }
 
-func UserInput(attribute string, conn net.Conn) error {
-	// First check if we get a reconnection signal
-	buffer := make([]byte, 1024)
-	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
-	n, err := conn.Read(buffer)
-	conn.SetReadDeadline(time.Time{}) // Reset read deadline
+// resumeSession presents a saved token, reporting whether the server accepted it
+func resumeSession(conn *protocol.Conn, address string, saved *Session) (bool, error) {
+	if err := conn.SendCommand("/RESUME_SESSION " + saved.Token); err != nil {
+		return false, err
+	}
 
-	if err == nil && n > 0 {
-		message := string(buffer[:n])
-		if strings.HasPrefix(message, "/RECONNECT") {
+	for {
+		frame, err := conn.Receive()
+		if err != nil {
+			return false, err
+		}
+		message := string(frame.Payload)
+		switch {
+		case message == "/RESUME_FAILED":
+			return false, nil
+		case strings.HasPrefix(message, "/RECONNECT"):
 			parts := strings.SplitN(message, " ", 4)
-			if len(parts) == 3 {
-				fmt.Printf("Welcome back %s!\n", parts[1])
-				return errors.New("reconnect")
+			if len(parts) != 4 {
+				return false, fmt.Errorf("invalid reconnect reply from server")
 			}
+			saved.UserId = parts[1]
+			saved.Username = parts[2]
+			saved.StoreFilePath = parts[3]
+			setCurrentSession(address, saved)
+			fmt.Printf("Welcome back %s!\n", utils.UserColor(saved.Username))
+			return true, nil
 		}
 	}
+}
 
-	// If no reconnection signal, proceed with normal user input
-	reader := bufio.NewReader(os.Stdin)
-
+// UserInput prompts for a login attribute, validating the store file path
+func UserInput(attribute string) (string, error) {
 	fmt.Println("Enter your " + attribute + ": ")
-	input, _ := reader.ReadString('\n')
-	input = strings.TrimSpace(input)
+	input, err := readLine()
+	if err != nil {
+		return "", err
+	}
+
+	if attribute == "Username" {
+		for input == "" || strings.HasPrefix(input, "/") || strings.ContainsAny(input, " \t") || isNumeric(input) {
+			fmt.Println(utils.ErrorColor("❌ Error: Username must be a single word, cannot start with '/' and cannot be a number"))
+			fmt.Println("Enter a valid " + attribute + ": ")
+			if input, err = readLine(); err != nil {
+				return "", err
+			}
+		}
+	}
 
 	// If it's a store file path, validate it
 	if attribute == "Store File Path" {
 		for {
 			// Check if path exists
 			if _, err := os.Stat(input); os.IsNotExist(err) {
-				fmt.Println(utils.ErrorColor("❌ Error: Directory does not exist")) 
+				fmt.Println(utils.ErrorColor("❌ Error: Directory does not exist"))
 				fmt.Println("Enter a valid " + attribute + ": ")
-				input, _ = reader.ReadString('\n')
-				input = strings.TrimSpace(input)
+				if input, err = readLine(); err != nil {
+					return "", err
+				}
 				continue
 			}
 
@@ -66,8 +194,9 @@ func UserInput(attribute string, conn net.Conn) error {
 			if err != nil || !fileInfo.IsDir() {
 				fmt.Println(utils.ErrorColor("❌ Error: Path is not a directory"))
 				fmt.Println("Enter a valid " + attribute + ": ")
-				input, _ = reader.ReadString('\n')
-				input = strings.TrimSpace(input)
+				if input, err = readLine(); err != nil {
+					return "", err
+				}
 				continue
 			}
 
@@ -75,93 +204,215 @@ func UserInput(attribute string, conn net.Conn) error {
 		}
 	}
 
-	_, err = conn.Write([]byte(input))
-	if err != nil {
-		fmt.Println("error in write " + attribute)
-		panic(err)
-	}
-
-	return nil
+	return input, nil
 }
 
-func ReadLoop(conn net.Conn) {
+func ReadLoop(conn *protocol.Conn) {
 	for {
-		buffer := make([]byte, 1024)
-		n, err := conn.Read(buffer)
+		frame, err := conn.Receive()
 		if err != nil {
 			fmt.Println(utils.ErrorColor("❌ Connection lost:"), err)
 			return
 		}
-		message := string(buffer[:n])
+
+		switch frame.Type {
+		case protocol.FrameError:
+			fmt.Println(utils.ErrorColor("❌ " + string(frame.Payload)))
+			continue
+		case protocol.FrameChat:
+			displayChat(string(frame.Payload))
+			continue
+		}
+
+		message := string(frame.Payload)
 		switch {
 		case strings.HasPrefix(message, "/FILE_RESPONSE"):
-			fmt.Println(utils.InfoColor("📥 File transfer starting..."))
-			args := strings.SplitN(message, " ", 5)
-			if len(args) != 5 {
-				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /FILE_RESPONSE <userId> <filename> <fileSize> <storeFilePath>"))
+			args := strings.SplitN(message, " ", 7)
+			if len(args) != 7 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /FILE_RESPONSE <userId> <filename> <fileSize> <transferId> <checksum> <storeFilePath>"))
 				continue
 			}
-			recipientId := args[1]
+			senderId := args[1]
 			fileName := args[2]
 			fileSizeStr := strings.TrimSpace(args[3])
 			fileSize, err := strconv.ParseInt(fileSizeStr, 10, 64)
-			storeFilePath := args[4]
-			if err != nil {
-				fmt.Println(utils.ErrorColor("❌ Invalid fileSize. Use: /FILE_RESPONSE <userId> <filename> <fileSize> <storeFilePath>"))
+			transferID, checksum := args[4], args[5]
+			storeFilePath := args[6]
+			if err != nil || transferID == emptyField {
+				fmt.Println(utils.ErrorColor("❌ Invalid fileSize or transferId. Use: /FILE_RESPONSE <userId> <filename> <fileSize> <transferId> <checksum> <storeFilePath>"))
 				continue
 			}
+			if checksum == emptyField {
+				checksum = ""
+			}
 
-			HandleFileTransfer(conn, recipientId, fileName, int64(fileSize), storeFilePath)
+			offerReceived(conn, &IncomingOffer{
+				TransferId: transferID,
+				Type:       FileTransfer,
+				SenderId:   senderId,
+				Name:       fileName,
+				Size:       fileSize,
+				Checksum:   checksum,
+				StorePath:  storeFilePath,
+				Received:   time.Now(),
+			})
 			continue
 		case strings.HasPrefix(message, "/FOLDER_RESPONSE"):
-			fmt.Println(utils.InfoColor("📥 Folder transfer starting..."))
-			args := strings.SplitN(message, " ", 5)
-			if len(args) != 5 {
-				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /FOLDER_RESPONSE <userId> <folderName> <folderSize> <storeFilePath>"))
+			args := strings.SplitN(message, " ", 7)
+			if len(args) != 7 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /FOLDER_RESPONSE <userId> <folderName> <folderSize> <transferId> <checksum> <storeFilePath>"))
 				continue
 			}
-			
-			recipientId := args[1]
+
+			senderId := args[1]
 			folderName := args[2]
 			folderSizeStr := strings.TrimSpace(args[3])
 			folderSize, err := strconv.ParseInt(folderSizeStr, 10, 64)
-			storeFilePath := args[4]
+			transferID, checksum := args[4], args[5]
+			storeFilePath := args[6]
+			if err != nil || transferID == emptyField {
+				fmt.Println(utils.ErrorColor("❌ Invalid folderSize or transferId. Use: /FOLDER_RESPONSE <userId> <folderName> <folderSize> <transferId> <checksum> <storeFilePath>"))
+				continue
+			}
+			if checksum == emptyField {
+				checksum = ""
+			}
+
+			offerReceived(conn, &IncomingOffer{
+				TransferId: transferID,
+				Type:       FolderTransfer,
+				SenderId:   senderId,
+				Name:       folderName,
+				Size:       folderSize,
+				Checksum:   checksum,
+				StorePath:  storeFilePath,
+				Received:   time.Now(),
+			})
+			continue
+		case strings.HasPrefix(message, "/TRANSFER_READY"), strings.HasPrefix(message, "/TRANSFER_DENIED"):
+			args := strings.SplitN(message, " ", 3)
+			if len(args) < 2 {
+				continue
+			}
+			if !deliverReply("transfer:"+args[1], message) && len(args) == 3 {
+				fmt.Println(utils.ErrorColor("❌ Transfer " + args[1] + " refused: " + args[2]))
+			}
+			continue
+		case strings.HasPrefix(message, "/USER_OF"):
+			args := strings.Fields(message)
+			if len(args) < 2 {
+				continue
+			}
+			deliverReply("user:"+args[1], message)
+			continue
+		case strings.HasPrefix(message, "/PUBKEY_OF"):
+			args := strings.Fields(message)
+			if len(args) < 2 {
+				continue
+			}
+			deliverReply("pubkey:"+args[1], message)
+			continue
+		case strings.HasPrefix(message, "/HASHES_OF"):
+			args := strings.Fields(message)
+			if len(args) < 2 {
+				continue
+			}
+			deliverReply("hashes:"+args[1], message)
+			continue
+		case strings.HasPrefix(message, "/OFFER_CLOSED"):
+			args := strings.SplitN(message, " ", 3)
+			if len(args) != 3 {
+				continue
+			}
+			offerClosed(args[1], args[2])
+			continue
+		case strings.HasPrefix(message, "/DIRECT_OFFER"):
+			// Arrives just before the response of the transfer it belongs to
+			args := strings.Fields(message)
+			if len(args) != 4 {
+				continue
+			}
+			rememberDirectOffer(args[1], args[2], args[3])
+			continue
+		case strings.HasPrefix(message, "/DIRECT_FALLBACK"):
+			args := strings.Fields(message)
+			if len(args) != 2 {
+				continue
+			}
+			deliverReply("direct:"+args[1], message)
+			continue
+		case strings.HasPrefix(message, "/TRANSFER_INTERRUPTED"):
+			args := strings.Fields(message)
+			if len(args) != 2 {
+				continue
+			}
+			interruptTransfer(args[1])
+			continue
+		case strings.HasPrefix(message, "/RESUME_REQUEST"):
+			args := strings.Fields(message)
+			if len(args) != 4 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /RESUME_REQUEST <userId> <transferId> <offset>"))
+				continue
+			}
+			offset, err := strconv.ParseInt(args[3], 10, 64)
 			if err != nil {
-				fmt.Println(utils.ErrorColor("❌ Invalid folderSize. Use: /FOLDER_RESPONSE <userId> <folderName> <folderSize> <storeFilePath>"))
+				fmt.Println(utils.ErrorColor("❌ Invalid offset. Use: /RESUME_REQUEST <userId> <transferId> <offset>"))
 				continue
 			}
-			HandleFolderTransfer(conn, recipientId, folderName, folderSize, storeFilePath)
+			go HandleResumeRequest(conn, args[1], args[2], offset)
 			continue
-		case strings.HasPrefix(message, "PING"):
-			_, err = conn.Write([]byte("PONG\n"))
+		case strings.HasPrefix(message, "/RESUME_OFFER"):
+			args := strings.Fields(message)
+			if len(args) != 3 {
+				continue
+			}
+			go handleResumeOffer(conn, args[1], args[2])
+			continue
+		case strings.HasPrefix(message, "/RESUME_RESPONSE"):
+			args := strings.Fields(message)
+			if len(args) != 4 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /RESUME_RESPONSE <userId> <transferId> <offset>"))
+				continue
+			}
+			senderId, transferID := args[1], args[2]
+			offset, err := strconv.ParseInt(args[3], 10, 64)
 			if err != nil {
-				fmt.Println(utils.ErrorColor("❌ Error responding to heartbeat:"), err)
+				fmt.Println(utils.ErrorColor("❌ Invalid offset. Use: /RESUME_RESPONSE <userId> <transferId> <offset>"))
 				continue
 			}
-		case message == "USERS:":
 
-			// Improved approach to accumulate the complete user list
+			go receiveTransfer(conn, transferID, senderId, func(data *dataReader) {
+				resumeFileTransfer(conn, data, senderId, transferID, offset)
+			})
+			continue
+		case strings.HasPrefix(message, "/TRANSFER_CANCELLED"):
+			args := strings.Fields(message)
+			if len(args) != 3 {
+				continue
+			}
+			handlePeerCancel(args[1], args[2])
+			continue
+		case strings.HasPrefix(message, "/RESUME_UNAVAILABLE"):
+			args := strings.Fields(message)
+			if len(args) != 3 {
+				continue
+			}
+			handleResumeUnavailable(args[1], args[2])
+			continue
+		case strings.HasPrefix(message, "/ROOM"):
+			handleRoomResponse(message)
+			continue
+		case message == "PING":
+			err = conn.SendCommand("PONG")
+			if err != nil {
+				fmt.Println(utils.ErrorColor("❌ Error responding to heartbeat:"), err)
+				continue
+			}
+		case strings.HasPrefix(message, "USERS:"):
 			fmt.Println(utils.HeaderColor("\n👥 Online Users:"))
 			fmt.Println(utils.InfoColor("-------------------"))
 
-			// Read the complete user list with timeout
-			userList := ""
-			tempBuf := make([]byte, 1024)
-			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
-
-			for {
-				m, err := conn.Read(tempBuf)
-				if err != nil {
-					break // Break on error (likely timeout)
-				}
-				userList += string(tempBuf[:m])
-				if m < 1024 {
-					break // All data received
-				}
-			}
-
-			// Reset the deadline
-			conn.SetReadDeadline(time.Time{})
+			userList := strings.TrimPrefix(message, "USERS:")
 
 			// Process users
 			userCount := 0
@@ -182,7 +433,7 @@ func ReadLoop(conn net.Conn) {
 									utils.UserColor(username),
 									utils.InfoColor("(ID:"),
 									utils.CommandColor(userId),
-									utils.InfoColor(")"+status))
+									utils.InfoColor(") "+status))
 								continue
 							}
 						}
@@ -204,7 +455,7 @@ func ReadLoop(conn net.Conn) {
 			storageFilePath := args[2]
 			userId := args[1]
 			fmt.Println(utils.InfoColor("🔍 Processing directory lookup request from"), utils.UserColor(userId))
-			HandleLookupResponse(conn, storageFilePath, userId)
+			go HandleLookupResponse(conn, storageFilePath, userId)
 			continue
 		case strings.HasPrefix(message, "/LOOK_RESPONSE"):
 			args := strings.SplitN(message, " ", 3)
@@ -213,7 +464,7 @@ func ReadLoop(conn net.Conn) {
 				continue
 			}
 			userId := args[1]
-			files := strings.Split(args[2], " ")
+			files := strings.Split(args[2], "\n")
 
 			fmt.Println(utils.HeaderColor("\n📂 Directory Listing for User:"), utils.UserColor(userId))
 			fmt.Println(utils.InfoColor("-------------------------------------------"))
@@ -241,33 +492,54 @@ func ReadLoop(conn net.Conn) {
 			userId := args[1]
 			filePath := args[2]
 			fmt.Println(utils.InfoColor("📤 Download request from"), utils.UserColor(userId), utils.InfoColor("for"), utils.InfoColor(filePath))
-			HandleDownloadResponse(conn, userId, filePath)
+			go HandleDownloadResponse(conn, userId, filePath)
 			continue
 		default:
-			if strings.Contains(message, "has joined the chat") {
-				fmt.Println(utils.WarningColor("👋 " + message))
-			} else if strings.Contains(message, "has rejoined the chat") {
-				fmt.Println(utils.WarningColor("🔄 " + message))
-			} else if strings.Contains(message, "is now offline") {
-				fmt.Println(utils.WarningColor("👋 " + message))
-			} else {
-				fmt.Println(message)
-			}
+			fmt.Println(utils.WarningColor("⚠ Unknown command from server:"), message)
 		}
 	}
 }
 
-func WriteLoop(conn net.Conn) {
-	reader := bufio.NewReader(os.Stdin)
+// displayChat prints a chat frame, highlighting presence notifications
+func displayChat(message string) {
+	if strings.HasPrefix(message, "[Room: ") {
+		if end := strings.Index(message, "]"); end != -1 {
+			fmt.Println(utils.RoomColor(message[:end+1]) + message[end+1:])
+			return
+		}
+	}
+	if strings.Contains(message, "has joined the chat") {
+		fmt.Println(utils.WarningColor("👋 " + message))
+	} else if strings.Contains(message, "has rejoined the chat") {
+		fmt.Println(utils.WarningColor("🔄 " + message))
+	} else if strings.Contains(message, "is now offline") {
+		fmt.Println(utils.WarningColor("👋 " + message))
+	} else {
+		fmt.Println(message)
+	}
+}
+
+func WriteLoop(conn *protocol.Conn) {
 	for {
-		fmt.Print(utils.CommandColor(">>> "))
-		message, _ := reader.ReadString('\n')
-		message = strings.TrimSpace(message)
+		fmt.Print(promptPrefix() + utils.CommandColor(">>> "))
+		message, err := readLine()
+		if err != nil {
+			message = "exit"
+		}
 		switch {
 		case message == "exit":
 			fmt.Println(utils.InfoColor("👋 Goodbye!"))
 			conn.Close()
 			return
+		case message == "/exit":
+			// Logging out ends the session on the server, so it is not resumed next time
+			if err := conn.SendCommand("/exit"); err != nil {
+				fmt.Println(utils.ErrorColor("❌ Error logging out:"), err)
+			}
+			ClearSession(CurrentServer())
+			fmt.Println(utils.InfoColor("👋 Logged out, goodbye!"))
+			conn.Close()
+			return
 		case message == "/help":
 			utils.PrintHelp()
 			continue
@@ -277,10 +549,13 @@ func WriteLoop(conn net.Conn) {
 				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /sendfile <userId> <filename>"))
 				continue
 			}
-			recipientId := args[1]
+			recipientId, ok := userIdArg(conn, args[1])
+			if !ok {
+				continue
+			}
 			filePath := args[2]
 			fmt.Println(utils.InfoColor("📤 Sending file to"), utils.UserColor(recipientId))
-			HandleSendFile(conn, recipientId, filePath)
+			enqueueSend(conn, FileTransfer, recipientId, filePath)
 			continue
 		case strings.HasPrefix(message, "/sendfolder"):
 			args := strings.SplitN(message, " ", 3)
@@ -288,10 +563,13 @@ func WriteLoop(conn net.Conn) {
 				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /sendfolder <userId> <folderPath>"))
 				continue
 			}
-			recipientId := args[1]
+			recipientId, ok := userIdArg(conn, args[1])
+			if !ok {
+				continue
+			}
 			folderPath := args[2]
 			fmt.Println(utils.InfoColor("📤 Sending folder to"), utils.UserColor(recipientId))
-			HandleSendFolder(conn, recipientId, folderPath)
+			enqueueSend(conn, FolderTransfer, recipientId, folderPath)
 			continue
 		case strings.HasPrefix(message, "/lookup"):
 			args := strings.SplitN(message, " ", 2)
@@ -299,13 +577,16 @@ func WriteLoop(conn net.Conn) {
 				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /lookup <userId>"))
 				continue
 			}
-			recipientId := args[1]
+			recipientId, ok := userIdArg(conn, strings.TrimSpace(args[1]))
+			if !ok {
+				continue
+			}
 			fmt.Println(utils.InfoColor("🔍 Looking up files for user"), utils.UserColor(recipientId))
 			HandleLookupRequest(conn, recipientId)
 			continue
 		case strings.HasPrefix(message, "/status"):
 			fmt.Println(utils.InfoColor("👥 Fetching online users..."))
-			_, err := conn.Write([]byte(message))
+			err := conn.SendCommand(message)
 			if err != nil {
 				fmt.Println(utils.ErrorColor("❌ Error checking status:"), err)
 				continue
@@ -317,11 +598,115 @@ func WriteLoop(conn net.Conn) {
 				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /download <userId> <filename>"))
 				continue
 			}
-			recipientId := args[1]
+			recipientId, ok := userIdArg(conn, args[1])
+			if !ok {
+				continue
+			}
 			filePath := args[2]
 			fmt.Println(utils.InfoColor("📥 Requesting download from"), utils.UserColor(recipientId))
 			HandleDownloadRequest(conn, recipientId, filePath)
 			continue
+		case strings.HasPrefix(message, "/createroom"):
+			args := strings.Fields(message)
+			if len(args) < 3 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /createroom <roomName> <userId1> [userId2] ..."))
+				continue
+			}
+			memberIds := make([]string, 0, len(args)-2)
+			for _, member := range args[2:] {
+				memberId, ok := userIdArg(conn, member)
+				if !ok {
+					break
+				}
+				memberIds = append(memberIds, memberId)
+			}
+			if len(memberIds) == len(args)-2 {
+				HandleCreateRoom(conn, args[1], memberIds)
+			}
+			continue
+		case strings.HasPrefix(message, "/joinroom"):
+			args := strings.Fields(message)
+			if len(args) != 2 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /joinroom <roomId>"))
+				continue
+			}
+			HandleJoinRoom(conn, args[1])
+			continue
+		case strings.HasPrefix(message, "/invite"):
+			args := strings.Fields(message)
+			if len(args) != 3 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /invite <roomId> <userId>"))
+				continue
+			}
+			if userId, ok := userIdArg(conn, args[2]); ok {
+				HandleInviteToRoom(conn, args[1], userId)
+			}
+			continue
+		case strings.HasPrefix(message, "/leaveroom"):
+			args := strings.Fields(message)
+			if len(args) != 2 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /leaveroom <roomId>"))
+				continue
+			}
+			HandleLeaveRoom(conn, args[1])
+			continue
+		case strings.HasPrefix(message, "/selectroom"):
+			args := strings.Fields(message)
+			if len(args) != 2 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /selectroom <roomId|global>"))
+				continue
+			}
+			HandleSelectRoom(conn, args[1])
+			continue
+		case message == "/listrooms":
+			HandleListRooms(conn)
+			continue
+		case strings.HasPrefix(message, "/roominfo"):
+			args := strings.Fields(message)
+			if len(args) != 2 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /roominfo <roomId>"))
+				continue
+			}
+			HandleRoomInfo(conn, args[1])
+			continue
+		case strings.HasPrefix(message, "/accept"):
+			args := strings.Fields(message)
+			if len(args) != 2 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /accept <transferId>"))
+				continue
+			}
+			HandleAcceptOffer(conn, args[1])
+			continue
+		case strings.HasPrefix(message, "/reject"):
+			args := strings.Fields(message)
+			if len(args) != 2 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /reject <transferId>"))
+				continue
+			}
+			HandleRejectOffer(conn, args[1])
+			continue
+		case strings.HasPrefix(message, "/autoaccept"):
+			// Rules name users, who may be given by ID here
+			args := strings.Fields(message)[1:]
+			if len(args) == 1 && args[0] != "off" {
+				_, username, err := lookupUser(conn, args[0])
+				if err != nil {
+					fmt.Println(utils.ErrorColor("❌ Error looking up user "+args[0]+":"), err)
+					continue
+				}
+				if username == "" {
+					fmt.Println(utils.ErrorColor("❌ No user with the name or ID"), utils.UserColor(args[0]))
+					continue
+				}
+				args[0] = username
+			} else if len(args) == 2 && args[0] == "off" {
+				// A rule for a user the server no longer knows can still be removed by name
+				if _, username, err := lookupUser(conn, args[1]); err == nil && username != "" {
+					args[1] = username
+				}
+			}
+			HandleAutoAccept(args)
+			continue
 		case strings.HasPrefix(message, "/transfers"):
 			HandleListTransfers()
 			continue
@@ -334,6 +719,36 @@ func WriteLoop(conn net.Conn) {
 			transferID := args[1]
 			HandlePauseTransfer(transferID)
 			continue
+		case strings.HasPrefix(message, "/priority"):
+			args := strings.Fields(message)
+			if len(args) != 3 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /priority <transferId> high|low"))
+				continue
+			}
+			HandlePriority(args[1], args[2])
+			continue
+		case message == "/fingerprint":
+			HandleFingerprint()
+			continue
+		case strings.HasPrefix(message, "/limit"):
+			args := strings.Fields(message)[1:]
+			if len(args) == 3 && args[0] == "user" {
+				userId, ok := userIdArg(conn, args[1])
+				if !ok {
+					continue
+				}
+				args[1] = userId
+			}
+			HandleLimit(args)
+			continue
+		case strings.HasPrefix(message, "/cancel"):
+			args := strings.Fields(message)
+			if len(args) != 2 {
+				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /cancel <transferId>"))
+				continue
+			}
+			HandleCancelTransfer(conn, args[1])
+			continue
 		case strings.HasPrefix(message, "/resume"):
 			args := strings.SplitN(message, " ", 2)
 			if len(args) != 2 {
@@ -345,7 +760,7 @@ func WriteLoop(conn net.Conn) {
 			continue
 		default:
 			if message != "" {
-				_, err := conn.Write([]byte(message))
+				err := conn.SendChat(message)
 				if err != nil {
 					fmt.Println(utils.ErrorColor("❌ Error sending message:"), err)
 					return
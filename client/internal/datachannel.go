@@ -0,0 +1,155 @@
+package connection
+
+import (
+	"ItShare/protocol"
+	"ItShare/utils"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// dataChannels holds the data connections of each running transfer, more than one
+// when it is split over parallel streams. Payloads never travel on the control
+// connection, so chat and heartbeats stay responsive.
+var (
+	dataChannels      = make(map[string][]*protocol.Conn)
+	dataChannelsMutex sync.Mutex
+)
+
+// openDataChannel opens a connection to the server dedicated to one side of a transfer.
+// role is "send" or "receive".
+func openDataChannel(transferID, role string) (*protocol.Conn, error) {
+	return openStreamChannel(transferID, role, 0)
+}
+
+// openStreamChannel opens the data connection of one stream of a transfer. Stream 0
+// is the transfer's own channel, the others carry a byte range each.
+func openStreamChannel(transferID, role string, stream int) (*protocol.Conn, error) {
+	session := CurrentSession()
+	if session == nil {
+		return nil, fmt.Errorf("not logged in")
+	}
+
+	conn, err := dialServer(CurrentServer(), false)
+	if err != nil {
+		return nil, err
+	}
+	handshake := fmt.Sprintf("/DATA %s %s %s", session.Token, transferID, role)
+	if stream > 0 {
+		handshake += fmt.Sprintf(" %d", stream)
+	}
+	if err := conn.SendCommand(handshake); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	addDataChannel(transferID, conn)
+	return conn, nil
+}
+
+func addDataChannel(transferID string, conn *protocol.Conn) {
+	dataChannelsMutex.Lock()
+	defer dataChannelsMutex.Unlock()
+	dataChannels[transferID] = append(dataChannels[transferID], conn)
+}
+
+// closeDataChannel closes the data connections of a transfer once it is done
+func closeDataChannel(transferID string) {
+	dataChannelsMutex.Lock()
+	conns := dataChannels[transferID]
+	delete(dataChannels, transferID)
+	dataChannelsMutex.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// receiveTransfer opens the receiving data channel of a transfer and hands its payload to handle
+func receiveTransfer(control *protocol.Conn, transferID, senderId string, handle func(data *dataReader)) {
+	if err := setupEncryption(control, senderId, transferID, false); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error setting up encryption:"), err)
+		return
+	}
+	defer dropTransferCipher(transferID)
+
+	conn, direct, err := openReceiveChannel(control, transferID)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error opening data connection:"), err)
+		return
+	}
+	defer closeDataChannel(transferID)
+	data := newDataReader(conn, transferID)
+	data.direct = direct
+	handle(data)
+}
+
+// drain reads until the sender closes the channel or the timeout expires, so that
+// closing this side with data still unread does not cut off what was sent on it
+func (r *dataReader) drain(timeout time.Duration) {
+	r.conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		if _, err := r.conn.Receive(); err != nil {
+			return
+		}
+	}
+}
+
+// dataReader yields the payload of the data frames arriving on a data channel,
+// decrypted when the transfer is encrypted
+type dataReader struct {
+	conn       *protocol.Conn
+	transferID string
+	chunk      []byte
+	direct     bool // connected straight to the sender rather than through the relay
+	cipher     cipher.AEAD
+	offset     int64  // where the next chunk lies in the stream being read
+	end        int64  // where that stream ends, as the receiver expects it
+	opened     uint64 // sealed commands opened so far, which numbers the next one
+}
+
+func newDataReader(conn *protocol.Conn, transferID string) *dataReader {
+	return &dataReader{conn: conn, transferID: transferID, cipher: transferCipher(transferID)}
+}
+
+// expect tells the reader that the data to come is the part of the transfer's stream
+// from offset to end, which sealed chunks must have been sent for
+func (r *dataReader) expect(offset, end int64) {
+	r.offset, r.end = offset, end
+}
+
+// Read implements io.Reader. A closed channel means the transfer was cut short,
+// since the receiver never reads past the size it expects.
+func (r *dataReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		frame, err := r.conn.Receive()
+		if err != nil {
+			return 0, ErrTransferInterrupted
+		}
+		switch frame.Type {
+		case protocol.FrameData:
+			transferID, chunk, err := protocol.DecodeData(frame.Payload)
+			if err != nil {
+				return 0, err
+			}
+			if transferID != r.transferID {
+				continue
+			}
+			if r.cipher != nil {
+				if chunk, err = protocol.OpenData(r.cipher, transferID, r.offset, r.end, chunk); err != nil {
+					return 0, err
+				}
+			}
+			r.offset += int64(len(chunk))
+			r.chunk = chunk
+		case protocol.FrameCommand:
+			applyPeerCommand(r.transferID, string(frame.Payload))
+		case protocol.FrameError:
+			return 0, errors.New(string(frame.Payload))
+		}
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
@@ -0,0 +1,188 @@
+package connection
+
+import (
+	"ItShare/protocol"
+	"ItShare/utils"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long a receiver tries to reach the sender before using the relay
+	directDialTimeout = 3 * time.Second
+	// How long a sender waits for its receiver to connect, directly or through the relay
+	directAcceptTimeout = 30 * time.Second
+)
+
+// directMode makes this client offer direct connections for the files it sends
+var directMode bool
+
+// SetDirectMode turns direct peer-to-peer transfers on or off for outgoing transfers
+func SetDirectMode(enabled bool) {
+	directMode = enabled
+}
+
+// directOffer is the sender endpoint and one-time token announced for an incoming transfer
+type directOffer struct {
+	endpoint string
+	token    string
+}
+
+var (
+	directOffers      = make(map[string]directOffer)
+	directOffersMutex sync.Mutex
+)
+
+// rememberDirectOffer keeps an offer until the response for its transfer arrives
+func rememberDirectOffer(transferID, endpoint, token string) {
+	directOffersMutex.Lock()
+	defer directOffersMutex.Unlock()
+	directOffers[transferID] = directOffer{endpoint: endpoint, token: token}
+}
+
+func takeDirectOffer(transferID string) (directOffer, bool) {
+	directOffersMutex.Lock()
+	defer directOffersMutex.Unlock()
+	offer, exists := directOffers[transferID]
+	delete(directOffers, transferID)
+	return offer, exists
+}
+
+// directSend is a sender's offer of a direct connection for one transfer
+type directSend struct {
+	transferID string
+	listener   net.Listener
+	port       string
+	fallback   chan string
+}
+
+// offerDirectSend opens the listener a sender offers to its receiver. It returns
+// nil when direct mode is off or no listener could be opened, and the relay is used.
+// The fallback notice is registered here, before the request that may trigger it.
+func offerDirectSend(transferID string) *directSend {
+	if !directMode {
+		return nil
+	}
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		fmt.Println(utils.WarningColor("⚠ Cannot listen for a direct connection, using the server relay:"), err)
+		return nil
+	}
+	return &directSend{
+		transferID: transferID,
+		listener:   listener,
+		port:       strconv.Itoa(listener.Addr().(*net.TCPAddr).Port),
+		fallback:   expectReply("direct:" + transferID),
+	}
+}
+
+// withPort appends the direct port to a transfer request when one is offered
+func (d *directSend) withPort(request string) string {
+	if d == nil {
+		return request
+	}
+	return request + " " + d.port
+}
+
+// abandon releases the listener of an offer that will not be used
+func (d *directSend) abandon() {
+	if d == nil {
+		return
+	}
+	d.listener.Close()
+	cancelReply("direct:" + d.transferID)
+}
+
+// readyToken extracts the direct connection token from a /TRANSFER_READY reply
+func readyToken(reply string) string {
+	args := strings.Fields(reply)
+	if len(args) == 3 {
+		return args[2]
+	}
+	return ""
+}
+
+// openSendChannel returns the connection a sender streams its payload on: the
+// receiver's direct connection when it arrives, the server relay otherwise
+func openSendChannel(transferID string, direct *directSend, token string) (*protocol.Conn, error) {
+	if direct == nil {
+		return openDataChannel(transferID, "send")
+	}
+	defer direct.abandon()
+	if token == "" {
+		// The server did not pass the offer on
+		return openDataChannel(transferID, "send")
+	}
+
+	accepted := make(chan *protocol.Conn, 1)
+	go acceptDirect(direct.listener, transferID, token, accepted)
+
+	select {
+	case conn := <-accepted:
+		addDataChannel(transferID, conn)
+		fmt.Println(utils.SuccessColor("🔗 Receiver connected directly, bypassing the server"))
+		return conn, nil
+	case <-direct.fallback:
+		fmt.Println(utils.WarningColor("↪ Receiver could not connect directly, using the server relay"))
+		return openDataChannel(transferID, "send")
+	case <-time.After(directAcceptTimeout):
+		return nil, fmt.Errorf("receiver did not connect")
+	}
+}
+
+// acceptDirect waits for the receiver's connection and checks the one-time token it presents.
+// Connections with a wrong token are dropped and the listener keeps waiting.
+func acceptDirect(listener net.Listener, transferID, token string, accepted chan *protocol.Conn) {
+	expected := []byte(fmt.Sprintf("/DIRECT %s %s", token, transferID))
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn := protocol.NewConn(netConn)
+		conn.SetReadDeadline(time.Now().Add(directDialTimeout))
+		frame, err := conn.Receive()
+		conn.SetReadDeadline(time.Time{})
+		if err != nil || frame.Type != protocol.FrameCommand || subtle.ConstantTimeCompare(frame.Payload, expected) != 1 {
+			conn.Close()
+			continue
+		}
+		accepted <- conn
+		return
+	}
+}
+
+// openReceiveChannel dials the sender directly when it offered an endpoint and
+// falls back to the server relay when that does not work. It reports whether the
+// connection is direct.
+func openReceiveChannel(control *protocol.Conn, transferID string) (*protocol.Conn, bool, error) {
+	offer, offered := takeDirectOffer(transferID)
+	if !offered {
+		conn, err := openDataChannel(transferID, "receive")
+		return conn, false, err
+	}
+
+	netConn, err := net.DialTimeout("tcp", offer.endpoint, directDialTimeout)
+	if err == nil {
+		conn := protocol.NewConn(netConn)
+		if err = conn.SendCommand(fmt.Sprintf("/DIRECT %s %s", offer.token, transferID)); err == nil {
+			addDataChannel(transferID, conn)
+			_ = control.SendCommand("/DIRECT_CONNECTED " + transferID)
+			fmt.Println(utils.SuccessColor("🔗 Connected directly to the sender"), utils.InfoColor(offer.endpoint))
+			return conn, true, nil
+		}
+		conn.Close()
+	}
+
+	fmt.Println(utils.WarningColor("↪ Could not reach the sender directly, using the server relay:"), err)
+	if err := control.SendCommand("/DIRECT_FAILED " + transferID); err != nil {
+		return nil, false, err
+	}
+	conn, err := openDataChannel(transferID, "receive")
+	return conn, false, err
+}
@@ -1,21 +1,28 @@
 package connection
 
 import (
-	"bufio"
+	"ItShare/protocol"
 	"ItShare/utils"
+	"errors"
 	"fmt"
 	"net"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// ErrManualEntry is returned by SelectServer when the user wants to type an address in
+var ErrManualEntry = errors.New("manual entry requested")
+
 // DiscoveredServer represents a discovered server
 type DiscoveredServer struct {
 	Address string
 	IP      string
 	Port    string
+	Name    string
+	Version int
+	Users   int
+	TLS     bool
 }
 
 // DiscoverServers listens for UDP broadcast messages from DrizLink servers
@@ -23,7 +30,7 @@ func DiscoverServers(timeout time.Duration) ([]DiscoveredServer, error) {
 	fmt.Println(utils.InfoColor("🔍 Scanning for DrizLink servers on local network..."))
 
 	// Create UDP connection to listen for broadcasts
-	addr, err := net.ResolveUDPAddr("udp", ":9876")
+	addr, err := net.ResolveUDPAddr("udp", ":"+strconv.Itoa(protocol.DiscoveryPort))
 	if err != nil {
 		return nil, fmt.Errorf("error resolving UDP address: %v", err)
 	}
@@ -54,37 +61,63 @@ func DiscoverServers(timeout time.Duration) ([]DiscoveredServer, error) {
 			continue
 		}
 
-		message := string(buffer[:n])
-
-		// Parse broadcast message: DRIZLINK_SERVER:<server_ip>:<server_port>
-		if strings.HasPrefix(message, "DRIZLINK_SERVER:") {
-			parts := strings.Split(message, ":")
-			if len(parts) == 3 {
-				serverIP := parts[1]
-				serverPort := parts[2]
-				serverAddress := fmt.Sprintf("%s:%s", serverIP, serverPort)
-
-				// Avoid duplicates
-				if !serverMap[serverAddress] {
-					serverMap[serverAddress] = true
-					servers = append(servers, DiscoveredServer{
-						Address: serverAddress,
-						IP:      serverIP,
-						Port:    serverPort,
-					})
-
-					fmt.Printf("%s Found server: %s (from %s)\n",
-						utils.SuccessColor("✅"),
-						utils.InfoColor(serverAddress),
-						utils.CommandColor(addr.IP.String()))
-				}
-			}
+		beacon, err := protocol.ParseBeacon(buffer[:n])
+		if err != nil {
+			continue
 		}
+		// Current servers leave the IP out, the one the beacon came from reaches them
+		serverIP := beacon.IP
+		if serverIP == "" {
+			serverIP = addr.IP.String()
+		}
+		serverAddress := net.JoinHostPort(serverIP, beacon.Port)
+
+		// Avoid duplicates
+		if serverMap[serverAddress] {
+			continue
+		}
+		serverMap[serverAddress] = true
+		servers = append(servers, DiscoveredServer{
+			Address: serverAddress,
+			IP:      serverIP,
+			Port:    beacon.Port,
+			Name:    beacon.Name,
+			Version: beacon.Version,
+			Users:   beacon.Users,
+			TLS:     beacon.TLS,
+		})
+
+		fmt.Printf("%s Found server: %s (from %s)\n",
+			utils.SuccessColor("✅"),
+			utils.InfoColor(serverAddress),
+			utils.CommandColor(addr.IP.String()))
 	}
 
 	return servers, nil
 }
 
+// describeServer sums up what a server announced, warning about what keeps this client
+// from connecting to it
+func describeServer(server DiscoveredServer) string {
+	if server.Version == 0 {
+		// Servers that only announce their address predate the details
+		return utils.WarningColor("older server")
+	}
+	details := []string{fmt.Sprintf("%d users online", server.Users)}
+	switch {
+	case server.TLS:
+		details = append(details, utils.SuccessColor("TLS"))
+	case tlsMode:
+		details = append(details, utils.WarningColor("no TLS, needs --tls=false"))
+	default:
+		details = append(details, utils.WarningColor("no TLS"))
+	}
+	if server.Version != protocol.Version {
+		details = append(details, utils.WarningColor(fmt.Sprintf("protocol v%d, this client speaks v%d", server.Version, protocol.Version)))
+	}
+	return strings.Join(details, ", ")
+}
+
 // SelectServer prompts user to select from discovered servers
 func SelectServer(servers []DiscoveredServer) (string, error) {
 	if len(servers) == 0 {
@@ -95,10 +128,16 @@ func SelectServer(servers []DiscoveredServer) (string, error) {
 	fmt.Println(utils.InfoColor("--------------------------------"))
 
 	for i, server := range servers {
-		fmt.Printf("%s %s %s\n",
+		name := "Server"
+		if server.Name != "" {
+			name = server.Name
+		}
+		fmt.Printf("%s %s %s %s (%s)\n",
 			utils.CommandColor(fmt.Sprintf("[%d]", i+1)),
-			utils.InfoColor("Server at"),
-			utils.SuccessColor(server.Address))
+			utils.UserColor(name),
+			utils.InfoColor("at"),
+			utils.SuccessColor(server.Address),
+			describeServer(server))
 	}
 
 	fmt.Printf("%s %s\n",
@@ -106,28 +145,28 @@ func SelectServer(servers []DiscoveredServer) (string, error) {
 		utils.WarningColor("Enter server address manually"))
 
 	fmt.Println(utils.InfoColor("--------------------------------"))
-	fmt.Print(utils.CommandColor("Select server (1-" + fmt.Sprintf("%d", len(servers)+1) + "): "))
-
-	reader := bufio.NewReader(os.Stdin)
-	input, _ := reader.ReadString('\n')
-	input = strings.TrimSpace(input)
-	choice, err := strconv.Atoi(input)
-	if err != nil {
-		return "", fmt.Errorf("invalid input")
-	}
 
-	if choice < 1 || choice > len(servers)+1 {
-		return "", fmt.Errorf("invalid choice")
-	}
+	for {
+		fmt.Print(utils.CommandColor("Select server (1-" + fmt.Sprintf("%d", len(servers)+1) + "): "))
+		input, err := readLine()
+		if err != nil {
+			return "", err
+		}
+		choice, err := strconv.Atoi(input)
+		if err != nil || choice < 1 || choice > len(servers)+1 {
+			fmt.Println(utils.ErrorColor("❌ Invalid choice"))
+			continue
+		}
 
-	if choice == len(servers)+1 {
-		return "", fmt.Errorf("manual_entry_requested")
-	}
+		if choice == len(servers)+1 {
+			return "", ErrManualEntry
+		}
 
-	selectedServer := servers[choice-1]
-	fmt.Printf("%s Selected server: %s\n",
-		utils.SuccessColor("✅"),
-		utils.InfoColor(selectedServer.Address))
+		selectedServer := servers[choice-1]
+		fmt.Printf("%s Selected server: %s\n",
+			utils.SuccessColor("✅"),
+			utils.InfoColor(selectedServer.Address))
 
-	return selectedServer.Address, nil
+		return selectedServer.Address, nil
+	}
 }
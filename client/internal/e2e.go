@@ -0,0 +1,266 @@
+package connection
+
+import (
+	"ItShare/protocol"
+	"ItShare/utils"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File payloads are encrypted end to end, so the relay only forwards ciphertext. Every
+// client has a long-term X25519 identity key and publishes its public half through the
+// server with /PUBKEY when it logs in. For each transfer both sides derive the same
+// AES-256-GCM key from their ECDH secret, the transfer ID and both public keys, and
+// every data frame is sealed under it together with its place in the stream. The
+// manifest and checksum of a file go on the data channel sealed the same way.
+// Transfers with a peer that published no key, such as an older client, are refused
+// unless the user chose to allow them in the clear.
+
+// allowUnencrypted is whether transfers may go in the clear when no key can be agreed on
+var allowUnencrypted = false
+
+// SetAllowUnencrypted lets transfers with peers that publish no key go in the clear
+func SetAllowUnencrypted(allowed bool) {
+	allowUnencrypted = allowed
+}
+
+// identity is this client's long-term key pair, loaded on first use
+var (
+	identity          *ecdh.PrivateKey
+	identityErr       error
+	identityOnce      sync.Once
+	transferKeys      = make(map[string]cipher.AEAD)
+	transferKeysMutex sync.Mutex
+	// Commands this side sealed on the data channel of each transfer, which number the next one
+	sealedCommands = make(map[string]uint64)
+	// Replies are matched by user, so lookups of the same key go one at a time
+	keyQueryMutex sync.Mutex
+)
+
+func identityFile() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "identity.key"), nil
+}
+
+// loadIdentity returns the identity key of this client, generating and saving it the first time
+func loadIdentity() (*ecdh.PrivateKey, error) {
+	identityOnce.Do(func() {
+		var path string
+		if path, identityErr = identityFile(); identityErr != nil {
+			return
+		}
+		if data, err := os.ReadFile(path); err == nil {
+			var raw []byte
+			if raw, identityErr = base64.StdEncoding.DecodeString(strings.TrimSpace(string(data))); identityErr == nil {
+				identity, identityErr = ecdh.X25519().NewPrivateKey(raw)
+			}
+			if identityErr != nil {
+				identityErr = fmt.Errorf("corrupt identity key %s: %v", path, identityErr)
+			}
+			return
+		}
+
+		if identity, identityErr = ecdh.X25519().GenerateKey(rand.Reader); identityErr != nil {
+			return
+		}
+		// The private key is what proves who this client is, keep it private to the user
+		encoded := base64.StdEncoding.EncodeToString(identity.Bytes())
+		if identityErr = os.WriteFile(path, []byte(encoded+"\n"), 0600); identityErr != nil {
+			return
+		}
+		fmt.Println(utils.InfoColor("🔑 Generated your identity key, its fingerprint is"), utils.InfoColor(KeyFingerprint(identity.PublicKey())))
+	})
+	return identity, identityErr
+}
+
+// KeyFingerprint returns the SHA-256 fingerprint of a public key in groups of four hex
+// digits, short enough to read out over the phone
+func KeyFingerprint(key *ecdh.PublicKey) string {
+	sum := sha256.Sum256(key.Bytes())
+	digits := strings.ToUpper(hex.EncodeToString(sum[:]))
+	groups := make([]string, 0, len(digits)/4)
+	for i := 0; i < len(digits); i += 4 {
+		groups = append(groups, digits[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+// announceIdentity publishes this client's public key through the server
+func announceIdentity(conn *protocol.Conn) error {
+	key, err := loadIdentity()
+	if err != nil {
+		if allowUnencrypted {
+			fmt.Println(utils.WarningColor("⚠ Transfers will not be end-to-end encrypted:"), err)
+		} else {
+			fmt.Println(utils.WarningColor("⚠ Transfers will be refused without an identity key:"), err)
+		}
+		return nil
+	}
+	return conn.SendCommand("/PUBKEY " + base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()))
+}
+
+// fetchPeerKey asks the server for the public key a user published. It returns nil
+// without an error when the user published none.
+func fetchPeerKey(conn *protocol.Conn, userId string) (*ecdh.PublicKey, error) {
+	keyQueryMutex.Lock()
+	defer keyQueryMutex.Unlock()
+
+	reply := expectReply("pubkey:" + userId)
+	if err := conn.SendCommand("/PUBKEY_QUERY " + userId); err != nil {
+		cancelReply("pubkey:" + userId)
+		return nil, err
+	}
+	answer, err := awaitReply("pubkey:"+userId, reply, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	args := strings.Fields(answer)
+	if len(args) < 3 {
+		return nil, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(args[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key of %s", userId)
+	}
+	key, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key of %s", userId)
+	}
+	return key, nil
+}
+
+// deriveTransferCipher derives the key of one transfer from the ECDH secret of both
+// sides. Salting with the transfer ID gives every transfer a key of its own, and the
+// public keys in the info bind it to who sends and who receives.
+func deriveTransferCipher(own *ecdh.PrivateKey, peer *ecdh.PublicKey, transferID string, sending bool) (cipher.AEAD, error) {
+	secret, err := own.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	sender, recipient := own.PublicKey().Bytes(), peer.Bytes()
+	if !sending {
+		sender, recipient = recipient, sender
+	}
+	info := "ItShare transfer key " + hex.EncodeToString(sender) + " " + hex.EncodeToString(recipient)
+	key, err := hkdf.Key(sha256.New, secret, []byte(transferID), info, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// setupEncryption looks up the peer's key and derives the cipher of a transfer, which
+// newDataWriter and newDataReader pick up from then on. Without keys on both sides the
+// transfer is refused, unless unencrypted transfers were allowed. Both sides show the
+// peer's fingerprint so it can be compared with what the peer's /fingerprint shows.
+func setupEncryption(conn *protocol.Conn, peerId, transferID string, sending bool) error {
+	own, err := loadIdentity()
+	if err != nil {
+		if !allowUnencrypted {
+			return fmt.Errorf("cannot encrypt without an identity key: %v", err)
+		}
+		fmt.Println(utils.WarningColor("⚠ Transfer "+transferID+" is not end-to-end encrypted:"), err)
+		return nil
+	}
+	peer, err := fetchPeerKey(conn, peerId)
+	if err != nil {
+		return fmt.Errorf("could not get the public key of %s: %v", peerId, err)
+	}
+	if peer == nil {
+		if !allowUnencrypted {
+			return fmt.Errorf("%s has no identity key, so the transfer cannot be encrypted (start with --allow-unencrypted to send it in the clear)", peerId)
+		}
+		fmt.Println(utils.WarningColor("⚠ " + peerId + " has no identity key, transfer " + transferID + " is not end-to-end encrypted"))
+		return nil
+	}
+
+	aead, err := deriveTransferCipher(own, peer, transferID, sending)
+	if err != nil {
+		return err
+	}
+	transferKeysMutex.Lock()
+	transferKeys[transferID] = aead
+	delete(sealedCommands, transferID)
+	transferKeysMutex.Unlock()
+
+	fmt.Printf("%s End-to-end encrypted, key fingerprint of %s: %s\n",
+		utils.SuccessColor("🔐"),
+		utils.UserColor(peerId),
+		utils.InfoColor(KeyFingerprint(peer)))
+	return nil
+}
+
+// transferCipher returns the cipher of a transfer, nil when it is not encrypted
+func transferCipher(transferID string) cipher.AEAD {
+	transferKeysMutex.Lock()
+	defer transferKeysMutex.Unlock()
+	return transferKeys[transferID]
+}
+
+// dropTransferCipher forgets the key of a transfer that has ended
+func dropTransferCipher(transferID string) {
+	transferKeysMutex.Lock()
+	delete(transferKeys, transferID)
+	delete(sealedCommands, transferID)
+	transferKeysMutex.Unlock()
+}
+
+// newDataWriter returns a writer of data frames for the part of a transfer's stream from
+// offset to end, sealing them when the transfer is encrypted
+func newDataWriter(conn *protocol.Conn, transferID string, offset, end int64) *protocol.DataWriter {
+	writer := protocol.NewDataWriter(conn, transferID)
+	writer.Cipher = transferCipher(transferID)
+	writer.Offset, writer.End = offset, end
+	return writer
+}
+
+// sendSealedCommand sends a command on the data channel of a transfer, sealed as
+// "/SEALED <base64>" when the transfer is encrypted so the relay cannot read it. Sealed
+// commands are numbered so the receiver notices any that go missing or come twice.
+func sendSealedCommand(conn *protocol.Conn, transferID, command string) error {
+	transferKeysMutex.Lock()
+	aead := transferKeys[transferID]
+	seq := sealedCommands[transferID]
+	if aead != nil {
+		sealedCommands[transferID]++
+	}
+	transferKeysMutex.Unlock()
+	if aead == nil {
+		return conn.SendCommand(command)
+	}
+	sealed, err := protocol.SealCommand(aead, transferID, seq, command)
+	if err != nil {
+		return err
+	}
+	return conn.SendCommand("/SEALED " + base64.StdEncoding.EncodeToString(sealed))
+}
+
+// HandleFingerprint handles the /fingerprint command, which shows this client's key
+// fingerprint so others can compare it with what they see when receiving
+func HandleFingerprint() {
+	key, err := loadIdentity()
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error loading your identity key:"), err)
+		return
+	}
+	fmt.Println(utils.InfoColor("🔑 Your key fingerprint:"), utils.InfoColor(KeyFingerprint(key.PublicKey())))
+}
@@ -1,19 +1,21 @@
 package connection
 
 import (
+	"errors"
 	"fmt"
 	"io"
-	"net"
 	"os"
 	"path/filepath"
 	"ItShare/helper"
+	"ItShare/protocol"
 	"ItShare/utils"
 	"strings"
 	"time"
 )
 
-
-func HandleSendFile(conn net.Conn, recipientId, filePath string) {
+// HandleSendFile offers a file to a recipient and streams it once accepted. It runs
+// in a slot of the send queue, which picked the transfer ID.
+func HandleSendFile(conn *protocol.Conn, recipientId, filePath, transferID string) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		fmt.Println(utils.ErrorColor("❌ Error opening file:"), err)
@@ -30,43 +32,103 @@ func HandleSendFile(conn net.Conn, recipientId, filePath string) {
 	fileSize := fileInfo.Size()
 	fileName := fileInfo.Name()
 
-	// Calculate checksum of file
-	checksum, err := helper.CalculateFileChecksum(filePath)
-	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error calculating checksum:"), err)
-		return
+	// Hash every chunk and the whole file with the strongest algorithm the recipient supports.
+	// In single-pass mode that happens while the file is sent and the checksum follows the data.
+	algorithm := negotiateHash(conn, recipientId)
+	var manifest *helper.ChunkManifest
+	var checksum helper.Checksum
+	if !singlePassMode {
+		manifest, checksum, err = helper.BuildManifest(filePath, algorithm, helper.DefaultChunkSize)
+		if err != nil {
+			fmt.Println(utils.ErrorColor("❌ Error calculating checksum:"), err)
+			return
+		}
 	}
 
-	transferID := GenerateTransferID()
 	fmt.Printf("%s Sending file '%s' to user %s (Transfer ID: %s)...\n",
 		utils.InfoColor("📤"),
 		utils.InfoColor(fileName),
 		utils.UserColor(recipientId),
 		utils.CommandColor(transferID))
 
-	// Send file request with file size, checksum, and transfer ID
-	_, err = conn.Write([]byte(fmt.Sprintf("/FILE_REQUEST %s %s %d %s %s\n",
-		recipientId, fileName, fileSize, checksum, transferID)))
+	// Nothing is offered that cannot be encrypted for the recipient
+	if err := setupEncryption(conn, recipientId, transferID, true); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Not sending file:"), err)
+		return
+	}
+	defer dropTransferCipher(transferID)
+
+	// The server answers with /TRANSFER_READY or /TRANSFER_DENIED before any data is streamed
+	ready := expectReply("transfer:" + transferID)
+	if sendWithdrawn(transferID) {
+		cancelReply("transfer:" + transferID)
+		fmt.Println(utils.WarningColor("🚫 Not sending file, it was cancelled"))
+		return
+	}
+	direct := offerDirectSend(transferID)
+
+	// The checksum is left out of the request, it goes with the manifest on the data channel
+	err = conn.SendCommand(direct.withPort(fmt.Sprintf("/FILE_REQUEST %s %s %d %s %s",
+		recipientId, fileName, fileSize, emptyField, transferID)))
 	if err != nil {
 		fmt.Println(utils.ErrorColor("❌ Error sending file request:"), err)
+		cancelReply("transfer:" + transferID)
+		direct.abandon()
+		return
+	}
+
+	fmt.Println(utils.InfoColor("⏳ Waiting for"), utils.UserColor(recipientId), utils.InfoColor("to accept..."))
+	token, err := awaitTransferReady(transferID, ready, offerAnswerTimeout)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ File transfer refused:"), err)
+		direct.abandon()
 		return
 	}
+	fmt.Println(utils.SuccessColor("✅"), utils.UserColor(recipientId), utils.SuccessColor("accepted the file"))
+
+	// Remember the file so the transfer can continue from an offset after a disconnect
+	record := &OutgoingTransfer{
+		TransferId:    transferID,
+		Server:        CurrentServer(),
+		RecipientId:   recipientId,
+		Path:          filePath,
+		Name:          fileName,
+		Size:          fileSize,
+		HashAlgorithm: algorithm,
+	}
+	if manifest != nil {
+		record.Checksum = checksum.String()
+	}
+	if err := saveOutgoingTransfer(record); err != nil {
+		fmt.Println(utils.WarningColor("⚠ Transfer will not be resumable:"), err)
+	}
+
+	sendFileData(conn, file, record, manifest, 0, direct, token)
+}
+
+// sendFileData streams a file from offset, which the caller has already seeked to,
+// directly to the receiver when it connects with token, over the server relay otherwise.
+// The chunk manifest goes first, and chunks the receiver cannot verify are sent again.
+// Without a manifest the file is hashed while it is sent and the digests follow the data.
+func sendFileData(conn *protocol.Conn, file *os.File, record *OutgoingTransfer, manifest *helper.ChunkManifest, offset int64, direct *directSend, token string) {
+	transferID := record.TransferId
 
 	// Create progress bar with transfer ID
-	bar := utils.CreateProgressBar(fileSize, "📤 Sending file")
+	bar := utils.CreateProgressBar(record.Size, "📤 Sending file")
 	bar.SetTransferId(transferID)
+	bar.Bar.Set64(offset)
 
 	transfer := &Transfer{
 		ID:            transferID,
 		Type:          FileTransfer,
-		Name:          fileName,
-		Size:          fileSize,
-		BytesComplete: 0,
+		Name:          record.Name,
+		Size:          record.Size,
+		BytesComplete: offset,
 		Status:        Active,
 		Direction:     "send",
-		Recipient:     recipientId,
-		Path:          filePath,
-		Checksum:      checksum,
+		Recipient:     record.RecipientId,
+		Path:          record.Path,
+		Checksum:      record.Checksum,
 		StartTime:     time.Now(),
 		File:          file,
 		ProgressBar:   bar,
@@ -75,87 +137,182 @@ func HandleSendFile(conn net.Conn, recipientId, filePath string) {
 
 	RegisterTransfer(transfer)
 
-	reader := NewCheckpointedReader(file, transfer, 32768) // 32KB chunks
-
-	n, err := io.CopyN(conn, io.TeeReader(reader, bar), fileSize)
+	defer dropTransferLimiter(transferID)
+	reader := NewCheckpointedReader(throttle(file, record.RecipientId, transferID), transfer, 32768) // 32KB chunks
+	reader.BytesRead = offset
+
+	remaining := record.Size - offset
+	var n int64
+	dataConn, err := openSendChannel(transferID, direct, token)
+	if err == nil {
+		replies := watchReplies(dataConn, transferID)
+		if manifest != nil {
+			err = sendManifest(dataConn, transferID, manifest, record.Checksum)
+			var streams []*StreamProgress
+			if err == nil {
+				streams, err = proposeStreams(dataConn, replies, transferID, manifest, offset)
+			}
+			if err == nil && len(streams) > 1 {
+				transfer.Streams = streams
+				n, err = sendStreams(dataConn, file, transfer, streams, bar)
+			} else if err == nil {
+				n, err = io.CopyN(newDataWriter(dataConn, transferID, offset, record.Size), io.TeeReader(reader, bar), remaining)
+			}
+		} else {
+			manifest, n, err = streamHashed(dataConn, file, record, io.TeeReader(reader, bar), offset)
+		}
+		if err == nil && n == remaining {
+			err = serveRetransmissions(dataConn, replies, file, manifest, transferID)
+		}
+		replies.stop()
+		closeDataChannel(transferID)
+	}
 
-	if err != nil {
+	if err != nil && isCancelled(transfer) {
+		// A cancelled file is not offered to the receiver again
+		removeOutgoingTransfer(transferID)
+		RemoveTransfer(transferID)
+		return
+	}
+	if errors.Is(err, errChunksUnverified) {
 		UpdateTransferStatus(transferID, Failed)
+		removeOutgoingTransfer(transferID)
 		fmt.Println(utils.ErrorColor("\n❌ Error sending file:"), err)
 		RemoveTransfer(transferID)
 		return
 	}
+	if err != nil {
+		// The record stays, the receiver asks for the rest once both sides are connected again
+		UpdateTransferStatus(transferID, Interrupted)
+		if errors.Is(err, ErrTransferInterrupted) {
+			fmt.Println(utils.WarningColor("\n🔌 Transfer " + transferID + " interrupted:"),
+				utils.InfoColor(describeResume(record.RecipientId, offset+n)))
+		} else {
+			fmt.Println(utils.ErrorColor("\n❌ Error sending file:"), err)
+			fmt.Println(utils.InfoColor("   " + describeResume(record.RecipientId, offset+n)))
+		}
+		RemoveTransfer(transferID)
+		return
+	}
 
-	if n != fileSize {
+	if n != remaining {
 		UpdateTransferStatus(transferID, Failed)
 		fmt.Println(utils.ErrorColor("\n❌ Error: sent"), utils.ErrorColor(n),
-			utils.ErrorColor("bytes, expected"), utils.ErrorColor(fileSize), utils.ErrorColor("bytes"))
+			utils.ErrorColor("bytes, expected"), utils.ErrorColor(remaining), utils.ErrorColor("bytes"))
 		RemoveTransfer(transferID)
 		return
 	}
 
 	// Mark transfer as completed
 	UpdateTransferStatus(transferID, Completed)
+	removeOutgoingTransfer(transferID)
 
 	fmt.Printf("%s File '%s' sent successfully!\n",
 		utils.SuccessColor("\n✅"),
-		utils.SuccessColor(fileName))
-	fmt.Println(utils.InfoColor("  MD5 Checksum:"), utils.InfoColor(checksum))
+		utils.SuccessColor(record.Name))
+	fmt.Println(utils.InfoColor("  Checksum:"), utils.InfoColor(record.Checksum))
 
 	// Clean up the transfer
 	RemoveTransfer(transferID)
 }
 
-func HandleFileTransfer(conn net.Conn, recipientId, fileName string, fileSize int64, storeFilePath string) {
-	// Get checksum and transfer ID from the split content
-	parts := strings.SplitN(fileName, "|", 3)
-	transferID := ""
-	checksum := ""
+// streamHashed sends the rest of a file from offset while hashing it, then sends the
+// digests as a trailer. The part sent before an interruption is hashed from disk first.
+func streamHashed(conn *protocol.Conn, file *os.File, record *OutgoingTransfer, data io.Reader, offset int64) (*helper.ChunkManifest, int64, error) {
+	builder, err := helper.NewManifestBuilder(record.HashAlgorithm, helper.DefaultChunkSize, record.Size)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := io.Copy(builder, io.NewSectionReader(file, 0, offset)); err != nil {
+		return nil, 0, err
+	}
+
+	// The digests of parallel ranges could not be folded into one checksum, so a single stream is used
+	err = sendSealedCommand(conn, record.TransferId, fmt.Sprintf("/MANIFEST %s %d trailer", record.HashAlgorithm, helper.DefaultChunkSize))
+	if err == nil {
+		err = sendSealedCommand(conn, record.TransferId, "/STREAMS 1")
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	n, err := io.CopyN(newDataWriter(conn, record.TransferId, offset, record.Size), io.TeeReader(data, builder), record.Size-offset)
+	if err != nil {
+		return nil, n, err
+	}
 
-	if len(parts) >= 2 {
-		fileName = parts[0]
-		checksum = parts[1]
-		fmt.Println(utils.InfoColor("📋 Original checksum:"), utils.InfoColor(checksum))
+	manifest, checksum := builder.Manifest()
+	record.Checksum = checksum.String()
+	if transfer, exists := GetTransfer(record.TransferId); exists {
+		transfer.Checksum = record.Checksum
+	}
+	if err := saveOutgoingTransfer(record); err != nil {
+		fmt.Println(utils.WarningColor("\n⚠ Transfer will not be resumable:"), err)
+	}
+	return manifest, n, sendTrailer(conn, record.TransferId, manifest, checksum)
+}
 
-		if len(parts) >= 3 {
-			transferID = parts[2]
-		} else {
-			transferID = GenerateTransferID()
-		}
-	} else {
-		transferID = GenerateTransferID()
+// HandleFileTransfer receives a file whose data frames are delivered on data
+func HandleFileTransfer(conn *protocol.Conn, data *dataReader, senderId, fileName, checksum, transferID string, fileSize int64, storeFilePath string) {
+	if err := helper.ValidateName(fileName); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Refusing file:"), err)
+		return
+	}
+	if checksum != "" {
+		fmt.Println(utils.InfoColor("📋 Original checksum:"), utils.InfoColor(checksum))
 	}
-	
+
 	fmt.Printf("%s Receiving file: %s (Size: %s, Transfer ID: %s)\n",
 		utils.InfoColor("📥"),
 		utils.InfoColor(fileName),
 		utils.InfoColor(fmt.Sprintf("%d bytes", fileSize)),
 		utils.CommandColor(transferID))
 
-	filePath := filepath.Join(storeFilePath, fileName)
-	file, err := os.Create(filePath)
+	// Data goes to a .part file with a sidecar until the checksum has been verified
+	partial := &PartialTransfer{
+		TransferId: transferID,
+		SenderId:   senderId,
+		FileName:   fileName,
+		Size:       fileSize,
+		Checksum:   checksum,
+	}
+	file, err := os.Create(partialPath(storeFilePath, fileName))
 	if err != nil {
 		fmt.Println(utils.ErrorColor("❌ Error creating file:"), err)
 		return
 	}
+	if err := savePartial(storeFilePath, partial); err != nil {
+		fmt.Println(utils.WarningColor("⚠ Transfer will not be resumable:"), err)
+	}
+
+	receiveFileData(conn, data, file, partial, storeFilePath)
+}
+
+// receiveFileData writes the rest of a partial file, verifying each chunk against the
+// sender's manifest as it completes. Chunks that fail are fetched again, and the file
+// is moved into place only once every one of them matches.
+func receiveFileData(conn *protocol.Conn, data *dataReader, file *os.File, partial *PartialTransfer, storeFilePath string) {
 	defer file.Close()
 
+	transferID := partial.TransferId
+	offset := partial.BytesReceived
+	filePath := filepath.Join(storeFilePath, partial.FileName)
 
 	// Create progress bar with transfer ID
-	bar := utils.CreateProgressBar(fileSize, "📥 Receiving file")
+	bar := utils.CreateProgressBar(partial.Size, "📥 Receiving file")
 	bar.SetTransferId(transferID)
+	bar.Bar.Set64(offset)
 
 	transfer := &Transfer{
 		ID:            transferID,
 		Type:          FileTransfer,
-		Name:          fileName,
-		Size:          fileSize,
-		BytesComplete: 0,
+		Name:          partial.FileName,
+		Size:          partial.Size,
+		BytesComplete: offset,
 		Status:        Active,
 		Direction:     "receive",
-		Recipient:     recipientId,
+		Recipient:     partial.SenderId,
 		Path:          filePath,
-		Checksum:      checksum,
+		Checksum:      partial.Checksum,
 		StartTime:     time.Now(),
 		File:          file,
 		Connection:    conn,
@@ -164,59 +321,150 @@ func HandleFileTransfer(conn net.Conn, recipientId, fileName string, fileSize in
 
 	RegisterTransfer(transfer)
 
-	writer := NewCheckpointedWriter(file, transfer, 32768) // 32KB chunks
-
-	// Write to file and update progress bar simultaneously
-	n, err := io.CopyN(writer, io.TeeReader(conn,bar), fileSize)
-	
-	// bar will be defined late, it is the status bar
+	sidecar := newPartialWriter(file, partial, storeFilePath)
+	writer := NewCheckpointedWriter(sidecar, transfer, 32768) // 32KB chunks
+	writer.BytesWritten = offset
+
+	remaining := partial.Size - offset
+	var n int64
+	var streamed helper.Checksum
+	rehash := false
+	manifest, trailer, err := data.readManifest(partial.Size)
+	if err == nil && !trailer {
+		if err = receiveChecksum(data, partial); err == nil {
+			fmt.Println(utils.InfoColor("\n📋 Original checksum:"), utils.InfoColor(partial.Checksum))
+		}
+	}
+	var streams []*StreamProgress
+	if err == nil {
+		streams, err = data.agreeStreams(manifest, offset)
+	}
+	if err == nil && len(streams) > 1 {
+		// Ranges arrive in parallel and are hashed per chunk, the whole file is hashed afterwards
+		transfer.Streams = streams
+		var failed []int
+		failed, err = receiveStreams(data, file, partial, storeFilePath, manifest, transfer, bar)
+		n = partial.BytesReceived - offset
+		rehash = true
+		if err == nil {
+			err = repairChunks(data, file, manifest, failed)
+		}
+	} else if err == nil {
+		// Chunks kept from an earlier attempt are hashed before new data is appended,
+		// so the whole file is hashed without reading it back afterwards
+		verifier := manifest.NewVerifier()
+		_, err = io.Copy(verifier, io.NewSectionReader(file, 0, offset))
+
+		// Write to file and update progress bar simultaneously
+		if err == nil {
+			data.expect(offset, partial.Size)
+			n, err = io.CopyN(io.MultiWriter(writer, verifier), io.TeeReader(data, bar), remaining)
+		}
+		if err == nil && n == remaining && trailer {
+			err = receiveTrailer(data, verifier, partial)
+		}
+		if err == nil && n == remaining {
+			streamed = verifier.Checksum()
+			rehash = len(verifier.Failed()) > 0
+			if err = sidecar.checkpoint(); err == nil {
+				err = repairChunks(data, file, verifier.Manifest(), verifier.Failed())
+			}
+		}
+	}
 
-	if err != nil {
+	if err != nil && isCancelled(transfer) {
+		data.drain(cancelDrainTimeout)
+		file.Close()
+		discardPartial(storeFilePath, partial)
+		RemoveTransfer(transferID)
+		return
+	}
+	if errors.Is(err, errChunksUnverified) {
+		fmt.Println(utils.ErrorColor("\n❌ Chunk verification failed! The file could not be received intact."))
+		fmt.Println(utils.InfoColor("   The partial file was removed, ask the sender to send it again"))
+		removePartial(storeFilePath, partial)
 		UpdateTransferStatus(transferID, Failed)
-		fmt.Println(utils.ErrorColor("\n❌ Error receiving file:"), err)
+		RemoveTransfer(transferID)
+		return
+	}
+	if err != nil {
+		// Keep the .part file and record how far it got so the sender can continue
+		UpdateTransferStatus(transferID, Interrupted)
+		if cpErr := sidecar.checkpoint(); cpErr != nil {
+			fmt.Println(utils.ErrorColor("\n❌ Error saving transfer progress:"), cpErr)
+		}
+		if errors.Is(err, ErrTransferInterrupted) {
+			fmt.Println(utils.WarningColor("\n🔌 Transfer " + transferID + " interrupted:"),
+				utils.InfoColor(describeResume(partial.SenderId, partial.BytesReceived)))
+		} else {
+			fmt.Println(utils.ErrorColor("\n❌ Error receiving file:"), err)
+			fmt.Println(utils.InfoColor("   " + describeResume(partial.SenderId, partial.BytesReceived)))
+		}
 		RemoveTransfer(transferID)
 		return
 	}
 
-	if n != fileSize {
+	if n != remaining {
 		UpdateTransferStatus(transferID, Failed)
 		fmt.Println(utils.ErrorColor("\n❌ Error: received"), utils.ErrorColor(n),
-			utils.ErrorColor("bytes, expected"), utils.ErrorColor(fileSize), utils.ErrorColor("bytes"))
+			utils.ErrorColor("bytes, expected"), utils.ErrorColor(remaining), utils.ErrorColor("bytes"))
 		RemoveTransfer(transferID)
 		return
 	}
 
-	// Verify checksum if provided
-	if checksum != "" {
-		file.Close() // Close file before calculating checksum
-		receivedChecksum, err := helper.CalculateFileChecksum(filePath)
+	file.Close()
+	partPath := partialPath(storeFilePath, partial.FileName)
+
+	// Verify checksum if provided, over the whole file including any earlier attempts
+	if partial.Checksum != "" {
+		expected, err := helper.ParseChecksum(partial.Checksum)
+		receivedChecksum := streamed
+		// The hash taken while writing misses repaired chunks and parallel ranges, only then is the file read again
+		if err == nil && (rehash || streamed.Algorithm != expected.Algorithm) {
+			receivedChecksum, err = helper.CalculateFileChecksum(partPath, expected.Algorithm)
+		}
 		if err != nil {
 			fmt.Println(utils.ErrorColor("\n❌ Error calculating checksum:"), err)
-		}else {
-			fmt.Println(utils.InfoColor("\n📋 Calculated checksum:"), utils.InfoColor(receivedChecksum))
-
-			if helper.VerifyChecksum(checksum, receivedChecksum) {
-				fmt.Println(utils.SuccessColor("✅ Checksum verification successful! File integrity confirmed."))
-			} else {
-				fmt.Println(utils.ErrorColor("❌ Checksum verification failed! File may be corrupted."))
-			}
+			UpdateTransferStatus(transferID, Failed)
+			RemoveTransfer(transferID)
+			return
+		}
+		fmt.Println(utils.InfoColor("\n📋 Calculated checksum:"), utils.InfoColor(receivedChecksum.String()))
+
+		if !helper.VerifyChecksum(expected, receivedChecksum) {
+			fmt.Println(utils.ErrorColor("❌ Checksum verification failed! File may be corrupted."))
+			fmt.Println(utils.InfoColor("   The partial file was removed, ask the sender to send it again"))
+			removePartial(storeFilePath, partial)
+			UpdateTransferStatus(transferID, Failed)
+			RemoveTransfer(transferID)
+			return
 		}
+		fmt.Println(utils.SuccessColor("✅ Checksum verification successful! File integrity confirmed."))
 	}
 
+	if err := os.Rename(partPath, filePath); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error moving file into place:"), err)
+		UpdateTransferStatus(transferID, Failed)
+		RemoveTransfer(transferID)
+		return
+	}
+	os.Remove(sidecarPath(storeFilePath, partial.FileName))
+
 	// Mark transfer as completed
 	UpdateTransferStatus(transferID, Completed)
 
 	fmt.Printf("%s File '%s' received successfully!\n",
 		utils.SuccessColor("✅"),
-		utils.SuccessColor(fileName))
+		utils.SuccessColor(partial.FileName))
 	fmt.Println(utils.InfoColor("📂 Saved to:"), utils.InfoColor(filePath))
 
 	// Clean up the transfer
 	RemoveTransfer(transferID)
 }
 
-func HandleDownloadRequest(conn net.Conn, recipientId, filePath string) {
-	_, err := conn.Write([]byte(fmt.Sprintf("/DOWNLOAD_REQUEST %s %s\n", recipientId, filePath)))
+func HandleDownloadRequest(conn *protocol.Conn, recipientId, filePath string) {
+	rememberDownload(recipientId, filePath)
+	err := conn.SendCommand(fmt.Sprintf("/DOWNLOAD_REQUEST %s %s", recipientId, filePath))
 	if err != nil {
 		fmt.Println("Error sending file request:", err)
 		return
@@ -224,11 +472,21 @@ func HandleDownloadRequest(conn net.Conn, recipientId, filePath string) {
 	fmt.Println("File download request sent successfully")
 }
 
-func HandleDownloadResponse(conn net.Conn, userId, filePath string) {
-	cleanPath := filepath.Clean(strings.TrimSpace(filePath))
-	absPath, err := filepath.Abs(cleanPath)
+// HandleDownloadResponse sends a file or folder from the share root to the user who asked
+// for it. Requests that do not resolve to something inside the root are refused and the
+// reason goes back to the requester.
+func HandleDownloadResponse(conn *protocol.Conn, userId, filePath string) {
+	session := CurrentSession()
+	if session == nil {
+		return
+	}
+
+	absPath, err := resolveSharedPath(session.StoreFilePath, filePath)
 	if err != nil {
-		fmt.Printf("Error resolving absolute path: %v\n", err)
+		fmt.Println(utils.WarningColor("🚫 Refused download of"), utils.InfoColor(filePath), utils.WarningColor("by"), utils.UserColor(userId)+":", err)
+		if sendErr := conn.SendCommand(fmt.Sprintf("/DOWNLOAD_ERROR %s %s: %v", userId, filePath, err)); sendErr != nil {
+			fmt.Println(utils.ErrorColor("❌ Error reporting download failure:"), sendErr)
+		}
 		return
 	}
 
@@ -238,8 +496,41 @@ func HandleDownloadResponse(conn net.Conn, userId, filePath string) {
 		return
 	}
 	if !fileInfo.IsDir() {
-		HandleSendFile(conn, userId, absPath)
+		enqueueSend(conn, FileTransfer, userId, absPath)
 	} else {
-		HandleSendFolder(conn, userId, absPath)
+		enqueueSend(conn, FolderTransfer, userId, absPath)
+	}
+}
+
+// resolveSharedPath maps a requested path onto the share root. Relative paths are taken
+// from the root and absolute ones must point into it, without naming the root itself. Symlinks are resolved before the
+// check, so a link inside the root cannot expose anything outside of it.
+func resolveSharedPath(root, requested string) (string, error) {
+	rootPath, err := filepath.Abs(root)
+	if err != nil {
+		return "", fmt.Errorf("share root unavailable")
+	}
+	rootPath, err = filepath.EvalSymlinks(rootPath)
+	if err != nil {
+		return "", fmt.Errorf("share root unavailable")
+	}
+
+	target := filepath.Clean(strings.TrimSpace(requested))
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(rootPath, target)
+	}
+	resolved, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		return "", fmt.Errorf("no such file in the shared folder")
+	}
+
+	rel, err := filepath.Rel(rootPath, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path is outside the shared folder")
+	}
+	// Only what is inside the share can be downloaded, never the whole share at once
+	if rel == "." {
+		return "", fmt.Errorf("the shared folder itself cannot be downloaded")
 	}
+	return resolved, nil
 }
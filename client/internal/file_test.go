@@ -0,0 +1,88 @@
+package connection
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveSharedPath(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "share")
+	mustMkdir(t, filepath.Join(root, "docs"))
+	mustWrite(t, filepath.Join(root, "docs", "report.pdf"))
+	mustWrite(t, filepath.Join(parent, "secret.txt"))
+	mustWrite(t, filepath.Join(parent, "share-other.txt"))
+	mustSymlink(t, filepath.Join(parent, "secret.txt"), filepath.Join(root, "leak"))
+	mustSymlink(t, "..", filepath.Join(root, "docs", "up"))
+	mustSymlink(t, "report.pdf", filepath.Join(root, "docs", "alias"))
+	// The share root may itself be reached through a link
+	mustSymlink(t, root, filepath.Join(parent, "linked-share"))
+
+	report := filepath.Join(root, "docs", "report.pdf")
+	tests := []struct {
+		name      string
+		root      string
+		requested string
+		want      string // resolved path, or empty when the request is refused
+	}{
+		{"relative", root, "docs/report.pdf", report},
+		{"padded", root, "  docs/report.pdf ", report},
+		{"absolute inside", root, report, report},
+		{"dot segments inside", root, "docs/../docs/report.pdf", report},
+		{"link inside", root, "docs/alias", report},
+		{"link to the root", root, "docs/up/docs/report.pdf", report},
+		{"root through a link", filepath.Join(parent, "linked-share"), "docs/report.pdf", report},
+		{"parent directory", root, "../secret.txt", ""},
+		{"absolute outside", root, filepath.Join(parent, "secret.txt"), ""},
+		{"sibling with a common prefix", root, "../share-other.txt", ""},
+		{"link outside", root, "leak", ""},
+		{"dot segments after a link", root, "docs/up/../secret.txt", ""},
+		{"the root", root, ".", ""},
+		{"the root, padded", root, "  ", ""},
+		{"the root by absolute path", root, root, ""},
+		{"the root through dot segments", root, "docs/..", ""},
+		{"the root through a link", root, "docs/up", ""},
+		{"missing", root, "docs/nothere.pdf", ""},
+		{"missing root", filepath.Join(parent, "nothere"), "docs/report.pdf", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveSharedPath(tt.root, tt.requested)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("resolveSharedPath(%q) = %q, want it refused", tt.requested, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveSharedPath(%q) error = %v", tt.requested, err)
+			}
+			want, _ := filepath.EvalSymlinks(tt.want)
+			if got != want {
+				t.Fatalf("resolveSharedPath(%q) = %q, want %q", tt.requested, got, want)
+			}
+		})
+	}
+}
+
+func mustMkdir(t *testing.T, path string) {
+	t.Helper()
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustWrite(t *testing.T, path string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(filepath.Base(path)), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustSymlink(t *testing.T, target, path string) {
+	t.Helper()
+	if err := os.Symlink(target, path); err != nil {
+		t.Fatal(err)
+	}
+}
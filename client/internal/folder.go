@@ -3,70 +3,74 @@ package connection
 import (
 	"ItShare/helper"
 	"ItShare/utils"
+	"errors"
 	"fmt"
+	"ItShare/protocol"
 	"io"
-	"net"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 )
 
-func HandleSendFolder(conn net.Conn, recipientId, folderPath string) {
+// HandleSendFolder streams a folder entry by entry, straight from the source tree.
+// It runs in a slot of the send queue, which picked the transfer ID.
+func HandleSendFolder(conn *protocol.Conn, recipientId, folderPath, transferID string) {
 	fmt.Println(utils.InfoColor("📦 Preparing folder for transfer..."))
 
-	//Create a temporary zip file
-	tempZipPath := folderPath + ".zip"
-	err := helper.CreateZipFromFolder(folderPath, tempZipPath)
+	archive, err := helper.NewFolderArchive(folderPath, negotiateHash(conn, recipientId))
 	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error creating zip file:"), err)
+		fmt.Println(utils.ErrorColor("❌ Error reading folder:"), err)
 		return
 	}
-	defer os.Remove(tempZipPath) //clean up temporary zip file
 
-	//open zip file
-	zipFile, err := os.Open(tempZipPath)
-	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error opening temp zip file:"), err)
+	archiveSize := archive.Size()
+	folderName := filepath.Base(folderPath)
+
+	fmt.Printf("%s Sending folder '%s' to user %s (%d entries, Transfer ID: %s)...\n",
+		utils.InfoColor("📤"),
+		utils.InfoColor(folderName),
+		utils.UserColor(recipientId),
+		archive.Entries(),
+		utils.CommandColor(transferID))
+
+	// Nothing is offered that cannot be encrypted for the recipient
+	if err := setupEncryption(conn, recipientId, transferID, true); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Not sending folder:"), err)
 		return
 	}
-	defer zipFile.Close()
+	defer dropTransferCipher(transferID)
 
-	//Get zip file info
-	zipInfo, err := zipFile.Stat()
-	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error getting zip file info:"), err)
+	// The server answers with /TRANSFER_READY or /TRANSFER_DENIED before any data is streamed
+	ready := expectReply("transfer:" + transferID)
+	if sendWithdrawn(transferID) {
+		cancelReply("transfer:" + transferID)
+		fmt.Println(utils.WarningColor("🚫 Not sending folder, it was cancelled"))
 		return
 	}
+	direct := offerDirectSend(transferID)
 
-	zipSize := zipInfo.Size()
-	folderName := filepath.Base(folderPath)
-
-	// Calculate checksum of the zip file
-	checksum, err := helper.CalculateFileChecksum(tempZipPath)
+	// Every file carries its own checksum inside the stream, so there is none for the whole folder
+	err = conn.SendCommand(direct.withPort(fmt.Sprintf("/FOLDER_REQUEST %s %s %d %s %s",
+		recipientId, folderName, archiveSize, emptyField, transferID)))
 	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error calculating checksum:"), err)
+		fmt.Println(utils.ErrorColor("❌ Error sending folder request:"), err)
+		cancelReply("transfer:" + transferID)
+		direct.abandon()
 		return
 	}
 
-	transferID := GenerateTransferID()
-
-	fmt.Printf("%s Sending folder '%s' to user %s (Transfer ID: %s)...\n",
-		utils.InfoColor("📤"),
-		utils.InfoColor(folderName),
-		utils.UserColor(recipientId),
-		utils.CommandColor(transferID))
-
-	// Send folder request with zip size, checksum and transfer ID
-	_, err = conn.Write([]byte(fmt.Sprintf("/FOLDER_REQUEST %s %s %d %s %s\n",
-		recipientId, folderName, zipSize, checksum, transferID)))
+	fmt.Println(utils.InfoColor("⏳ Waiting for"), utils.UserColor(recipientId), utils.InfoColor("to accept..."))
+	token, err := awaitTransferReady(transferID, ready, offerAnswerTimeout)
 	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error sending folder request:"), err)
+		fmt.Println(utils.ErrorColor("❌ Folder transfer refused:"), err)
+		direct.abandon()
 		return
 	}
+	fmt.Println(utils.SuccessColor("✅"), utils.UserColor(recipientId), utils.SuccessColor("accepted the folder"))
 
 	// Create progress bar with transfer ID
-	bar := utils.CreateProgressBar(zipSize, "📤 Sending folder")
+	bar := utils.CreateProgressBar(archiveSize, "📤 Sending folder")
 	bar.SetTransferId(transferID)
 
 	// Create transfer record
@@ -74,15 +78,13 @@ func HandleSendFolder(conn net.Conn, recipientId, folderPath string) {
 		ID:            transferID,
 		Type:          FolderTransfer,
 		Name:          folderName,
-		Size:          zipSize,
+		Size:          archiveSize,
 		BytesComplete: 0,
 		Status:        Active,
 		Direction:     "send",
 		Recipient:     recipientId,
 		Path:          folderPath,
-		Checksum:      checksum,
 		StartTime:     time.Now(),
-		File:          zipFile,
 		ProgressBar:   bar,
 		Connection:    conn,
 	}
@@ -90,21 +92,37 @@ func HandleSendFolder(conn net.Conn, recipientId, folderPath string) {
 	// Register the transfer
 	RegisterTransfer(transfer)
 
-	checkpointedReader := NewCheckpointedReader(zipFile, transfer, 32768) // 32KB chunks
-
-	// Stream zip file data using the checkpointed reader with progress bar
-	reader := io.TeeReader(checkpointedReader, bar)
-	n, err := io.CopyN(conn, reader, zipSize)
+	// The archive is produced while it is sent, nothing is staged on disk
+	stream, streamWriter := io.Pipe()
+	go func() {
+		_, err := archive.WriteTo(streamWriter)
+		streamWriter.CloseWithError(err)
+	}()
+	defer stream.Close()
+
+	reader := io.TeeReader(NewCheckpointedReader(throttle(stream, recipientId, transferID), transfer, 32768), bar) // 32KB chunks
+	var n int64
+	dataConn, err := openSendChannel(transferID, direct, token)
+	if err == nil {
+		replies := watchReplies(dataConn, transferID)
+		n, err = io.CopyN(newDataWriter(dataConn, transferID, 0, archiveSize), reader, archiveSize)
+		replies.stop()
+		closeDataChannel(transferID)
+	}
 
+	if err != nil && isCancelled(transfer) {
+		RemoveTransfer(transferID)
+		return
+	}
 	if err != nil {
 		UpdateTransferStatus(transferID, Failed)
 		fmt.Println(utils.ErrorColor("\n❌ Error sending folder:"), err)
 		RemoveTransfer(transferID)
 		return
 	}
-	if n != zipSize {
+	if n != archiveSize {
 		UpdateTransferStatus(transferID, Failed)
-		fmt.Println(utils.ErrorColor("\n❌ Error: sent"), utils.ErrorColor(n), utils.ErrorColor("bytes, expected"), utils.ErrorColor(zipSize), utils.ErrorColor("bytes"))
+		fmt.Println(utils.ErrorColor("\n❌ Error: sent"), utils.ErrorColor(n), utils.ErrorColor("bytes, expected"), utils.ErrorColor(archiveSize), utils.ErrorColor("bytes"))
 		RemoveTransfer(transferID)
 		return
 	}
@@ -112,38 +130,18 @@ func HandleSendFolder(conn net.Conn, recipientId, folderPath string) {
 	UpdateTransferStatus(transferID, Completed)
 
 	fmt.Println(utils.SuccessColor("\n✅ Folder"), utils.SuccessColor(folderName), utils.SuccessColor("sent successfully!"))
-	fmt.Println(utils.InfoColor("  MD5 Checksum:"), utils.InfoColor(checksum))
 
 	RemoveTransfer(transferID)
 }
 
-func HandleFolderTransfer(conn net.Conn, recipientId, folderName string, folderSize int64, storeFilePath string) {
-	// Extract checksum and transfer ID if present
-	checksum := ""
-	transferID := ""
-
-	parts := strings.SplitN(folderName, "|", 3)
-	if len(parts) >= 2 {
-		folderName = parts[0]
-		checksum = parts[1]
-		if len(parts) >= 3 {
-			transferID = parts[2]
-		} else {
-			transferID = GenerateTransferID()
-		}
-	} else {
-		transferID = GenerateTransferID()
-	}
-
-	// Create temporary zip file to store received data
-	tempZipPath := filepath.Join(storeFilePath, folderName+".zip")
-	zipFile, err := os.Create(tempZipPath)
-	if err != nil {
-		fmt.Println(err)
+// HandleFolderTransfer extracts a folder archive into the store path while its data frames arrive on data
+func HandleFolderTransfer(conn *protocol.Conn, data *dataReader, senderId, folderName, transferID string, folderSize int64, storeFilePath string) {
+	if err := helper.ValidateName(folderName); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Refusing folder:"), err)
 		return
 	}
+	destPath := filepath.Join(storeFilePath, folderName)
 
-	
 	// Create progress bar with transfer ID
 	bar := utils.CreateProgressBar(folderSize, "📥 Receiving folder")
 	bar.SetTransferId(transferID)
@@ -157,82 +155,60 @@ func HandleFolderTransfer(conn net.Conn, recipientId, folderName string, folderS
 		BytesComplete: 0,
 		Status:        Active,
 		Direction:     "receive",
-		Recipient:     recipientId,
-		Path:          tempZipPath,
-		Checksum:      checksum,
+		Recipient:     senderId,
+		Path:          destPath,
 		StartTime:     time.Now(),
-		File:          zipFile,
 		ProgressBar:   bar,
 		Connection:    conn,
 	}
 
 	RegisterTransfer(transfer)
 
-	writer := NewCheckpointedWriter(zipFile, transfer, 32768) // 32KB chunks
-
-	// Receive the zip file data with progress
-	n, err := io.CopyN(writer, io.TeeReader(conn, bar), folderSize)
-	zipFile.Close()
-
-	if err != nil {
-		UpdateTransferStatus(transferID, Failed)
-		os.Remove(tempZipPath)
-		fmt.Println(err)
-		RemoveTransfer(transferID)
-		return
-	}
-
-	if n != folderSize {
-		UpdateTransferStatus(transferID, Failed)
-		os.Remove(tempZipPath)
+	// A folder that was already there is merged into and never removed on cancel
+	_, statErr := os.Stat(destPath)
+	existed := statErr == nil
+
+	// Entries are written and verified one by one as they arrive
+	data.expect(0, folderSize)
+	reader := io.TeeReader(NewCheckpointedReader(io.LimitReader(data, folderSize), transfer, 32768), bar) // 32KB chunks
+	err := helper.ExtractFolderArchive(reader, destPath, helper.ExtractLimitsFor(folderSize))
+	if err != nil && isCancelled(transfer) {
+		data.drain(cancelDrainTimeout)
+		discardFolder(destPath, existed)
 		RemoveTransfer(transferID)
 		return
 	}
-
-	// Verify checksum if provided
-	if checksum != "" {
-		receivedChecksum, err := helper.CalculateFileChecksum(tempZipPath)
-		if err != nil {
-			fmt.Println(err)
-		} else {
-
-			if helper.VerifyChecksum(checksum, receivedChecksum) {
-				fmt.Println("✅ Checksum verification successful! Folder integrity confirmed.")
-			} else {
-				fmt.Println("❌ Checksum verification failed! Folder may be corrupted.")
-			}
-		}
-	}
-
-	fmt.Println("\n📦 Extracting folder...")
-	//Extract the zip file
-	destPath := filepath.Join(storeFilePath, folderName)
-	err = helper.ExtractZip(tempZipPath, destPath)
 	if err != nil {
 		UpdateTransferStatus(transferID, Failed)
-		os.Remove(tempZipPath)
-		fmt.Println(err)
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			err = fmt.Errorf("folder stream ended early")
+		}
+		fmt.Println(utils.ErrorColor("\n❌ Error receiving folder:"), err)
+		fmt.Println(utils.InfoColor("   Entries received so far were kept in"), utils.InfoColor(destPath))
 		RemoveTransfer(transferID)
 		return
 	}
 
 	UpdateTransferStatus(transferID, Completed)
 
-	// Clean up the temporary zip file
-	os.Remove(tempZipPath)
+	fmt.Println(utils.SuccessColor("\n✅ Every file checksum verified. Folder integrity confirmed."))
+	fmt.Printf("%s Folder '%s' received successfully!\n",
+		utils.SuccessColor("✅"),
+		utils.SuccessColor(folderName))
+	fmt.Println(utils.InfoColor("📂 Saved to:"), utils.InfoColor(destPath))
 
 	RemoveTransfer(transferID)
 }
 
-func HandleLookupRequest(conn net.Conn, userId string) {
-	_, err := conn.Write([]byte(fmt.Sprintf("/LOOK %s\n", userId)))
+func HandleLookupRequest(conn *protocol.Conn, userId string) {
+	err := conn.SendCommand(fmt.Sprintf("/LOOK %s", userId))
 	if err != nil {
 		fmt.Printf("Error sending look request: %v\n", err)
 		return
 	}
 }
 
-func HandleLookupResponse(conn net.Conn, storeFilePath string, userId string) {
+func HandleLookupResponse(conn *protocol.Conn, storeFilePath string, userId string) {
 	// Clean and normalize the path
 	cleanPath := filepath.Clean(strings.TrimSpace(storeFilePath))
 	absPath, err := filepath.Abs(cleanPath)
@@ -302,8 +278,8 @@ func HandleLookupResponse(conn net.Conn, storeFilePath string, userId string) {
 		allEntries = append(allEntries, "Directory is empty")
 	}
 
-	response := fmt.Sprintf("LOOK_RESPONSE %s %s\n", userId, strings.Join(allEntries, "\n"))
-	_, err = conn.Write([]byte(response))
+	response := fmt.Sprintf("/DIR_LISTING %s %s", userId, strings.Join(allEntries, "\n"))
+	err = conn.SendCommand(response)
 	if err != nil {
 		fmt.Printf("Error sending lookup response: %v\n", err)
 	}
@@ -0,0 +1,155 @@
+package connection
+
+import (
+	"ItShare/helper"
+	"ItShare/utils"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Outgoing data is throttled by up to three token buckets at once: one for the
+// transfer, one shared by everything sent to the same user and one for the whole
+// client. A limit of zero leaves the bucket open.
+var (
+	globalLimiter    = helper.NewRateLimiter(0)
+	userLimiters     = make(map[string]*helper.RateLimiter)
+	transferLimiters = make(map[string]*helper.RateLimiter)
+	limitsMutex      sync.Mutex
+)
+
+// SetGlobalLimit sets the rate all outgoing transfers share together
+func SetGlobalLimit(rate string) error {
+	bytesPerSecond, err := helper.ParseRate(rate)
+	if err != nil {
+		return err
+	}
+	globalLimiter.SetRate(bytesPerSecond)
+	return nil
+}
+
+// limiterFor returns the limiter stored under key, creating an open one the first time
+func limiterFor(limiters map[string]*helper.RateLimiter, key string) *helper.RateLimiter {
+	limitsMutex.Lock()
+	defer limitsMutex.Unlock()
+	limiter, exists := limiters[key]
+	if !exists {
+		limiter = helper.NewRateLimiter(0)
+		limiters[key] = limiter
+	}
+	return limiter
+}
+
+// dropTransferLimiter forgets the limit of a transfer that has ended
+func dropTransferLimiter(transferID string) {
+	limitsMutex.Lock()
+	delete(transferLimiters, transferID)
+	limitsMutex.Unlock()
+}
+
+// throttle wraps what a transfer reads for sending in its own, its recipient's and the global limit
+func throttle(reader io.Reader, recipientId, transferID string) io.Reader {
+	return helper.NewLimitedReader(reader,
+		limiterFor(transferLimiters, transferID),
+		limiterFor(userLimiters, recipientId),
+		globalLimiter)
+}
+
+// transferLimit returns the rate a transfer is limited to on its own, zero when it is not
+func transferLimit(transferID string) int64 {
+	limitsMutex.Lock()
+	limiter, exists := transferLimiters[transferID]
+	limitsMutex.Unlock()
+	if !exists {
+		return 0
+	}
+	return limiter.Rate()
+}
+
+// HandleLimit handles the /limit command:
+//
+//	/limit                         list the limits in place
+//	/limit <transferId> <rate>     limit one outgoing transfer
+//	/limit user <userId> <rate>    limit everything sent to a user
+//	/limit all <rate>              limit everything this client sends
+func HandleLimit(args []string) {
+	if len(args) == 0 {
+		listLimits()
+		return
+	}
+	if len(args) != 2 && !(len(args) == 3 && args[0] == "user") {
+		fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /limit <transferId|all> <rate> or /limit user <userId> <rate>"))
+		return
+	}
+
+	rate, err := helper.ParseRate(args[len(args)-1])
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error:"), err)
+		return
+	}
+
+	switch {
+	case args[0] == "all":
+		globalLimiter.SetRate(rate)
+		fmt.Println(utils.SuccessColor("🚦 All outgoing transfers limited to"), utils.InfoColor(helper.FormatRate(rate)))
+	case args[0] == "user":
+		limiterFor(userLimiters, args[1]).SetRate(rate)
+		fmt.Printf("%s Transfers to %s limited to %s\n",
+			utils.SuccessColor("🚦"),
+			utils.UserColor(args[1]),
+			utils.InfoColor(helper.FormatRate(rate)))
+	default:
+		transferID := args[0]
+		transfer, exists := GetTransfer(transferID)
+		if !exists {
+			fmt.Println(utils.ErrorColor("❌ Transfer not found:"), utils.CommandColor(transferID))
+			return
+		}
+		if transfer.Direction != "send" {
+			fmt.Printf("%s Only outgoing transfers can be limited, %s can limit %s\n",
+				utils.WarningColor("⚠"),
+				utils.UserColor(transfer.Recipient),
+				utils.CommandColor(transferID))
+			return
+		}
+		limiterFor(transferLimiters, transferID).SetRate(rate)
+		fmt.Printf("%s Transfer %s of '%s' limited to %s\n",
+			utils.SuccessColor("🚦"),
+			utils.CommandColor(transferID),
+			utils.InfoColor(transfer.Name),
+			utils.InfoColor(helper.FormatRate(rate)))
+	}
+}
+
+// listLimits prints the limits that are in place
+func listLimits() {
+	fmt.Println(utils.HeaderColor("🚦 Bandwidth Limits:"))
+	fmt.Println(utils.InfoColor("-----------------------------------"))
+	fmt.Printf("   All transfers: %s\n", utils.InfoColor(helper.FormatRate(globalLimiter.Rate())))
+
+	limitsMutex.Lock()
+	users := make([]string, 0, len(userLimiters))
+	for userId, limiter := range userLimiters {
+		if limiter.Rate() > 0 {
+			users = append(users, userId)
+		}
+	}
+	transfers := make([]string, 0, len(transferLimiters))
+	for transferID, limiter := range transferLimiters {
+		if limiter.Rate() > 0 {
+			transfers = append(transfers, transferID)
+		}
+	}
+	limitsMutex.Unlock()
+	sort.Strings(users)
+	sort.Strings(transfers)
+
+	for _, userId := range users {
+		fmt.Printf("   User %s: %s\n", utils.UserColor(userId), utils.InfoColor(helper.FormatRate(limiterFor(userLimiters, userId).Rate())))
+	}
+	for _, transferID := range transfers {
+		fmt.Printf("   Transfer %s: %s\n", utils.CommandColor(transferID), utils.InfoColor(helper.FormatRate(transferLimit(transferID))))
+	}
+	fmt.Println(utils.InfoColor("-----------------------------------"))
+}
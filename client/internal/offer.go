@@ -0,0 +1,317 @@
+package connection
+
+import (
+	"ItShare/helper"
+	"ItShare/protocol"
+	"ItShare/utils"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a sender waits for its offer to be answered. The server closes
+// unanswered offers sooner, so its verdict normally arrives first.
+const offerAnswerTimeout = 3 * time.Minute
+
+// IncomingOffer is a file or folder another user wants to send, waiting for /accept or /reject
+type IncomingOffer struct {
+	TransferId string
+	Type       TransferType
+	SenderId   string
+	Name       string
+	Size       int64
+	Checksum   string
+	StorePath  string
+	Received   time.Time
+}
+
+var (
+	pendingOffers      = make(map[string]*IncomingOffer)
+	pendingOffersMutex sync.Mutex
+
+	// requestedDownloads holds the names asked for with /download, per owner,
+	// so the matching offers are accepted without asking again
+	requestedDownloads      = make(map[string][]string)
+	requestedDownloadsMutex sync.Mutex
+)
+
+// offerReceived accepts an offer right away when a rule allows it and keeps it
+// pending for the user otherwise
+func offerReceived(conn *protocol.Conn, offer *IncomingOffer) {
+	// The name is joined onto the store path, so it must not lead out of it
+	if err := helper.ValidateName(offer.Name); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Refused offer from"), utils.UserColor(offer.SenderId), utils.ErrorColor(err.Error()))
+		if err := conn.SendCommand("/TRANSFER_REJECT " + offer.TransferId); err != nil {
+			fmt.Println(utils.ErrorColor("❌ Error rejecting transfer:"), err)
+		}
+		return
+	}
+	if takeRequestedDownload(offer.SenderId, offer.Name) {
+		fmt.Println(utils.InfoColor("📥 Receiving the requested download"), utils.InfoColor(offer.Name))
+		acceptOffer(conn, offer)
+		return
+	}
+	if hasAutoAcceptRules() {
+		// Rules name users, so the sender's name is asked for. The answer arrives on the
+		// loop that handed over this offer, which must not wait for it.
+		go func() {
+			_, sender, err := lookupUser(conn, offer.SenderId)
+			if err == nil && isAutoAccepted(sender) {
+				fmt.Println(utils.InfoColor("📥 Auto-accepting"), utils.InfoColor(offer.Name), utils.InfoColor("from"), utils.UserColor(sender))
+				acceptOffer(conn, offer)
+				return
+			}
+			holdOffer(offer)
+		}()
+		return
+	}
+	holdOffer(offer)
+}
+
+// holdOffer keeps an offer until the user accepts or rejects it
+func holdOffer(offer *IncomingOffer) {
+	pendingOffersMutex.Lock()
+	pendingOffers[offer.TransferId] = offer
+	pendingOffersMutex.Unlock()
+
+	fmt.Printf("%s %s wants to send you the %s '%s' (Size: %s, Transfer ID: %s)\n",
+		utils.InfoColor("📨"),
+		utils.UserColor(offer.SenderId),
+		formatTransferType(offer.Type),
+		utils.InfoColor(offer.Name),
+		utils.InfoColor(formatSize(offer.Size)),
+		utils.CommandColor(offer.TransferId))
+	if offer.Checksum != "" {
+		fmt.Println(utils.InfoColor("📋 Checksum:"), utils.InfoColor(offer.Checksum))
+	}
+	fmt.Printf("   Type %s or %s\n",
+		utils.CommandColor("/accept "+offer.TransferId),
+		utils.CommandColor("/reject "+offer.TransferId))
+}
+
+func takeOffer(transferID string) (*IncomingOffer, bool) {
+	pendingOffersMutex.Lock()
+	defer pendingOffersMutex.Unlock()
+	offer, exists := pendingOffers[transferID]
+	delete(pendingOffers, transferID)
+	return offer, exists
+}
+
+// listOffers returns the pending offers, oldest first
+func listOffers() []*IncomingOffer {
+	pendingOffersMutex.Lock()
+	defer pendingOffersMutex.Unlock()
+	offers := make([]*IncomingOffer, 0, len(pendingOffers))
+	for _, offer := range pendingOffers {
+		offers = append(offers, offer)
+	}
+	sort.Slice(offers, func(i, j int) bool { return offers[i].Received.Before(offers[j].Received) })
+	return offers
+}
+
+// acceptOffer tells the server the offer is wanted and starts receiving it
+func acceptOffer(conn *protocol.Conn, offer *IncomingOffer) {
+	if err := conn.SendCommand("/TRANSFER_ACCEPT " + offer.TransferId); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error accepting transfer:"), err)
+		return
+	}
+	go receiveTransfer(conn, offer.TransferId, offer.SenderId, func(data *dataReader) {
+		if offer.Type == FolderTransfer {
+			HandleFolderTransfer(conn, data, offer.SenderId, offer.Name, offer.TransferId, offer.Size, offer.StorePath)
+		} else {
+			HandleFileTransfer(conn, data, offer.SenderId, offer.Name, offer.Checksum, offer.TransferId, offer.Size, offer.StorePath)
+		}
+	})
+}
+
+// HandleAcceptOffer handles the /accept command
+func HandleAcceptOffer(conn *protocol.Conn, transferID string) {
+	offer, exists := takeOffer(transferID)
+	if !exists {
+		fmt.Println(utils.ErrorColor("❌ No pending offer:"), utils.CommandColor(transferID))
+		return
+	}
+	fmt.Println(utils.SuccessColor("✅ Accepted"), utils.InfoColor(offer.Name), utils.SuccessColor("from"), utils.UserColor(offer.SenderId))
+	acceptOffer(conn, offer)
+}
+
+// HandleRejectOffer handles the /reject command
+func HandleRejectOffer(conn *protocol.Conn, transferID string) {
+	offer, exists := takeOffer(transferID)
+	if !exists {
+		fmt.Println(utils.ErrorColor("❌ No pending offer:"), utils.CommandColor(transferID))
+		return
+	}
+	takeDirectOffer(transferID)
+	if err := conn.SendCommand("/TRANSFER_REJECT " + transferID); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error rejecting transfer:"), err)
+		return
+	}
+	fmt.Println(utils.WarningColor("🚫 Rejected"), utils.InfoColor(offer.Name), utils.WarningColor("from"), utils.UserColor(offer.SenderId))
+}
+
+// offerClosed drops an offer the server no longer holds, because it expired or its sender left
+func offerClosed(transferID, reason string) {
+	offer, exists := takeOffer(transferID)
+	if !exists {
+		return
+	}
+	takeDirectOffer(transferID)
+	fmt.Printf("%s Offer of '%s' from %s closed: %s\n",
+		utils.WarningColor("⌛"),
+		utils.InfoColor(offer.Name),
+		utils.UserColor(offer.SenderId),
+		reason)
+}
+
+// rememberDownload notes a /download so the offer answering it needs no /accept
+func rememberDownload(ownerId, filePath string) {
+	requestedDownloadsMutex.Lock()
+	defer requestedDownloadsMutex.Unlock()
+	requestedDownloads[ownerId] = append(requestedDownloads[ownerId], filepath.Base(filePath))
+}
+
+func takeRequestedDownload(ownerId, name string) bool {
+	requestedDownloadsMutex.Lock()
+	defer requestedDownloadsMutex.Unlock()
+	names := requestedDownloads[ownerId]
+	for i, requested := range names {
+		if requested == name {
+			requestedDownloads[ownerId] = append(names[:i], names[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Auto-accept rules are kept per server and name users, since a user gets a new ID
+// whenever they log in afresh while names stay theirs
+func autoAcceptFile() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "autoaccept.json"), nil
+}
+
+func loadAutoAccept() (map[string][]string, error) {
+	rules := make(map[string][]string)
+	path, err := autoAcceptFile()
+	if err != nil {
+		return rules, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return rules, nil
+	}
+	if err != nil {
+		return rules, err
+	}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return make(map[string][]string), fmt.Errorf("corrupt auto-accept file %s: %v", path, err)
+	}
+	// Older rules held user IDs, which may belong to someone else by now
+	for server, names := range rules {
+		kept := names[:0]
+		for _, name := range names {
+			if !isNumeric(name) {
+				kept = append(kept, name)
+			}
+		}
+		rules[server] = kept
+	}
+	return rules, nil
+}
+
+func storeAutoAccept(rules map[string][]string) error {
+	path, err := autoAcceptFile()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// hasAutoAcceptRules reports whether any user's offers are accepted without asking
+func hasAutoAcceptRules() bool {
+	rules, _ := loadAutoAccept()
+	return len(rules[CurrentServer()]) > 0
+}
+
+// isAutoAccepted reports whether offers from the user with this name are accepted
+// without asking. Names are unique on a server whatever their case.
+func isAutoAccepted(username string) bool {
+	rules, _ := loadAutoAccept()
+	for _, name := range rules[CurrentServer()] {
+		if strings.EqualFold(name, username) {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleAutoAccept handles the /autoaccept command: no argument lists the rules,
+// "<username>" adds one and "off <username>" removes it
+func HandleAutoAccept(args []string) {
+	rules, err := loadAutoAccept()
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error reading auto-accept rules:"), err)
+		return
+	}
+	server := CurrentServer()
+	names := rules[server]
+
+	switch {
+	case len(args) == 0:
+		if len(names) == 0 {
+			fmt.Println(utils.InfoColor("📨 Every incoming transfer asks for /accept"))
+			return
+		}
+		fmt.Println(utils.HeaderColor("📨 Always accepting transfers from:"))
+		for _, name := range names {
+			fmt.Println("  " + utils.UserColor(name))
+		}
+		return
+	case len(args) == 1 && args[0] != "off":
+		for _, name := range names {
+			if strings.EqualFold(name, args[0]) {
+				fmt.Println(utils.WarningColor("⚠ Already accepting transfers from"), utils.UserColor(args[0]))
+				return
+			}
+		}
+		rules[server] = append(names, args[0])
+	case len(args) == 2 && args[0] == "off":
+		kept := names[:0]
+		for _, name := range names {
+			if !strings.EqualFold(name, args[1]) {
+				kept = append(kept, name)
+			}
+		}
+		if len(kept) == len(names) {
+			fmt.Println(utils.WarningColor("⚠ No auto-accept rule for"), utils.UserColor(args[1]))
+			return
+		}
+		rules[server] = kept
+	default:
+		fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /autoaccept [username | off <username>]"))
+		return
+	}
+
+	if err := storeAutoAccept(rules); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error saving auto-accept rules:"), err)
+		return
+	}
+	if args[0] == "off" {
+		fmt.Println(utils.SuccessColor("✅ Transfers from"), utils.UserColor(args[1]), utils.SuccessColor("will ask for /accept again"))
+	} else {
+		fmt.Println(utils.SuccessColor("✅ Transfers from"), utils.UserColor(args[0]), utils.SuccessColor("will be accepted automatically"))
+	}
+}
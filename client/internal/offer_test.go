@@ -0,0 +1,44 @@
+package connection
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAutoAcceptRulesNameUsers(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	setCurrentSession("server:8080", nil)
+	t.Cleanup(func() { setCurrentSession("", nil) })
+
+	dir, err := ConfigDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A rule by ID from an older version sits next to one by name
+	rules := `{"server:8080": ["4821", "Alice"], "other:8080": ["bob"]}`
+	if err := os.WriteFile(filepath.Join(dir, "autoaccept.json"), []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		username string
+		want     bool
+	}{
+		{"Alice", true},
+		{"alice", true},
+		{"4821", false},
+		{"bob", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isAutoAccepted(tt.username); got != tt.want {
+			t.Errorf("isAutoAccepted(%q) = %v, want %v", tt.username, got, tt.want)
+		}
+	}
+
+	HandleAutoAccept([]string{"off", "ALICE"})
+	if hasAutoAcceptRules() {
+		t.Fatal("rules left after removing the only named one")
+	}
+}
@@ -0,0 +1,172 @@
+package connection
+
+import (
+	"ItShare/protocol"
+	"ItShare/utils"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Either side can pause a running transfer. The request travels on the transfer's data
+// channel, so it reaches the peer through the relay or over a direct connection alike:
+//
+//	/PAUSE
+//	/RESUME
+//
+// The sender stops producing data while either side holds the transfer, and the relay
+// waits for a paused receiver instead of timing it out. A transfer only continues once
+// every side that paused it has resumed.
+
+// applyPeerCommand applies a pause, resume or cancel sent by the other side of a
+// transfer and reports whether the command was one of them
+func applyPeerCommand(transferID, command string) bool {
+	var paused bool
+	switch strings.TrimSpace(command) {
+	case "/PAUSE":
+		paused = true
+	case "/RESUME":
+		paused = false
+	case "/CANCEL":
+		cancelledByPeer(transferID)
+		return true
+	default:
+		return false
+	}
+
+	transfer, exists := GetTransfer(transferID)
+	if !exists {
+		return true
+	}
+	transfer.PauseLock.Lock()
+	changed := transfer.PeerPaused != paused && (transfer.Status == Active || transfer.Status == Paused)
+	if changed {
+		transfer.PeerPaused = paused
+		transfer.Status = Active
+		if transfer.IsPaused || transfer.PeerPaused {
+			transfer.Status = Paused
+		}
+		if transfer.ProgressBar != nil {
+			transfer.ProgressBar.SetPaused(transfer.Status == Paused)
+		}
+		transfer.notifyChanged()
+	}
+	transfer.PauseLock.Unlock()
+
+	if changed && paused {
+		fmt.Printf("%s Transfer %s paused by %s\n",
+			utils.WarningColor("\n⏸"),
+			utils.CommandColor(transferID),
+			utils.UserColor(transfer.Recipient))
+	} else if changed {
+		fmt.Printf("%s Transfer %s resumed by %s\n",
+			utils.SuccessColor("\n▶"),
+			utils.CommandColor(transferID),
+			utils.UserColor(transfer.Recipient))
+	}
+	return true
+}
+
+// signalPeer sends a pause, resume or cancel to the other side on the transfer's data channel
+func signalPeer(transferID, command string) error {
+	dataChannelsMutex.Lock()
+	conns := dataChannels[transferID]
+	dataChannelsMutex.Unlock()
+	if len(conns) == 0 {
+		return nil
+	}
+	return conns[0].SendCommand(command)
+}
+
+// waitWhilePaused blocks while either side holds a transfer and reports an interruption
+// or cancellation
+func waitWhilePaused(transfer *Transfer) error {
+	transfer.PauseLock.Lock()
+	defer transfer.PauseLock.Unlock()
+	for {
+		switch {
+		case transfer.Status == Interrupted:
+			return ErrTransferInterrupted
+		case transfer.Status == Cancelled:
+			return ErrTransferCancelled
+		case !transfer.IsPaused && !transfer.PeerPaused:
+			return nil
+		}
+		if transfer.stateChanged == nil {
+			transfer.stateChanged = sync.NewCond(&transfer.PauseLock)
+		}
+		transfer.stateChanged.Wait()
+	}
+}
+
+// pausedBy describes who holds a paused transfer
+func pausedBy(transfer *Transfer) string {
+	transfer.PauseLock.Lock()
+	defer transfer.PauseLock.Unlock()
+	switch {
+	case transfer.IsPaused && transfer.PeerPaused:
+		return "you and " + transfer.Recipient
+	case transfer.PeerPaused:
+		return transfer.Recipient
+	case transfer.IsPaused:
+		return "you"
+	}
+	return ""
+}
+
+// peerReplies reads what the receiver sends back on a sender's data channel. Pause
+// and resume requests are applied as they arrive, everything else waits for Receive.
+type peerReplies struct {
+	frames chan protocol.Frame
+	done   chan struct{}
+}
+
+// watchReplies starts reading the receiver's side of a sender's data channel. The
+// sender is not reading while it streams, so this is what lets a receiver pause it.
+func watchReplies(conn *protocol.Conn, transferID string) *peerReplies {
+	replies := &peerReplies{
+		frames: make(chan protocol.Frame),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(replies.frames)
+		for {
+			frame, err := conn.Receive()
+			if err != nil {
+				// A sender held by a pause would otherwise wait for a peer that is gone
+				if transfer, exists := GetTransfer(transferID); exists {
+					transfer.PauseLock.Lock()
+					if transfer.Status == Paused {
+						transfer.Status = Interrupted
+						transfer.notifyChanged()
+					}
+					transfer.PauseLock.Unlock()
+				}
+				return
+			}
+			if frame.Type == protocol.FrameCommand && applyPeerCommand(transferID, string(frame.Payload)) {
+				continue
+			}
+			select {
+			case replies.frames <- frame:
+			case <-replies.done:
+				return
+			}
+		}
+	}()
+	return replies
+}
+
+// Receive returns the next frame from the receiver that is not a pause or resume
+func (r *peerReplies) Receive() (protocol.Frame, error) {
+	frame, ok := <-r.frames
+	if !ok {
+		return protocol.Frame{}, ErrTransferInterrupted
+	}
+	return frame, nil
+}
+
+// stop releases the reader once the sender no longer expects replies
+func (r *peerReplies) stop() {
+	close(r.done)
+}
@@ -0,0 +1,258 @@
+package connection
+
+import (
+	"ItShare/protocol"
+	"ItShare/utils"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Outgoing sends, whether typed in or serving a /download, wait in a queue and only
+// maxActiveSends of them run at a time. A queued send is listed in ActiveTransfers with
+// the Queued status under the ID it keeps once it starts, then as AwaitingAccept until
+// the recipient accepts and the running transfer takes its place. Transfers resumed
+// after a disconnect continue right away, they already had their turn.
+
+// Priority orders queued sends, higher ones start first
+type Priority int
+
+const (
+	LowPriority Priority = iota
+	NormalPriority
+	HighPriority
+)
+
+// String representation of Priority
+func (p Priority) String() string {
+	switch p {
+	case LowPriority:
+		return "low"
+	case HighPriority:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+// parsePriority reads a priority given on the command line
+func parsePriority(name string) (Priority, error) {
+	switch name {
+	case "low":
+		return LowPriority, nil
+	case "normal":
+		return NormalPriority, nil
+	case "high":
+		return HighPriority, nil
+	}
+	return NormalPriority, fmt.Errorf("unknown priority %q, use high, normal or low", name)
+}
+
+// queuedSend is an outgoing send waiting for a free slot
+type queuedSend struct {
+	transfer *Transfer
+	priority Priority
+	seq      uint64
+	run      func()
+}
+
+var (
+	sendQueue      []*queuedSend
+	sendSeq        uint64
+	runningSends   int
+	maxActiveSends = 2
+	sendQueueMutex sync.Mutex
+)
+
+// SetMaxActiveSends sets how many outgoing transfers run at once
+func SetMaxActiveSends(count int) {
+	sendQueueMutex.Lock()
+	maxActiveSends = max(count, 1)
+	sendQueueMutex.Unlock()
+}
+
+// enqueueSend queues a file or folder for a recipient and returns without waiting for it
+func enqueueSend(conn *protocol.Conn, transferType TransferType, recipientId, path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error opening "+formatTransferType(transferType)+":"), err)
+		return
+	}
+
+	transferID := GenerateTransferID()
+	transfer := &Transfer{
+		ID:         transferID,
+		Type:       transferType,
+		Name:       info.Name(),
+		Size:       info.Size(),
+		Status:     Queued,
+		Direction:  "send",
+		Recipient:  recipientId,
+		Path:       path,
+		StartTime:  time.Now(),
+		Connection: conn,
+	}
+	run := func() { HandleSendFile(conn, recipientId, path, transferID) }
+	if transferType == FolderTransfer {
+		transfer.Size = 0
+		run = func() { HandleSendFolder(conn, recipientId, path, transferID) }
+	}
+	RegisterTransfer(transfer)
+
+	sendQueueMutex.Lock()
+	sendSeq++
+	sendQueue = append(sendQueue, &queuedSend{transfer: transfer, priority: NormalPriority, seq: sendSeq, run: run})
+	sortSendQueue()
+	waiting := runningSends >= maxActiveSends
+	position := len(sendQueue)
+	sendQueueMutex.Unlock()
+
+	if waiting {
+		fmt.Printf("%s Queued %s '%s' for %s (Transfer ID: %s, position %d)\n",
+			utils.InfoColor("🕒"),
+			formatTransferType(transfer.Type),
+			utils.InfoColor(filepath.Base(path)),
+			utils.UserColor(recipientId),
+			utils.CommandColor(transferID),
+			position)
+	}
+	dispatchSends()
+}
+
+// sortSendQueue puts higher priorities first and keeps the order sends were queued in
+// otherwise. Callers must hold sendQueueMutex.
+func sortSendQueue() {
+	sort.SliceStable(sendQueue, func(i, j int) bool {
+		if sendQueue[i].priority != sendQueue[j].priority {
+			return sendQueue[i].priority > sendQueue[j].priority
+		}
+		return sendQueue[i].seq < sendQueue[j].seq
+	})
+}
+
+// dispatchSends starts queued sends while there are free slots
+func dispatchSends() {
+	sendQueueMutex.Lock()
+	defer sendQueueMutex.Unlock()
+	for runningSends < maxActiveSends && len(sendQueue) > 0 {
+		next := sendQueue[0]
+		sendQueue = sendQueue[1:]
+		runningSends++
+		next.transfer.PauseLock.Lock()
+		next.transfer.Status = AwaitingAccept
+		next.transfer.StartTime = time.Now()
+		next.transfer.PauseLock.Unlock()
+		go runSend(next)
+	}
+}
+
+// runSend runs one send in its slot and hands the slot on once it is done
+func runSend(send *queuedSend) {
+	// The send registers the running transfer under the same ID once the recipient accepts it
+	send.run()
+	dropTransferLimiter(send.transfer.ID)
+
+	// A send that never got going leaves its queue entry behind
+	TransfersMutex.Lock()
+	if ActiveTransfers[send.transfer.ID] == send.transfer {
+		send.transfer.unregistered()
+		delete(ActiveTransfers, send.transfer.ID)
+	}
+	TransfersMutex.Unlock()
+
+	sendQueueMutex.Lock()
+	runningSends--
+	sendQueueMutex.Unlock()
+	dispatchSends()
+}
+
+// dequeueSend drops a send that has not started yet, reporting whether it was queued
+func dequeueSend(transferID string) (*Transfer, bool) {
+	sendQueueMutex.Lock()
+	defer sendQueueMutex.Unlock()
+	for i, send := range sendQueue {
+		if send.transfer.ID == transferID {
+			sendQueue = append(sendQueue[:i], sendQueue[i+1:]...)
+			RemoveTransfer(transferID)
+			dropTransferLimiter(transferID)
+			return send.transfer, true
+		}
+	}
+	return nil, false
+}
+
+// withdrawStartingSend cancels a send that left the queue but has not been offered yet
+func withdrawStartingSend(transferID string) (*Transfer, bool) {
+	transfer, exists := GetTransfer(transferID)
+	if !exists {
+		return nil, false
+	}
+	transfer.PauseLock.Lock()
+	defer transfer.PauseLock.Unlock()
+	if transfer.Status != AwaitingAccept {
+		return nil, false
+	}
+	transfer.Status = Cancelled
+	return transfer, true
+}
+
+// sendWithdrawn reports whether a send was cancelled before it offered its transfer
+func sendWithdrawn(transferID string) bool {
+	transfer, exists := GetTransfer(transferID)
+	return exists && isCancelled(transfer)
+}
+
+// queuePosition returns where a queued send stands and its priority
+func queuePosition(transferID string) (int, Priority, bool) {
+	sendQueueMutex.Lock()
+	defer sendQueueMutex.Unlock()
+	for i, send := range sendQueue {
+		if send.transfer.ID == transferID {
+			return i + 1, send.priority, true
+		}
+	}
+	return 0, NormalPriority, false
+}
+
+// HandlePriority handles the /priority command, which reorders sends still in the queue
+func HandlePriority(transferID, level string) {
+	priority, err := parsePriority(level)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error:"), err)
+		return
+	}
+
+	sendQueueMutex.Lock()
+	var found *queuedSend
+	for _, send := range sendQueue {
+		if send.transfer.ID == transferID {
+			found = send
+			send.priority = priority
+		}
+	}
+	sortSendQueue()
+	sendQueueMutex.Unlock()
+
+	if found == nil {
+		if transfer, exists := GetTransfer(transferID); exists {
+			fmt.Printf("%s Transfer %s is not queued (current status: %s)\n",
+				utils.WarningColor("⚠"),
+				utils.CommandColor(transferID),
+				utils.WarningColor(transfer.Status.String()))
+			return
+		}
+		fmt.Println(utils.ErrorColor("❌ Transfer not found:"), utils.CommandColor(transferID))
+		return
+	}
+
+	position, _, _ := queuePosition(transferID)
+	fmt.Printf("%s Transfer %s of '%s' now has %s priority (position %d)\n",
+		utils.SuccessColor("🔀"),
+		utils.CommandColor(transferID),
+		utils.InfoColor(found.transfer.Name),
+		utils.InfoColor(priority.String()),
+		position)
+}
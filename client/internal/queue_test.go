@@ -0,0 +1,167 @@
+package connection
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// testQueue queues sends that report when they start and run until released
+type testQueue struct {
+	t        *testing.T
+	started  chan string
+	release  map[string]chan struct{}
+	mutex    sync.Mutex
+	running  int
+	mostRuns int
+}
+
+func newTestQueue(t *testing.T, slots int) *testQueue {
+	SetMaxActiveSends(slots)
+	q := &testQueue{t: t, started: make(chan string, 16), release: make(map[string]chan struct{})}
+	t.Cleanup(func() {
+		sendQueueMutex.Lock()
+		sendQueue = nil
+		sendQueueMutex.Unlock()
+		for transferID := range q.release {
+			q.finish(transferID)
+		}
+		// Wait for the running sends to hand their slots back
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			sendQueueMutex.Lock()
+			idle := runningSends == 0
+			sendQueueMutex.Unlock()
+			if idle {
+				break
+			}
+		}
+		SetMaxActiveSends(2)
+	})
+	return q
+}
+
+// finish lets a started send complete
+func (q *testQueue) finish(transferID string) {
+	if release, exists := q.release[transferID]; exists {
+		close(release)
+		delete(q.release, transferID)
+	}
+}
+
+// add queues a send the way enqueueSend does, without a file or recipient behind it
+func (q *testQueue) add(transferID string) {
+	release := make(chan struct{})
+	q.release[transferID] = release
+	transfer := &Transfer{ID: transferID, Name: transferID + ".bin", Status: Queued, Direction: "send"}
+	RegisterTransfer(transfer)
+	q.t.Cleanup(func() { RemoveTransfer(transferID) })
+
+	run := func() {
+		q.mutex.Lock()
+		q.running++
+		q.mostRuns = max(q.mostRuns, q.running)
+		q.mutex.Unlock()
+		q.started <- transferID
+		<-release
+		q.mutex.Lock()
+		q.running--
+		q.mutex.Unlock()
+	}
+	sendQueueMutex.Lock()
+	sendSeq++
+	sendQueue = append(sendQueue, &queuedSend{transfer: transfer, priority: NormalPriority, seq: sendSeq, run: run})
+	sortSendQueue()
+	sendQueueMutex.Unlock()
+	dispatchSends()
+}
+
+// nextStart returns the next send to start
+func (q *testQueue) nextStart() string {
+	q.t.Helper()
+	select {
+	case started := <-q.started:
+		return started
+	case <-time.After(2 * time.Second):
+		q.t.Fatal("no send started")
+		return ""
+	}
+}
+
+// expectStart checks that transferID is the next send to start
+func (q *testQueue) expectStart(transferID string) {
+	q.t.Helper()
+	if started := q.nextStart(); started != transferID {
+		q.t.Fatalf("%s started, want %s", started, transferID)
+	}
+}
+
+// expectIdle checks that no further send starts
+func (q *testQueue) expectIdle() {
+	q.t.Helper()
+	select {
+	case started := <-q.started:
+		q.t.Fatalf("%s started without a free slot", started)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSendQueuePriority(t *testing.T) {
+	q := newTestQueue(t, 1)
+	q.add("a0000001")
+	q.expectStart("a0000001")
+	q.add("b0000002")
+	q.add("c0000003")
+	q.add("d0000004")
+	q.expectIdle()
+
+	HandlePriority("b0000002", "low")
+	HandlePriority("d0000004", "high")
+	wantPositions := map[string]int{"d0000004": 1, "c0000003": 2, "b0000002": 3}
+	for transferID, want := range wantPositions {
+		if got, _, queued := queuePosition(transferID); !queued || got != want {
+			t.Errorf("queuePosition(%s) = %d, %v, want %d", transferID, got, queued, want)
+		}
+	}
+	if transfer, _ := GetTransfer("a0000001"); transfer.Status != AwaitingAccept {
+		t.Fatalf("running send has status %s, want %s", transfer.Status, AwaitingAccept)
+	}
+
+	q.finish("a0000001")
+	q.expectStart("d0000004")
+	q.finish("d0000004")
+	q.expectStart("c0000003")
+	q.finish("c0000003")
+	q.expectStart("b0000002")
+}
+
+func TestSendQueueLimitsActiveSends(t *testing.T) {
+	q := newTestQueue(t, 2)
+	for _, transferID := range []string{"a0000001", "b0000002", "c0000003", "d0000004"} {
+		q.add(transferID)
+	}
+	// Sends that get a slot together start in either order
+	first, second := q.nextStart(), q.nextStart()
+	if !(first == "a0000001" && second == "b0000002" || first == "b0000002" && second == "a0000001") {
+		t.Fatalf("%s and %s started, want the first two queued", first, second)
+	}
+	q.expectIdle()
+
+	if transfer, queued := dequeueSend("d0000004"); !queued || transfer.ID != "d0000004" {
+		t.Fatal("dequeueSend() did not find the queued send")
+	}
+	if _, exists := GetTransfer("d0000004"); exists {
+		t.Fatal("a dequeued send is still listed")
+	}
+
+	q.finish("b0000002")
+	q.expectStart("c0000003")
+	q.finish("a0000001")
+	q.finish("c0000003")
+	q.expectIdle()
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.mostRuns != 2 {
+		t.Fatalf("%d sends ran at once, want 2", q.mostRuns)
+	}
+}
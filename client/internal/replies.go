@@ -0,0 +1,54 @@
+package connection
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// pendingReplies holds goroutines waiting for a specific server reply, keyed by
+// something both sides know such as "ready:<transferId>"
+var (
+	pendingReplies = make(map[string]chan string)
+	repliesMutex   sync.Mutex
+)
+
+// expectReply registers interest in a reply before the request that triggers it is sent
+func expectReply(key string) chan string {
+	reply := make(chan string, 1)
+	repliesMutex.Lock()
+	pendingReplies[key] = reply
+	repliesMutex.Unlock()
+	return reply
+}
+
+// deliverReply hands a reply to its waiter, reporting whether anyone was waiting
+func deliverReply(key, message string) bool {
+	repliesMutex.Lock()
+	reply, exists := pendingReplies[key]
+	delete(pendingReplies, key)
+	repliesMutex.Unlock()
+	if !exists {
+		return false
+	}
+	reply <- message
+	return true
+}
+
+// cancelReply stops waiting for a reply
+func cancelReply(key string) {
+	repliesMutex.Lock()
+	delete(pendingReplies, key)
+	repliesMutex.Unlock()
+}
+
+// awaitReply waits for a reply registered with expectReply
+func awaitReply(key string, reply chan string, timeout time.Duration) (string, error) {
+	select {
+	case message := <-reply:
+		return message, nil
+	case <-time.After(timeout):
+		cancelReply(key)
+		return "", fmt.Errorf("timed out waiting for the server")
+	}
+}
@@ -0,0 +1,499 @@
+package connection
+
+import (
+	"ItShare/helper"
+	"ItShare/protocol"
+	"ItShare/utils"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// A receiver checkpoints its progress to the sidecar every checkpointInterval bytes
+const checkpointInterval = 4 << 20
+
+const (
+	partialSuffix = ".part"
+	sidecarSuffix = ".part.json"
+)
+
+// OutgoingTransfer is what a sender remembers about a file until the receiver has all of it
+type OutgoingTransfer struct {
+	TransferId  string `json:"transferId"`
+	Server      string `json:"server"`
+	RecipientId string `json:"recipientId"`
+	Path        string `json:"path"`
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	Checksum    string `json:"checksum"`
+	// HashAlgorithm is what a file sent in single-pass mode is hashed with, its checksum
+	// is only known once all of it has been read
+	HashAlgorithm helper.HashAlgorithm `json:"hashAlgorithm,omitempty"`
+}
+
+// PartialTransfer is the sidecar kept next to a .part file while it is incomplete
+type PartialTransfer struct {
+	TransferId    string `json:"transferId"`
+	SenderId      string `json:"senderId"`
+	FileName      string `json:"fileName"`
+	Size          int64  `json:"size"`
+	Checksum      string `json:"checksum"`
+	BytesReceived int64  `json:"bytesReceived"`
+}
+
+var outgoingMutex sync.Mutex
+
+func outgoingFile() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "transfers.json"), nil
+}
+
+// loadOutgoing reads the unfinished outgoing transfers, keyed by transfer ID.
+// Callers must hold outgoingMutex.
+func loadOutgoing() (map[string]OutgoingTransfer, error) {
+	records := make(map[string]OutgoingTransfer)
+	path, err := outgoingFile()
+	if err != nil {
+		return records, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+	if err != nil {
+		return records, err
+	}
+	if err := json.Unmarshal(data, &records); err != nil {
+		return make(map[string]OutgoingTransfer), fmt.Errorf("corrupt transfer file %s: %v", path, err)
+	}
+	return records, nil
+}
+
+func storeOutgoing(records map[string]OutgoingTransfer) error {
+	path, err := outgoingFile()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// saveOutgoingTransfer remembers an outgoing file so it can be continued after a disconnect
+func saveOutgoingTransfer(record *OutgoingTransfer) error {
+	outgoingMutex.Lock()
+	defer outgoingMutex.Unlock()
+	records, _ := loadOutgoing()
+	records[record.TransferId] = *record
+	return storeOutgoing(records)
+}
+
+// removeOutgoingTransfer forgets an outgoing file once it has been sent in full
+func removeOutgoingTransfer(transferID string) {
+	outgoingMutex.Lock()
+	defer outgoingMutex.Unlock()
+	records, err := loadOutgoing()
+	if err != nil {
+		return
+	}
+	if _, exists := records[transferID]; !exists {
+		return
+	}
+	delete(records, transferID)
+	storeOutgoing(records)
+}
+
+// getOutgoingTransfer returns the record of an unfinished outgoing transfer on the current server
+func getOutgoingTransfer(transferID string) (*OutgoingTransfer, bool) {
+	outgoingMutex.Lock()
+	defer outgoingMutex.Unlock()
+	records, err := loadOutgoing()
+	if err != nil {
+		return nil, false
+	}
+	record, exists := records[transferID]
+	if !exists || record.Server != CurrentServer() {
+		return nil, false
+	}
+	return &record, true
+}
+
+// pendingOutgoing lists the unfinished outgoing transfers on the current server
+func pendingOutgoing() []OutgoingTransfer {
+	outgoingMutex.Lock()
+	defer outgoingMutex.Unlock()
+	records, _ := loadOutgoing()
+	server := CurrentServer()
+	var pending []OutgoingTransfer
+	for _, record := range records {
+		if record.Server == server {
+			pending = append(pending, record)
+		}
+	}
+	return pending
+}
+
+func partialPath(storeFilePath, fileName string) string {
+	return filepath.Join(storeFilePath, fileName+partialSuffix)
+}
+
+func sidecarPath(storeFilePath, fileName string) string {
+	return filepath.Join(storeFilePath, fileName+sidecarSuffix)
+}
+
+// savePartial writes the sidecar, replacing the previous one in a single rename
+func savePartial(storeFilePath string, partial *PartialTransfer) error {
+	data, err := json.MarshalIndent(partial, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := sidecarPath(storeFilePath, partial.FileName)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// removePartial deletes the .part file and its sidecar
+func removePartial(storeFilePath string, partial *PartialTransfer) {
+	os.Remove(partialPath(storeFilePath, partial.FileName))
+	os.Remove(sidecarPath(storeFilePath, partial.FileName))
+}
+
+// listPartials returns the sidecars found in the store path
+func listPartials(storeFilePath string) []*PartialTransfer {
+	matches, _ := filepath.Glob(filepath.Join(storeFilePath, "*"+sidecarSuffix))
+	var partials []*PartialTransfer
+	for _, match := range matches {
+		data, err := os.ReadFile(match)
+		if err != nil {
+			continue
+		}
+		partial := &PartialTransfer{}
+		if err := json.Unmarshal(data, partial); err != nil || partial.TransferId == "" {
+			continue
+		}
+		// The sidecar is only trusted for the file it sits next to
+		if filepath.Base(match) != partial.FileName+sidecarSuffix {
+			continue
+		}
+		partials = append(partials, partial)
+	}
+	return partials
+}
+
+// findPartial returns the sidecar of a transfer in the store path
+func findPartial(storeFilePath, transferID string) (*PartialTransfer, bool) {
+	for _, partial := range listPartials(storeFilePath) {
+		if partial.TransferId == transferID {
+			return partial, true
+		}
+	}
+	return nil, false
+}
+
+// partialWriter writes to a .part file and checkpoints the sidecar as data comes in
+type partialWriter struct {
+	file          *os.File
+	partial       *PartialTransfer
+	storeFilePath string
+	unsaved       int64
+}
+
+func newPartialWriter(file *os.File, partial *PartialTransfer, storeFilePath string) *partialWriter {
+	return &partialWriter{
+		file:          file,
+		partial:       partial,
+		storeFilePath: storeFilePath,
+	}
+}
+
+func (pw *partialWriter) Write(p []byte) (int, error) {
+	n, err := pw.file.Write(p)
+	pw.partial.BytesReceived += int64(n)
+	pw.unsaved += int64(n)
+	if pw.unsaved >= checkpointInterval {
+		if err := pw.checkpoint(); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// checkpoint flushes the data to disk before recording it, so the sidecar never
+// claims bytes the .part file does not have
+func (pw *partialWriter) checkpoint() error {
+	pw.unsaved = 0
+	if err := pw.file.Sync(); err != nil {
+		return err
+	}
+	return savePartial(pw.storeFilePath, pw.partial)
+}
+
+// ResumePendingTransfers picks up the transfers left unfinished by an earlier
+// connection: partial files are requested again from their senders, and files
+// this client was sending are offered to their receivers
+func ResumePendingTransfers(conn *protocol.Conn) {
+	session := CurrentSession()
+	if session == nil {
+		return
+	}
+
+	for _, partial := range listPartials(session.StoreFilePath) {
+		requestResume(conn, session.StoreFilePath, partial)
+	}
+
+	for _, record := range pendingOutgoing() {
+		err := conn.SendCommand(fmt.Sprintf("/RESUME_OFFER %s %s", record.RecipientId, record.TransferId))
+		if err != nil {
+			fmt.Println(utils.ErrorColor("❌ Error offering transfer"), utils.CommandColor(record.TransferId), err)
+		}
+	}
+}
+
+// requestResume asks the sender of a partial file to continue where it stopped
+func requestResume(conn *protocol.Conn, storeFilePath string, partial *PartialTransfer) {
+	info, err := os.Stat(partialPath(storeFilePath, partial.FileName))
+	if err != nil || info.Size() < partial.BytesReceived {
+		// Without the data the sidecar describes there is nothing to continue
+		removePartial(storeFilePath, partial)
+		return
+	}
+
+	fmt.Printf("%s Asking %s to continue '%s' from %s (Transfer ID: %s)\n",
+		utils.InfoColor("🔄"),
+		utils.UserColor(partial.SenderId),
+		utils.InfoColor(partial.FileName),
+		utils.InfoColor(formatSize(partial.BytesReceived)),
+		utils.CommandColor(partial.TransferId))
+
+	err = conn.SendCommand(fmt.Sprintf("/RESUME_REQUEST %s %s %d", partial.SenderId, partial.TransferId, partial.BytesReceived))
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error requesting resume:"), err)
+	}
+}
+
+// handleResumeOffer answers a sender that reconnected and still has a file for us
+func handleResumeOffer(conn *protocol.Conn, senderId, transferID string) {
+	session := CurrentSession()
+	if session == nil {
+		return
+	}
+	// An interrupted receive may still be saving its checkpoint
+	if !waitTransferEnded(transferID, 5*time.Second) {
+		return
+	}
+	partial, exists := findPartial(session.StoreFilePath, transferID)
+	if !exists || partial.SenderId != senderId {
+		// Nothing left to continue, let the sender forget the transfer
+		_ = conn.SendCommand(fmt.Sprintf("/RESUME_UNAVAILABLE %s %s", senderId, transferID))
+		return
+	}
+	requestResume(conn, session.StoreFilePath, partial)
+}
+
+// HandleResumeRequest continues sending a file from the offset the receiver already has
+func HandleResumeRequest(conn *protocol.Conn, recipientId, transferID string, offset int64) {
+	record, exists := getOutgoingTransfer(transferID)
+	if !exists || record.RecipientId != recipientId {
+		fmt.Println(utils.WarningColor("⚠ Cannot resume unknown transfer"), utils.CommandColor(transferID))
+		_ = conn.SendCommand(fmt.Sprintf("/RESUME_UNAVAILABLE %s %s", recipientId, transferID))
+		return
+	}
+
+	// The previous attempt may still be winding down after the interruption
+	if !waitTransferEnded(transferID, 5*time.Second) {
+		fmt.Println(utils.WarningColor("⚠ Transfer is still running:"), utils.CommandColor(transferID))
+		return
+	}
+
+	file, err := os.Open(record.Path)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Cannot resume transfer, error opening file:"), err)
+		removeOutgoingTransfer(transferID)
+		_ = conn.SendCommand(fmt.Sprintf("/RESUME_UNAVAILABLE %s %s", recipientId, transferID))
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.Size() != record.Size || offset > record.Size {
+		fmt.Println(utils.ErrorColor("❌ Cannot resume transfer, the file changed since it was sent:"), utils.InfoColor(record.Path))
+		removeOutgoingTransfer(transferID)
+		_ = conn.SendCommand(fmt.Sprintf("/RESUME_UNAVAILABLE %s %s", recipientId, transferID))
+		return
+	}
+	// The manifest is rebuilt from the file, which must still hash to what was announced.
+	// A file sent in single-pass mode that never got that far is hashed while it is sent again.
+	var manifest *helper.ChunkManifest
+	if record.Checksum != "" {
+		checksum, err := helper.ParseChecksum(record.Checksum)
+		var current helper.Checksum
+		if err == nil {
+			manifest, current, err = helper.BuildManifest(record.Path, checksum.Algorithm, helper.DefaultChunkSize)
+		}
+		if err != nil || !helper.VerifyChecksum(checksum, current) {
+			fmt.Println(utils.ErrorColor("❌ Cannot resume transfer, the file changed since it was sent:"), utils.InfoColor(record.Path))
+			removeOutgoingTransfer(transferID)
+			_ = conn.SendCommand(fmt.Sprintf("/RESUME_UNAVAILABLE %s %s", recipientId, transferID))
+			return
+		}
+	}
+	if _, err := file.Seek(offset, 0); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error seeking in file:"), err)
+		return
+	}
+
+	fmt.Printf("%s Resuming '%s' for user %s from %s (Transfer ID: %s)\n",
+		utils.InfoColor("🔄"),
+		utils.InfoColor(record.Name),
+		utils.UserColor(recipientId),
+		utils.InfoColor(formatSize(offset)),
+		utils.CommandColor(transferID))
+
+	if err := setupEncryption(conn, recipientId, transferID, true); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Not resuming transfer:"), err)
+		return
+	}
+	defer dropTransferCipher(transferID)
+
+	ready := expectReply("transfer:" + transferID)
+	direct := offerDirectSend(transferID)
+	err = conn.SendCommand(direct.withPort(fmt.Sprintf("/FILE_RESUME %s %s %d %d", recipientId, transferID, record.Size, offset)))
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error sending resume request:"), err)
+		cancelReply("transfer:" + transferID)
+		direct.abandon()
+		return
+	}
+	token, err := awaitTransferReady(transferID, ready, 30*time.Second)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Resume refused:"), err)
+		direct.abandon()
+		return
+	}
+
+	sendFileData(conn, file, record, manifest, offset, direct, token)
+}
+
+// resumeFileTransfer receives the rest of a partial file starting at offset
+func resumeFileTransfer(conn *protocol.Conn, data *dataReader, senderId, transferID string, offset int64) {
+	session := CurrentSession()
+	if session == nil {
+		return
+	}
+	partial, exists := findPartial(session.StoreFilePath, transferID)
+	if !exists || partial.SenderId != senderId || partial.BytesReceived != offset {
+		fmt.Println(utils.WarningColor("⚠ Ignoring unexpected resume of transfer"), utils.CommandColor(transferID))
+		return
+	}
+
+	file, err := os.OpenFile(partialPath(session.StoreFilePath, partial.FileName), os.O_RDWR, 0644)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error opening partial file:"), err)
+		return
+	}
+	// Anything past the last checkpoint was never confirmed and is received again
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		fmt.Println(utils.ErrorColor("❌ Error preparing partial file:"), err)
+		return
+	}
+	if _, err := file.Seek(offset, 0); err != nil {
+		file.Close()
+		fmt.Println(utils.ErrorColor("❌ Error preparing partial file:"), err)
+		return
+	}
+
+	fmt.Printf("%s Resuming file: %s from %s of %s (Transfer ID: %s)\n",
+		utils.InfoColor("🔄"),
+		utils.InfoColor(partial.FileName),
+		utils.InfoColor(formatSize(offset)),
+		utils.InfoColor(formatSize(partial.Size)),
+		utils.CommandColor(transferID))
+
+	receiveFileData(conn, data, file, partial, session.StoreFilePath)
+}
+
+// handleResumeUnavailable forgets a transfer the other side can no longer continue
+func handleResumeUnavailable(peerId, transferID string) {
+	if record, exists := getOutgoingTransfer(transferID); exists && record.RecipientId == peerId {
+		removeOutgoingTransfer(transferID)
+		return
+	}
+
+	session := CurrentSession()
+	if session == nil {
+		return
+	}
+	partial, exists := findPartial(session.StoreFilePath, transferID)
+	if !exists || partial.SenderId != peerId {
+		return
+	}
+	removePartial(session.StoreFilePath, partial)
+	fmt.Printf("%s Transfer %s of '%s' cannot be resumed, the partial file was removed\n",
+		utils.WarningColor("⚠"),
+		utils.CommandColor(transferID),
+		utils.InfoColor(partial.FileName))
+}
+
+// interruptTransfer stops a transfer whose other side disconnected. It is kept
+// on disk so it continues once the peer is back.
+func interruptTransfer(transferID string) {
+	if transfer, exists := GetTransfer(transferID); exists {
+		transfer.PauseLock.Lock()
+		if transfer.Status != Cancelled {
+			transfer.Status = Interrupted
+		}
+		transfer.IsPaused = false
+		transfer.PeerPaused = false
+		transfer.notifyChanged()
+		transfer.PauseLock.Unlock()
+	}
+	closeDataChannel(transferID)
+}
+
+// waitTransferEnded waits until a transfer is no longer registered as running
+func waitTransferEnded(transferID string, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		ended, running := transferEnded(transferID)
+		if !running {
+			return true
+		}
+		// Another transfer may be registered under the ID in the meantime, so check again
+		select {
+		case <-ended:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// transferEnded returns a channel that is closed once the transfer registered under
+// an ID goes away, and false when there is none
+func transferEnded(transferID string) (<-chan struct{}, bool) {
+	TransfersMutex.Lock()
+	defer TransfersMutex.Unlock()
+	transfer, running := ActiveTransfers[transferID]
+	if !running {
+		return nil, false
+	}
+	if transfer.ended == nil {
+		transfer.ended = make(chan struct{})
+	}
+	return transfer.ended, true
+}
+
+// describeResume is the note shown when a transfer stops before completion
+func describeResume(peerId string, bytesDone int64) string {
+	return fmt.Sprintf("%s transferred, it continues from there once %s is back online", formatSize(bytesDone), peerId)
+}
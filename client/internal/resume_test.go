@@ -0,0 +1,93 @@
+package connection
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPartialWriterCheckpoints(t *testing.T) {
+	store := t.TempDir()
+	file, err := os.Create(partialPath(store, "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	partial := &PartialTransfer{TransferId: "a1b2c3d4", SenderId: "1111", FileName: "big.bin", Size: 2 * checkpointInterval}
+	writer := newPartialWriter(file, partial, store)
+
+	saved := func() int64 {
+		t.Helper()
+		found, exists := findPartial(store, partial.TransferId)
+		if !exists {
+			return -1
+		}
+		return found.BytesReceived
+	}
+
+	if _, err := writer.Write(make([]byte, checkpointInterval-1)); err != nil {
+		t.Fatal(err)
+	}
+	if got := saved(); got != -1 {
+		t.Fatalf("sidecar saved at %d bytes before a checkpoint was due", got)
+	}
+	if _, err := writer.Write([]byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	if got := saved(); got != checkpointInterval {
+		t.Fatalf("sidecar offset = %d, want %d", got, checkpointInterval)
+	}
+	if _, err := writer.Write(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if partial.BytesReceived != checkpointInterval+10 {
+		t.Fatalf("BytesReceived = %d, want %d", partial.BytesReceived, checkpointInterval+10)
+	}
+	// The bytes since the last checkpoint are received again on resume
+	if got := saved(); got != checkpointInterval {
+		t.Fatalf("sidecar offset = %d after unconfirmed bytes, want %d", got, checkpointInterval)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() < saved() {
+		t.Fatalf("sidecar claims %d bytes, the .part file has %d", saved(), info.Size())
+	}
+}
+
+func TestListPartialsTrustsOnlyTheirOwnFile(t *testing.T) {
+	store := t.TempDir()
+	if err := savePartial(store, &PartialTransfer{TransferId: "a1b2c3d4", FileName: "report.pdf", BytesReceived: 100}); err != nil {
+		t.Fatal(err)
+	}
+	sidecars := map[string]PartialTransfer{
+		// Claims a file other than the one it sits next to
+		"notes.txt" + sidecarSuffix: {TransferId: "b1b2c3d4", FileName: "../notes.txt", BytesReceived: 5},
+		"empty.bin" + sidecarSuffix: {FileName: "empty.bin"},
+	}
+	for name, partial := range sidecars {
+		data, err := json.Marshal(partial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(store, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(store, "broken.bin"+sidecarSuffix), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var listed []string
+	for _, partial := range listPartials(store) {
+		listed = append(listed, partial.FileName)
+	}
+	if len(listed) != 1 || listed[0] != "report.pdf" {
+		t.Fatalf("listPartials() = %q, want only report.pdf", listed)
+	}
+	if _, exists := findPartial(store, "b1b2c3d4"); exists {
+		t.Fatal("findPartial() trusted a sidecar for another file")
+	}
+}
@@ -0,0 +1,244 @@
+package connection
+
+import (
+	"ItShare/protocol"
+	"ItShare/utils"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// selected room as confirmed by the server, shown in the prompt
+var (
+	activeRoomId   string
+	activeRoomName string
+	roomMutex      sync.Mutex
+)
+
+func HandleCreateRoom(conn *protocol.Conn, roomName string, memberIds []string) {
+	err := conn.SendCommand(fmt.Sprintf("/createroom %s %s", roomName, strings.Join(memberIds, " ")))
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error creating room:"), err)
+	}
+}
+
+func HandleJoinRoom(conn *protocol.Conn, roomId string) {
+	err := conn.SendCommand(fmt.Sprintf("/joinroom %s", roomId))
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error joining room:"), err)
+	}
+}
+
+// HandleInviteToRoom invites a user to a room, or approves a user who asked to join it
+func HandleInviteToRoom(conn *protocol.Conn, roomId, userId string) {
+	err := conn.SendCommand(fmt.Sprintf("/invite %s %s", roomId, userId))
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error inviting user:"), err)
+	}
+}
+
+func HandleLeaveRoom(conn *protocol.Conn, roomId string) {
+	err := conn.SendCommand(fmt.Sprintf("/leaveroom %s", roomId))
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error leaving room:"), err)
+	}
+}
+
+func HandleSelectRoom(conn *protocol.Conn, roomId string) {
+	err := conn.SendCommand(fmt.Sprintf("/selectroom %s", roomId))
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error selecting room:"), err)
+	}
+}
+
+func HandleListRooms(conn *protocol.Conn) {
+	err := conn.SendCommand("/listrooms")
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error listing rooms:"), err)
+	}
+}
+
+func HandleRoomInfo(conn *protocol.Conn, roomId string) {
+	err := conn.SendCommand(fmt.Sprintf("/roominfo %s", roomId))
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error fetching room info:"), err)
+	}
+}
+
+// setActiveRoom records the room confirmed by the server, empty ID means global chat
+func setActiveRoom(roomId, roomName string) {
+	roomMutex.Lock()
+	defer roomMutex.Unlock()
+	activeRoomId = roomId
+	activeRoomName = roomName
+}
+
+// promptPrefix returns the room indicator shown before the prompt
+func promptPrefix() string {
+	roomMutex.Lock()
+	defer roomMutex.Unlock()
+	if activeRoomId == "" {
+		return ""
+	}
+	return utils.RoomColor(fmt.Sprintf("[Room: %s] ", activeRoomName))
+}
+
+// handleRoomResponse displays the server's answer to a room command
+func handleRoomResponse(message string) {
+	switch {
+	case strings.HasPrefix(message, "/ROOM_CREATED"):
+		args := strings.SplitN(message, " ", 3)
+		if len(args) != 3 {
+			return
+		}
+		fmt.Printf("%s Room %s created (ID: %s)\n",
+			utils.SuccessColor("🏠"),
+			utils.RoomColor(args[2]),
+			utils.CommandColor(args[1]))
+		fmt.Println(utils.InfoColor("   Use"), utils.CommandColor("/selectroom "+args[1]), utils.InfoColor("to chat and share files in it"))
+	case strings.HasPrefix(message, "/ROOM_JOINED"):
+		args := strings.SplitN(message, " ", 3)
+		if len(args) != 3 {
+			return
+		}
+		fmt.Printf("%s Joined room %s (ID: %s)\n",
+			utils.SuccessColor("✅"),
+			utils.RoomColor(args[2]),
+			utils.CommandColor(args[1]))
+	case strings.HasPrefix(message, "/ROOM_JOIN_PENDING"):
+		args := strings.SplitN(message, " ", 3)
+		if len(args) != 3 {
+			return
+		}
+		fmt.Printf("%s Asked the owner of room %s (ID: %s) to let you in\n",
+			utils.InfoColor("⏳"),
+			utils.RoomColor(args[2]),
+			utils.CommandColor(args[1]))
+	case strings.HasPrefix(message, "/ROOM_JOIN_REQUEST"):
+		args := strings.SplitN(message, " ", 5)
+		if len(args) != 5 {
+			return
+		}
+		fmt.Printf("%s %s (ID: %s) asks to join room %s (ID: %s)\n",
+			utils.InfoColor("🚪"),
+			utils.UserColor(args[3]),
+			utils.CommandColor(args[2]),
+			utils.RoomColor(args[4]),
+			utils.CommandColor(args[1]))
+		fmt.Println(utils.InfoColor("   Use"), utils.CommandColor("/invite "+args[1]+" "+args[2]), utils.InfoColor("to let them in"))
+	case strings.HasPrefix(message, "/ROOM_INVITED"):
+		args := strings.SplitN(message, " ", 4)
+		if len(args) != 4 {
+			return
+		}
+		fmt.Printf("%s %s invited you to room %s (ID: %s)\n",
+			utils.SuccessColor("✉️"),
+			utils.UserColor(args[2]),
+			utils.RoomColor(args[3]),
+			utils.CommandColor(args[1]))
+		fmt.Println(utils.InfoColor("   Use"), utils.CommandColor("/joinroom "+args[1]), utils.InfoColor("to join it"))
+	case strings.HasPrefix(message, "/ROOM_INVITE_SENT"):
+		args := strings.SplitN(message, " ", 4)
+		if len(args) != 4 {
+			return
+		}
+		fmt.Printf("%s Invited %s to room %s\n",
+			utils.SuccessColor("✉️"),
+			utils.UserColor(args[3]),
+			utils.CommandColor(args[1]))
+	case strings.HasPrefix(message, "/ROOM_APPROVED"):
+		args := strings.SplitN(message, " ", 4)
+		if len(args) != 4 {
+			return
+		}
+		fmt.Printf("%s Let %s into room %s\n",
+			utils.SuccessColor("✅"),
+			utils.UserColor(args[3]),
+			utils.CommandColor(args[1]))
+	case strings.HasPrefix(message, "/ROOM_LEFT"):
+		args := strings.SplitN(message, " ", 3)
+		if len(args) != 3 {
+			return
+		}
+		roomMutex.Lock()
+		if activeRoomId == args[1] {
+			activeRoomId = ""
+			activeRoomName = ""
+		}
+		roomMutex.Unlock()
+		fmt.Printf("%s Left room %s (ID: %s)\n",
+			utils.WarningColor("👋"),
+			utils.RoomColor(args[2]),
+			utils.CommandColor(args[1]))
+	case strings.HasPrefix(message, "/ROOM_SELECTED"):
+		args := strings.SplitN(message, " ", 3)
+		if len(args) == 2 && args[1] == "global" {
+			setActiveRoom("", "")
+			fmt.Println(utils.SuccessColor("🌐 Chatting globally"))
+			return
+		}
+		if len(args) != 3 {
+			return
+		}
+		setActiveRoom(args[1], args[2])
+		fmt.Printf("%s Active room is now %s (ID: %s)\n",
+			utils.SuccessColor("🎯"),
+			utils.RoomColor(args[2]),
+			utils.CommandColor(args[1]))
+	case strings.HasPrefix(message, "/ROOMS"):
+		fmt.Println(utils.HeaderColor("\n🏠 Rooms:"))
+		fmt.Println(utils.InfoColor("-------------------"))
+		count := 0
+		for _, line := range strings.Split(strings.TrimPrefix(message, "/ROOMS"), "\n") {
+			fields := strings.Split(strings.TrimSpace(line), "|")
+			if len(fields) != 5 {
+				continue
+			}
+			count++
+			marker := ""
+			if fields[3] == "true" {
+				marker = utils.SuccessColor(" [member]")
+			}
+			if fields[4] == "true" {
+				marker += utils.AccentColor(" [active]")
+			}
+			fmt.Printf("%s %s %s%s\n",
+				utils.CommandColor(fmt.Sprintf(" [%s]", fields[0])),
+				utils.RoomColor(fields[1]),
+				utils.InfoColor(fmt.Sprintf("(%s members)", fields[2])),
+				marker)
+		}
+		if count == 0 {
+			fmt.Println(utils.InfoColor(" No rooms yet, create one with /createroom"))
+		}
+		fmt.Println(utils.InfoColor("-------------------"))
+	case strings.HasPrefix(message, "/ROOM_INFO"):
+		lines := strings.Split(strings.TrimPrefix(message, "/ROOM_INFO "), "\n")
+		header := strings.Split(lines[0], "|")
+		if len(header) != 5 {
+			return
+		}
+		fmt.Println(utils.HeaderColor("\n🏠 Room Info:"))
+		fmt.Println(utils.InfoColor("-------------------"))
+		fmt.Printf(" %s %s (ID: %s)\n", utils.InfoColor("Name:"), utils.RoomColor(header[1]), utils.CommandColor(header[0]))
+		fmt.Printf(" %s %s (ID: %s)\n", utils.InfoColor("Owner:"), utils.UserColor(header[3]), utils.CommandColor(header[2]))
+		fmt.Printf(" %s %s\n", utils.InfoColor("Created:"), utils.InfoColor(header[4]))
+		fmt.Println(utils.InfoColor(" Members:"))
+		for _, line := range lines[1:] {
+			fields := strings.Split(strings.TrimSpace(line), "|")
+			if len(fields) != 3 {
+				continue
+			}
+			status := utils.WarningColor("offline")
+			if fields[2] == "true" {
+				status = utils.SuccessColor("online")
+			}
+			fmt.Printf("%s %s %s %s\n",
+				utils.SuccessColor("  •"),
+				utils.UserColor(fields[1]),
+				utils.InfoColor("(ID: "+fields[0]+")"),
+				status)
+		}
+		fmt.Println(utils.InfoColor("-------------------"))
+	}
+}
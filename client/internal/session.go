@@ -0,0 +1,129 @@
+package connection
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Session is what the client remembers about its login on one server
+type Session struct {
+	Token         string `json:"token"`
+	UserId        string `json:"userId"`
+	Username      string `json:"username"`
+	StoreFilePath string `json:"storeFilePath"`
+}
+
+var (
+	currentSession *Session
+	currentServer  string
+	sessionMutex   sync.Mutex
+)
+
+// ConfigDir returns the directory where the client keeps its state, creating it if needed
+func ConfigDir() (string, error) {
+	base, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(base, "itshare")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func sessionsFile() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "sessions.json"), nil
+}
+
+// loadSessions reads every saved session, keyed by server address
+func loadSessions() (map[string]Session, error) {
+	sessions := make(map[string]Session)
+	path, err := sessionsFile()
+	if err != nil {
+		return sessions, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return sessions, nil
+	}
+	if err != nil {
+		return sessions, err
+	}
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return make(map[string]Session), fmt.Errorf("corrupt session file %s: %v", path, err)
+	}
+	return sessions, nil
+}
+
+func storeSessions(sessions map[string]Session) error {
+	path, err := sessionsFile()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(sessions, "", "  ")
+	if err != nil {
+		return err
+	}
+	// The token is a credential, keep it private to the user
+	return os.WriteFile(path, data, 0600)
+}
+
+// LoadSession returns the saved session for a server, if any
+func LoadSession(address string) (*Session, bool) {
+	sessions, err := loadSessions()
+	if err != nil {
+		return nil, false
+	}
+	session, exists := sessions[address]
+	if !exists || session.Token == "" {
+		return nil, false
+	}
+	return &session, true
+}
+
+// SaveSession remembers the session issued by a server
+func SaveSession(address string, session *Session) error {
+	sessions, _ := loadSessions()
+	sessions[address] = *session
+	return storeSessions(sessions)
+}
+
+// ClearSession forgets the session for a server
+func ClearSession(address string) error {
+	sessions, err := loadSessions()
+	if err != nil {
+		return err
+	}
+	delete(sessions, address)
+	return storeSessions(sessions)
+}
+
+// setCurrentSession records the identity in use for this run and the server it belongs to
+func setCurrentSession(address string, session *Session) {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+	currentServer = address
+	currentSession = session
+}
+
+// CurrentSession returns the identity in use for this run
+func CurrentSession() *Session {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+	return currentSession
+}
+
+// CurrentServer returns the address of the server this run is logged in to
+func CurrentServer() string {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+	return currentServer
+}
@@ -0,0 +1,321 @@
+package connection
+
+import (
+	"ItShare/helper"
+	"ItShare/protocol"
+	"ItShare/utils"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A file can be split into byte ranges sent over parallel data connections, which
+// helps when a single TCP stream through the relay is held back by latency. Right
+// after the manifest the sender proposes a number of streams and the receiver
+// answers with the number it takes:
+//
+//	/STREAMS <count>                   (sender, always)
+//	/STREAMS <count>                   (receiver, only when more than one was proposed)
+//
+// Ranges are whole chunks, so every stream verifies the chunks it carries. Stream 0 is
+// the transfer's own data channel, the others attach to the relay with their index.
+
+// Most streams a receiver takes for one file
+const maxIncomingStreams = 8
+
+// How often a parallel receive records its contiguous progress in the sidecar
+const streamCheckpointInterval = 2 * time.Second
+
+// streamCount is how many streams this client proposes for the files it sends
+var streamCount = 1
+
+// SetStreams sets how many parallel data connections outgoing files are split over
+func SetStreams(count int) {
+	streamCount = max(count, 1)
+}
+
+// StreamProgress is the byte range carried by one stream of a parallel transfer
+// and how much of it has been moved so far
+type StreamProgress struct {
+	Start int64
+	End   int64
+	done  atomic.Int64
+}
+
+// Done returns the number of bytes of the range moved so far
+func (s *StreamProgress) Done() int64 {
+	return s.done.Load()
+}
+
+func (s *StreamProgress) add(transfer *Transfer, n int) {
+	s.done.Add(int64(n))
+	atomic.AddInt64(&transfer.BytesComplete, int64(n))
+}
+
+// streamRanges splits the chunks from offset to the end of the file into at most
+// count contiguous ranges. The first range starts at offset, which may fall inside a chunk.
+func streamRanges(manifest *helper.ChunkManifest, offset int64, count int) []*StreamProgress {
+	first := int(offset / manifest.ChunkSize)
+	chunks := manifest.Count() - first
+	count = max(min(count, chunks), 1)
+
+	ranges := make([]*StreamProgress, count)
+	for k := range ranges {
+		start, _ := manifest.ChunkRange(first + k*chunks/count)
+		end, _ := manifest.ChunkRange(first + (k+1)*chunks/count)
+		ranges[k] = &StreamProgress{Start: max(start, offset), End: min(end, manifest.Size)}
+	}
+	return ranges
+}
+
+// proposeStreams offers the receiver to split the rest of the file and returns the
+// ranges it agreed to. A single range means the file goes over the data channel as usual.
+func proposeStreams(conn *protocol.Conn, replies *peerReplies, transferID string, manifest *helper.ChunkManifest, offset int64) ([]*StreamProgress, error) {
+	proposed := len(streamRanges(manifest, offset, streamCount))
+	if err := sendSealedCommand(conn, transferID, fmt.Sprintf("/STREAMS %d", proposed)); err != nil {
+		return nil, err
+	}
+	if proposed == 1 {
+		return streamRanges(manifest, offset, 1), nil
+	}
+
+	for {
+		frame, err := replies.Receive()
+		if err != nil {
+			return nil, err
+		}
+		if frame.Type != protocol.FrameCommand {
+			continue
+		}
+		var agreed int
+		if _, err := fmt.Sscanf(string(frame.Payload), "/STREAMS %d", &agreed); err != nil || agreed < 1 || agreed > proposed {
+			return nil, fmt.Errorf("invalid stream count from the receiver: %s", frame.Payload)
+		}
+		return streamRanges(manifest, offset, agreed), nil
+	}
+}
+
+// agreeStreams answers the sender's proposal with the number of streams this side
+// takes. A direct connection does not go through the relay and stays a single stream.
+func (r *dataReader) agreeStreams(manifest *helper.ChunkManifest, offset int64) ([]*StreamProgress, error) {
+	args, err := r.nextCommand()
+	if err != nil {
+		return nil, err
+	}
+	if args[0] != "/STREAMS" || len(args) != 2 {
+		return nil, fmt.Errorf("expected a stream count, got %s", args[0])
+	}
+	proposed, err := strconv.Atoi(args[1])
+	if err != nil || proposed < 1 {
+		return nil, fmt.Errorf("invalid stream count %q", args[1])
+	}
+	if proposed == 1 {
+		return streamRanges(manifest, offset, 1), nil
+	}
+
+	agreed := min(proposed, maxIncomingStreams)
+	if r.direct || manifest.Count() == 0 {
+		agreed = 1
+	}
+	if err := r.conn.SendCommand(fmt.Sprintf("/STREAMS %d", agreed)); err != nil {
+		return nil, ErrTransferInterrupted
+	}
+	return streamRanges(manifest, offset, agreed), nil
+}
+
+// sendStreams sends every range over its own data connection, the first one over
+// the transfer's channel, and returns the number of bytes sent
+func sendStreams(primary *protocol.Conn, file *os.File, transfer *Transfer, streams []*StreamProgress, bar io.Writer) (int64, error) {
+	return runStreams(transfer.ID, streams, func(k int, stream *StreamProgress) error {
+		conn := primary
+		if k > 0 {
+			var err error
+			if conn, err = openStreamChannel(transfer.ID, "send", k); err != nil {
+				return err
+			}
+			// Closing after the last frame lets the relay finish this stream
+			defer conn.Close()
+		}
+		reader := &streamReader{
+			reader:   throttle(io.NewSectionReader(file, stream.Start, stream.End-stream.Start), transfer.Recipient, transfer.ID),
+			stream:   stream,
+			transfer: transfer,
+		}
+		_, err := io.Copy(newDataWriter(conn, transfer.ID, stream.Start, stream.End), io.TeeReader(reader, bar))
+		return err
+	})
+}
+
+// receiveStreams writes every range at its offset in the file as it arrives on its
+// stream and returns the chunks that failed verification. The sidecar keeps the
+// contiguous part received so far, which is where a resume continues from.
+func receiveStreams(primary *dataReader, file *os.File, partial *PartialTransfer, storeFilePath string, manifest *helper.ChunkManifest, transfer *Transfer, bar io.Writer) ([]int, error) {
+	streams := transfer.Streams
+
+	// Ranges are written out of order, so the file gets its full size up front
+	if err := file.Truncate(partial.Size); err != nil {
+		return nil, err
+	}
+
+	var failedMutex sync.Mutex
+	var failed []int
+
+	// Whole chunks kept from an earlier attempt are checked before new data arrives
+	verifier := manifest.NewVerifier()
+	if _, err := io.Copy(verifier, io.NewSectionReader(file, 0, streams[0].Start/manifest.ChunkSize*manifest.ChunkSize)); err != nil {
+		return nil, err
+	}
+	failed = append(failed, verifier.Failed()...)
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(streamCheckpointInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				checkpointStreams(file, partial, storeFilePath, streams)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	_, err := runStreams(transfer.ID, streams, func(k int, stream *StreamProgress) error {
+		data := primary
+		if k > 0 {
+			conn, err := openStreamChannel(transfer.ID, "receive", k)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			data = newDataReader(conn, transfer.ID)
+		}
+		data.expect(stream.Start, stream.End)
+		bad, err := receiveRange(data, file, manifest, stream, transfer, bar)
+		failedMutex.Lock()
+		failed = append(failed, bad...)
+		failedMutex.Unlock()
+		return err
+	})
+	close(stop)
+	checkpointStreams(file, partial, storeFilePath, streams)
+	return failed, err
+}
+
+// receiveRange writes one range chunk by chunk and verifies each chunk once complete.
+// A first chunk that starts before the range was partly received earlier and is
+// hashed from the file.
+func receiveRange(data io.Reader, file *os.File, manifest *helper.ChunkManifest, stream *StreamProgress, transfer *Transfer, bar io.Writer) ([]int, error) {
+	var failed []int
+	for index := int(stream.Start / manifest.ChunkSize); index < manifest.Count(); index++ {
+		offset, length := manifest.ChunkRange(index)
+		if offset >= stream.End {
+			break
+		}
+		h, err := helper.NewHash(manifest.Algorithm)
+		if err != nil {
+			return failed, err
+		}
+		position := max(offset, stream.Start)
+		if position > offset {
+			if _, err := io.Copy(h, io.NewSectionReader(file, offset, position-offset)); err != nil {
+				return failed, err
+			}
+		}
+
+		writer := &streamWriter{writer: io.NewOffsetWriter(file, position), stream: stream, transfer: transfer}
+		if _, err := io.CopyN(io.MultiWriter(h, writer), io.TeeReader(data, bar), offset+length-position); err != nil {
+			return failed, err
+		}
+		if !manifest.Verify(index, h.Sum(nil)) {
+			failed = append(failed, index)
+		}
+	}
+	return failed, nil
+}
+
+// runStreams runs one function per stream and waits for all of them. The first
+// failure closes every data connection of the transfer, which stops the others.
+// A cancelled transfer stops every stream by itself and is left to close its channels.
+func runStreams(transferID string, streams []*StreamProgress, run func(k int, stream *StreamProgress) error) (int64, error) {
+	var wg sync.WaitGroup
+	errs := make([]error, len(streams))
+	for k, stream := range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if errs[k] = run(k, stream); errs[k] != nil && !errors.Is(errs[k], ErrTransferCancelled) {
+				closeDataChannel(transferID)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var total int64
+	for _, stream := range streams {
+		total += stream.Done()
+	}
+	for _, err := range errs {
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// checkpointStreams records how far the file is received without gaps. Data of later
+// ranges beyond that point is received again if the transfer is resumed.
+func checkpointStreams(file *os.File, partial *PartialTransfer, storeFilePath string, streams []*StreamProgress) {
+	contiguous := streams[len(streams)-1].End
+	for _, stream := range streams {
+		if done := stream.Start + stream.Done(); done < stream.End {
+			contiguous = done
+			break
+		}
+	}
+	if file.Sync() != nil {
+		return
+	}
+	partial.BytesReceived = contiguous
+	if err := savePartial(storeFilePath, partial); err != nil {
+		fmt.Println(utils.ErrorColor("\n❌ Error saving transfer progress:"), err)
+	}
+}
+
+// streamReader reads the range of one sending stream and counts its progress
+type streamReader struct {
+	reader   io.Reader
+	stream   *StreamProgress
+	transfer *Transfer
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	if err := waitWhilePaused(r.transfer); err != nil {
+		return 0, err
+	}
+	n, err := r.reader.Read(p)
+	r.stream.add(r.transfer, n)
+	return n, err
+}
+
+// streamWriter writes the range of one receiving stream and counts its progress
+type streamWriter struct {
+	writer   io.Writer
+	stream   *StreamProgress
+	transfer *Transfer
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if err := waitWhilePaused(w.transfer); err != nil {
+		return 0, err
+	}
+	n, err := w.writer.Write(p)
+	w.stream.add(w.transfer, n)
+	return n, err
+}
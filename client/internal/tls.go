@@ -0,0 +1,163 @@
+package connection
+
+import (
+	"ItShare/helper"
+	"ItShare/protocol"
+	"ItShare/utils"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Servers usually run with a self-signed certificate on a LAN without any CA, so the
+// client trusts a server on first use: the fingerprint seen on the first connection is
+// pinned in known_servers.json and every later connection must present the same one.
+
+// How long connecting to the server may take, TLS handshake included
+const dialTimeout = 10 * time.Second
+
+// tlsMode is whether connections to the server use TLS
+var tlsMode = true
+
+// SetTLSMode turns TLS for connections to the server on or off
+func SetTLSMode(enabled bool) {
+	tlsMode = enabled
+}
+
+// errFingerprintChanged is returned when a server presents a certificate other than the pinned one
+var errFingerprintChanged = errors.New("the server certificate does not match the pinned fingerprint")
+
+var knownServersMutex sync.Mutex
+
+func knownServersFile() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "known_servers.json"), nil
+}
+
+// loadKnownServers reads the pinned fingerprints, keyed by server address
+func loadKnownServers() (map[string]string, error) {
+	known := make(map[string]string)
+	path, err := knownServersFile()
+	if err != nil {
+		return known, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return known, nil
+	}
+	if err != nil {
+		return known, err
+	}
+	if err := json.Unmarshal(data, &known); err != nil {
+		return make(map[string]string), fmt.Errorf("corrupt known servers file %s: %v", path, err)
+	}
+	return known, nil
+}
+
+// pinFingerprint remembers the fingerprint of a server
+func pinFingerprint(address, fingerprint string) error {
+	knownServersMutex.Lock()
+	defer knownServersMutex.Unlock()
+	known, err := loadKnownServers()
+	if err != nil {
+		return err
+	}
+	known[address] = fingerprint
+	path, err := knownServersFile()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(known, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// pinnedFingerprint returns the fingerprint pinned for a server, if any
+func pinnedFingerprint(address string) (string, bool) {
+	knownServersMutex.Lock()
+	defer knownServersMutex.Unlock()
+	known, err := loadKnownServers()
+	if err != nil {
+		return "", false
+	}
+	fingerprint, exists := known[address]
+	return fingerprint, exists
+}
+
+// dialServer connects to the server and checks its certificate against the pinned one.
+// With interactive set, a changed certificate is shown to the user, who may accept it;
+// otherwise the connection is refused.
+func dialServer(address string, interactive bool) (*protocol.Conn, error) {
+	if !tlsMode {
+		conn, err := net.DialTimeout("tcp", address, dialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return protocol.NewConn(conn), nil
+	}
+
+	// The certificate is checked against the pin below instead of a CA
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, "tcp", address, &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	})
+	if err != nil {
+		return nil, err
+	}
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		conn.Close()
+		return nil, fmt.Errorf("the server presented no certificate")
+	}
+	fingerprint := helper.CertFingerprint(certs[0])
+
+	pinned, known := pinnedFingerprint(address)
+	switch {
+	case !known:
+		if err := pinFingerprint(address, fingerprint); err != nil {
+			fmt.Println(utils.WarningColor("⚠ Could not pin the server certificate:"), err)
+		}
+		fmt.Println(utils.InfoColor("🔒 First connection to " + address + ", its certificate is now trusted:"))
+		fmt.Println(utils.InfoColor("   " + fingerprint))
+		fmt.Println(utils.InfoColor("   Compare it with the fingerprint the server printed on startup"))
+	case pinned != fingerprint:
+		if !interactive || !trustChangedCertificate(address, pinned, fingerprint) {
+			conn.Close()
+			return nil, errFingerprintChanged
+		}
+	}
+	return protocol.NewConn(conn), nil
+}
+
+// trustChangedCertificate warns that a server's certificate changed and asks whether
+// to trust the new one from now on
+func trustChangedCertificate(address, pinned, fingerprint string) bool {
+	fmt.Println(utils.ErrorColor("\n⚠⚠⚠  WARNING: THE CERTIFICATE OF " + address + " HAS CHANGED  ⚠⚠⚠"))
+	fmt.Println(utils.ErrorColor("Someone could be intercepting your connection, or the server got a new certificate."))
+	fmt.Println(utils.InfoColor("   Pinned:    " + pinned))
+	fmt.Println(utils.InfoColor("   Presented: " + fingerprint))
+	fmt.Println(utils.WarningColor("Only continue if the server's administrator confirms the new fingerprint."))
+
+	fmt.Println(utils.InfoColor("Type 'trust' to accept the new certificate, anything else to disconnect:"))
+	fmt.Print(utils.CommandColor(">>> "))
+	answer, err := readLine()
+	if err != nil || answer != "trust" {
+		return false
+	}
+	if err := pinFingerprint(address, fingerprint); err != nil {
+		fmt.Println(utils.WarningColor("⚠ Could not pin the server certificate:"), err)
+	}
+	fmt.Println(utils.SuccessColor("🔒 The new certificate of " + address + " is now trusted"))
+	return true
+}
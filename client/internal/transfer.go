@@ -1,12 +1,16 @@
 package connection
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"ItShare/helper"
+	"ItShare/protocol"
 	"ItShare/utils"
 	"io"
-	"net"
 	"os"
-	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -27,6 +31,10 @@ const (
 	Paused
 	Completed
 	Failed
+	Interrupted
+	Cancelled
+	Queued
+	AwaitingAccept
 )
 
 // String representation of TransferStatus
@@ -40,6 +48,14 @@ func (s TransferStatus) String() string {
 		return "Completed"
 	case Failed:
 		return "Failed"
+	case Interrupted:
+		return "Interrupted"
+	case Cancelled:
+		return "Cancelled"
+	case Queued:
+		return "Queued"
+	case AwaitingAccept:
+		return "Waiting for accept"
 	default:
 		return "Unknown"
 	}
@@ -59,33 +75,123 @@ type Transfer struct {
 	Checksum      string
 	StartTime     time.Time
 	File          *os.File
-	Connection    net.Conn
+	Connection    *protocol.Conn
 	ProgressBar   *utils.ProgressBar
 	PauseLock     sync.Mutex
-	IsPaused      bool
+	IsPaused      bool // paused on this side
+	PeerPaused    bool // paused by the other side
+	Streams       []*StreamProgress // set when the file is split over parallel streams
+	stateChanged  *sync.Cond        // wakes waitWhilePaused, guarded by PauseLock
+	ended         chan struct{}     // closed once the transfer is no longer registered, guarded by TransfersMutex
 }
 
+// notifyChanged wakes whatever waits for the transfer's status to change. Callers must
+// hold PauseLock.
+func (t *Transfer) notifyChanged() {
+	if t.stateChanged != nil {
+		t.stateChanged.Broadcast()
+	}
+}
+
+// unregistered closes the transfer's ended channel. Callers must hold TransfersMutex.
+func (t *Transfer) unregistered() {
+	if t.ended != nil {
+		close(t.ended)
+		t.ended = nil
+	}
+}
+
+// ErrTransferInterrupted is returned by a CheckpointedReader once the other side of its transfer is gone
+var ErrTransferInterrupted = errors.New("transfer interrupted")
+
+// ErrTransferCancelled is returned by a CheckpointedReader once either side cancelled its transfer
+var ErrTransferCancelled = errors.New("transfer cancelled")
+
 // ActiveTransfers tracks all ongoing transfers
 var (
-	ActiveTransfers   = make(map[string]*Transfer)
-	TransfersMutex    sync.RWMutex
-	transferIDCounter = 1
+	ActiveTransfers = make(map[string]*Transfer)
+	TransfersMutex  sync.RWMutex
 )
 
 // RegisterTransfer adds a new transfer to the tracking system
 func RegisterTransfer(transfer *Transfer) {
 	TransfersMutex.Lock()
 	defer TransfersMutex.Unlock()
+	if previous, exists := ActiveTransfers[transfer.ID]; exists && previous != transfer {
+		previous.unregistered()
+	}
 	ActiveTransfers[transfer.ID] = transfer
 }
 
 
+// GenerateTransferID returns a short random ID. Data frames are routed by this
+// ID on the server and on the receiver, so it must not collide with IDs
+// chosen by other clients.
 func GenerateTransferID() string {
-	TransfersMutex.Lock()
-	defer TransfersMutex.Unlock()
-	id := strconv.Itoa(transferIDCounter)
-	transferIDCounter++
-	return id
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%08x", time.Now().UnixNano()&0xffffffff)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// awaitTransferReady waits for the server to accept or deny an outgoing transfer.
+// It returns the token of the direct connection offer, if the server passed one on.
+func awaitTransferReady(transferID string, reply chan string, timeout time.Duration) (string, error) {
+	answer, err := awaitReply("transfer:"+transferID, reply, timeout)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(answer, "/TRANSFER_DENIED") {
+		args := strings.SplitN(answer, " ", 3)
+		if len(args) == 3 {
+			return "", fmt.Errorf("%s", args[2])
+		}
+		return "", fmt.Errorf("transfer denied by server")
+	}
+	return readyToken(answer), nil
+}
+
+// emptyField stands in for a metadata field without a value, such as the checksum
+// of a folder whose files each carry their own
+const emptyField = "-"
+
+// hashQueryMutex serializes /HASHES_QUERY requests
+var hashQueryMutex sync.Mutex
+
+// negotiateHash asks the server which checksum algorithms a recipient announced and
+// picks the strongest one both sides support. Older clients announce nothing and get MD5.
+func negotiateHash(conn *protocol.Conn, recipientId string) helper.HashAlgorithm {
+	// Replies are matched by recipient, so sends running side by side ask one at a time
+	hashQueryMutex.Lock()
+	defer hashQueryMutex.Unlock()
+
+	reply := expectReply("hashes:" + recipientId)
+	if err := conn.SendCommand("/HASHES_QUERY " + recipientId); err != nil {
+		cancelReply("hashes:" + recipientId)
+		return helper.MD5
+	}
+	answer, err := awaitReply("hashes:"+recipientId, reply, 5*time.Second)
+	if err != nil {
+		return helper.MD5
+	}
+
+	var announced []helper.HashAlgorithm
+	for _, name := range strings.Fields(answer)[2:] {
+		if algorithm, err := helper.ParseHashAlgorithm(name); err == nil {
+			announced = append(announced, algorithm)
+		}
+	}
+	return helper.NegotiateHash(announced)
+}
+
+// announceHashes tells the server which checksum algorithms this client supports
+func announceHashes(conn *protocol.Conn) error {
+	names := make([]string, len(helper.SupportedHashes))
+	for i, algorithm := range helper.SupportedHashes {
+		names[i] = string(algorithm)
+	}
+	return conn.SendCommand("/HASHES " + strings.Join(names, " "))
 }
 
 // GetTransfer retrieves a transfer by ID
@@ -101,10 +207,13 @@ func GetTransfer(id string) (*Transfer, bool) {
 func RemoveTransfer(id string) {
 	TransfersMutex.Lock()
 	defer TransfersMutex.Unlock()
-	delete(ActiveTransfers, id)
+	if transfer, exists := ActiveTransfers[id]; exists {
+		transfer.unregistered()
+		delete(ActiveTransfers, id)
+	}
 }
 
-// PauseTransfer pauses an active transfer
+// PauseTransfer pauses a transfer on this side and asks the other side to hold it too
 func PauseTransfer(id string) error {
 	transfer, exists := GetTransfer(id)
 	if !exists {
@@ -112,24 +221,25 @@ func PauseTransfer(id string) error {
 	}
 	
 	transfer.PauseLock.Lock()
-	defer transfer.PauseLock.Unlock()
-	
-	if transfer.Status != Active {
+	if transfer.IsPaused || (transfer.Status != Active && transfer.Status != Paused) {
+		transfer.PauseLock.Unlock()
 		return fmt.Errorf("cannot pause transfer with status: %s", transfer.Status)
 	}
 	
 	transfer.Status = Paused
 	transfer.IsPaused = true
+	transfer.notifyChanged()
 	
 	// Update progress bar to show paused status
 	if transfer.ProgressBar != nil {
 		transfer.ProgressBar.SetPaused(true)
 	}
+	transfer.PauseLock.Unlock()
 	
-	return nil
+	return signalPeer(id, "/PAUSE")
 }
 
-// ResumeTransfer resumes a paused transfer
+// ResumeTransfer lifts this side's pause. The transfer stays paused while the other side holds it.
 func ResumeTransfer(id string) error {
 	transfer, exists := GetTransfer(id)
 	if !exists {
@@ -137,21 +247,24 @@ func ResumeTransfer(id string) error {
 	}
 	
 	transfer.PauseLock.Lock()
-	defer transfer.PauseLock.Unlock()
-	
-	if transfer.Status != Paused {
+	if !transfer.IsPaused || transfer.Status != Paused {
+		transfer.PauseLock.Unlock()
 		return fmt.Errorf("cannot resume transfer with status: %s", transfer.Status)
 	}
 	
-	transfer.Status = Active
 	transfer.IsPaused = false
+	if !transfer.PeerPaused {
+		transfer.Status = Active
+	}
+	transfer.notifyChanged()
 	
 	// Update progress bar to show active status
 	if transfer.ProgressBar != nil {
-		transfer.ProgressBar.SetPaused(false)
+		transfer.ProgressBar.SetPaused(transfer.PeerPaused)
 	}
+	transfer.PauseLock.Unlock()
 	
-	return nil
+	return signalPeer(id, "/RESUME")
 }
 
 
@@ -166,6 +279,7 @@ func UpdateTransferStatus(id string, status TransferStatus) {
 	defer transfer.PauseLock.Unlock()
 	
 	transfer.Status = status
+	transfer.notifyChanged()
 }
 
 type CheckpointedReader struct {
@@ -174,7 +288,6 @@ type CheckpointedReader struct {
 	Transfer   *Transfer
 	ChunkSize  int
 	Buffer     []byte
-	PauseCheck func() bool
 }
 
 // NewCheckpointedReader creates a new CheckpointedReader
@@ -184,21 +297,14 @@ func NewCheckpointedReader(reader io.Reader, transfer *Transfer, chunkSize int)
 		Transfer:  transfer,
 		ChunkSize: chunkSize,
 		Buffer:    make([]byte, chunkSize),
-		PauseCheck: func() bool {
-			transfer.PauseLock.Lock()
-			defer transfer.PauseLock.Unlock()
-			return transfer.IsPaused
-		},
 	}
 }
 
-// Read implements io.Reader and supports pausing
+// Read implements io.Reader. It blocks while the transfer is paused on either side,
+// so nothing is produced until it continues.
 func (cr *CheckpointedReader) Read(p []byte) (n int, err error) {
-	// Check if transfer is paused
-	if cr.PauseCheck() {
-		// Sleep a bit and check again to avoid CPU spinning
-		time.Sleep(500 * time.Millisecond)
-		return 0, nil
+	if err := waitWhilePaused(cr.Transfer); err != nil {
+		return 0, err
 	}
 	
 	// Perform actual read
@@ -219,7 +325,6 @@ type CheckpointedWriter struct {
 	Transfer    *Transfer
 	ChunkSize   int
 	Buffer      []byte
-	PauseCheck  func() bool
 }
 
 // NewCheckpointedWriter creates a new CheckpointedWriter
@@ -229,19 +334,14 @@ func NewCheckpointedWriter(writer io.Writer, transfer *Transfer, chunkSize int)
 		Transfer:   transfer,
 		ChunkSize:  chunkSize,
 		Buffer:     make([]byte, chunkSize),
-		PauseCheck: func() bool {
-			transfer.PauseLock.Lock()
-			defer transfer.PauseLock.Unlock()
-			return transfer.IsPaused
-		},
 	}
 }
 
-// Write implements io.Writer and supports pausing
+// Write implements io.Writer. It blocks while the transfer is paused on either side,
+// which stops reading from the data channel as well.
 func (cw *CheckpointedWriter) Write(p []byte) (n int, err error) {
-	if cw.PauseCheck() {
-		time.Sleep(500 * time.Millisecond)
-		return 0, nil
+	if err := waitWhilePaused(cw.Transfer); err != nil {
+		return 0, err
 	}
 	
 	n, err = cw.Writer.Write(p)
@@ -335,7 +435,25 @@ func ListTransfers() []*Transfer {
 // HandleListTransfers handles the /transfers command
 func HandleListTransfers() {
 	transfers := ListTransfers()
-	
+	offers := listOffers()
+
+	if len(offers) > 0 {
+		fmt.Println(utils.HeaderColor("📨 Pending Offers:"))
+		fmt.Println(utils.InfoColor("-----------------------------------"))
+		for _, offer := range offers {
+			fmt.Printf("%s %s %s from %s\n",
+				utils.CommandColor("ID: "+offer.TransferId),
+				utils.InfoColor(offer.Name),
+				utils.InfoColor("("+formatTransferType(offer.Type)+", "+formatSize(offer.Size)+")"),
+				utils.UserColor(offer.SenderId))
+			fmt.Printf("   Received: %s ago | %s or %s\n",
+				formatDuration(time.Since(offer.Received)),
+				utils.CommandColor("/accept "+offer.TransferId),
+				utils.CommandColor("/reject "+offer.TransferId))
+		}
+		fmt.Println(utils.InfoColor("-----------------------------------"))
+	}
+
 	if len(transfers) == 0 {
 		fmt.Println(utils.InfoColor("📡 No active transfers"))
 		return
@@ -362,6 +480,18 @@ func HandleListTransfers() {
 		case Failed:
 			statusColor = utils.ErrorColor
 			statusIcon = "❌ "
+		case Interrupted:
+			statusColor = utils.WarningColor
+			statusIcon = "🔌 "
+		case Cancelled:
+			statusColor = utils.ErrorColor
+			statusIcon = "🚫 "
+		case Queued:
+			statusColor = utils.InfoColor
+			statusIcon = "🕒 "
+		case AwaitingAccept:
+			statusColor = utils.InfoColor
+			statusIcon = "⏳ "
 		}
 		
 		directionIcon := "📤 "
@@ -375,6 +505,28 @@ func HandleListTransfers() {
 			utils.CommandColor("ID: "+transfer.ID),
 			utils.InfoColor(transfer.Name),
 			statusColor(transfer.Status.String()))
+
+		if position, priority, queued := queuePosition(transfer.ID); queued {
+			fmt.Printf("   Type: %s | Position: %d in queue | Priority: %s\n",
+				formatTransferType(transfer.Type),
+				position,
+				priority)
+			fmt.Printf("   To: %s | Queued: %s ago\n",
+				utils.UserColor(transfer.Recipient),
+				formatDuration(time.Since(transfer.StartTime)))
+			fmt.Println(utils.InfoColor("   ---"))
+			continue
+		}
+
+		// Nothing is sent before the recipient accepts, and a folder's size is not known yet
+		if transfer.Status == AwaitingAccept {
+			fmt.Printf("   Type: %s | To: %s | Offered: %s ago\n",
+				formatTransferType(transfer.Type),
+				utils.UserColor(transfer.Recipient),
+				formatDuration(time.Since(transfer.StartTime)))
+			fmt.Println(utils.InfoColor("   ---"))
+			continue
+		}
 		
 		fmt.Printf("   Type: %s | Size: %s | Progress: %.1f%% (%s/%s)\n", 
 			formatTransferType(transfer.Type),
@@ -383,6 +535,28 @@ func HandleListTransfers() {
 			formatSize(transfer.BytesComplete),
 			formatSize(transfer.Size))
 		
+		if len(transfer.Streams) > 1 {
+			for k, stream := range transfer.Streams {
+				length := stream.End - stream.Start
+				streamProgress := 100.0
+				if length > 0 {
+					streamProgress = float64(stream.Done()) / float64(length) * 100
+				}
+				fmt.Printf("   Stream %d: %.1f%% (%s/%s)\n",
+					k+1,
+					streamProgress,
+					formatSize(stream.Done()),
+					formatSize(length))
+			}
+		}
+
+		if by := pausedBy(transfer); by != "" {
+			fmt.Printf("   Paused by: %s\n", utils.WarningColor(by))
+		}
+		if limit := transferLimit(transfer.ID); limit > 0 {
+			fmt.Printf("   Limited to: %s\n", utils.InfoColor(helper.FormatRate(limit)))
+		}
+
 		relationText := "From"
 		if transfer.Direction == "send" {
 			relationText = "To"
@@ -398,6 +572,10 @@ func HandleListTransfers() {
 	fmt.Println(utils.InfoColor("Commands:"))
 	fmt.Printf("  %s - Pause a transfer\n", utils.CommandColor("/pause <transferId>"))
 	fmt.Printf("  %s - Resume a paused transfer\n", utils.CommandColor("/resume <transferId>"))
+	fmt.Printf("  %s - Cancel a transfer on both sides\n", utils.CommandColor("/cancel <transferId>"))
+	fmt.Printf("  %s - Move a queued transfer ahead or back\n", utils.CommandColor("/priority <transferId> high|low"))
+	fmt.Printf("  %s - Limit the bandwidth of an outgoing transfer\n", utils.CommandColor("/limit <transferId> <rate>"))
+	fmt.Printf("  %s - Show your key fingerprint to compare with your peers\n", utils.CommandColor("/fingerprint"))
 	fmt.Println(utils.InfoColor("-----------------------------------"))
 }
 
@@ -409,7 +587,7 @@ func HandlePauseTransfer(transferID string) {
 		return
 	}
 	
-	if transfer.Status != Active {
+	if transfer.IsPaused || (transfer.Status != Active && transfer.Status != Paused) {
 		fmt.Printf("%s Transfer %s is already %s\n", 
 			utils.WarningColor("⚠"),
 			utils.CommandColor(transferID),
@@ -447,6 +625,14 @@ func HandleResumeTransfer(transferID string) {
 		return
 	}
 	
+	if transfer.PeerPaused && !transfer.IsPaused {
+		fmt.Printf("%s Transfer %s was paused by %s, it continues once they resume it\n",
+			utils.WarningColor("⚠"),
+			utils.CommandColor(transferID),
+			utils.UserColor(transfer.Recipient))
+		return
+	}
+
 	if transfer.Status != Paused {
 		fmt.Printf("%s Transfer %s is not paused (current status: %s)\n", 
 			utils.WarningColor("⚠"),
@@ -461,10 +647,13 @@ func HandleResumeTransfer(transferID string) {
 		return
 	}
 	
-	fmt.Printf("%s Transfer %s resumed\n", 
+	fmt.Printf("%s Transfer %s resumed\n",
 		utils.SuccessColor("▶"),
 		utils.CommandColor(transferID))
-	
+	if by := pausedBy(transfer); by != "" {
+		fmt.Printf("  %s\n", utils.WarningColor("Still paused by "+by))
+	}
+
 	fmt.Printf("  %s: %s (%s)\n", 
 		utils.InfoColor("Name"),
 		utils.InfoColor(transfer.Name),
@@ -0,0 +1,65 @@
+package connection
+
+import (
+	"ItShare/protocol"
+	"ItShare/utils"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replies are matched by the name asked for, so lookups go one at a time
+var userQueryMutex sync.Mutex
+
+// lookupUser asks the server for the ID and username of the user a command names, by
+// username or ID, returning empty ones when there is no such user
+func lookupUser(conn *protocol.Conn, nameOrId string) (userId, username string, err error) {
+	userQueryMutex.Lock()
+	defer userQueryMutex.Unlock()
+
+	reply := expectReply("user:" + nameOrId)
+	if err := conn.SendCommand("/USER_QUERY " + nameOrId); err != nil {
+		cancelReply("user:" + nameOrId)
+		return "", "", err
+	}
+	answer, err := awaitReply("user:"+nameOrId, reply, 5*time.Second)
+	if err != nil {
+		return "", "", err
+	}
+	args := strings.Fields(answer)
+	if len(args) < 4 {
+		return "", "", nil
+	}
+	return args[2], args[3], nil
+}
+
+// resolveUser asks the server for the ID of the user a command names, by username or
+// ID, returning an empty ID when there is no such user
+func resolveUser(conn *protocol.Conn, nameOrId string) (string, error) {
+	userId, _, err := lookupUser(conn, nameOrId)
+	return userId, err
+}
+
+// userIdArg resolves the user a command was given to their ID, telling the user when
+// there is no such user
+func userIdArg(conn *protocol.Conn, nameOrId string) (string, bool) {
+	userId, err := resolveUser(conn, nameOrId)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error looking up user "+nameOrId+":"), err)
+		return "", false
+	}
+	if userId == "" {
+		fmt.Println(utils.ErrorColor("❌ No user with the name or ID"), utils.UserColor(nameOrId))
+		return "", false
+	}
+	return userId, true
+}
+
+// isNumeric reports whether text is a number, which usernames cannot be so they are
+// never mistaken for user IDs
+func isNumeric(text string) bool {
+	_, err := strconv.Atoi(text)
+	return err == nil
+}
@@ -0,0 +1,412 @@
+package helper
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A folder archive is a stream of entries that can be written while walking the
+// source tree and extracted while it arrives, so neither side needs a temporary zip.
+//
+//	stream  = magic algLen(1) algorithm entry* end
+//	entry   = kind(1) nameLen(2) name mode(4) size(8) content [digest for files]
+//	end     = 'e'
+//
+// Names are slash separated and relative to the folder. The content of a symlink
+// entry is its target. Every file is followed by its digest under the hash algorithm
+// named in the stream header. Integers are big-endian.
+const folderArchiveMagic = "ISF1"
+
+const (
+	entryDir     = 'd'
+	entryFile    = 'f'
+	entrySymlink = 'l'
+	entryEnd     = 'e'
+)
+
+const entryHeaderSize = 1 + 2 + 4 + 8
+
+// Longest symlink target accepted when extracting
+const maxSymlinkTarget = 4096
+
+type archiveEntry struct {
+	kind   byte
+	name   string
+	mode   os.FileMode
+	size   int64
+	target string
+}
+
+// FolderArchive is the plan for streaming a folder. The tree is walked once up front,
+// so the exact stream size is known before anything is sent.
+type FolderArchive struct {
+	root      string
+	algorithm HashAlgorithm
+	entries   []archiveEntry
+	size      int64
+}
+
+// NewFolderArchive walks a folder and prepares its archive stream, with file
+// checksums made by algorithm
+func NewFolderArchive(folderPath string, algorithm HashAlgorithm) (*FolderArchive, error) {
+	h, err := NewHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	archive := &FolderArchive{
+		root:      folderPath,
+		algorithm: algorithm,
+		size:      int64(len(folderArchiveMagic)+1+len(algorithm)) + 1,
+	}
+
+	err = filepath.Walk(folderPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(folderPath, path)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+
+		entry := archiveEntry{name: filepath.ToSlash(relPath), mode: info.Mode().Perm()}
+		switch {
+		case info.IsDir():
+			entry.kind = entryDir
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			entry.kind = entrySymlink
+			entry.target = target
+			entry.size = int64(len(target))
+		case info.Mode().IsRegular():
+			entry.kind = entryFile
+			entry.size = info.Size()
+		default:
+			// Devices, sockets and pipes are not shared
+			return nil
+		}
+		if len(entry.name) > 0xffff {
+			return fmt.Errorf("path too long: %s", entry.name)
+		}
+
+		archive.entries = append(archive.entries, entry)
+		archive.size += entryHeaderSize + int64(len(entry.name)) + entry.size
+		if entry.kind == entryFile {
+			archive.size += int64(h.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return archive, nil
+}
+
+// Size returns the exact number of bytes WriteTo produces
+func (a *FolderArchive) Size() int64 {
+	return a.size
+}
+
+// Entries returns the number of entries in the archive
+func (a *FolderArchive) Entries() int {
+	return len(a.entries)
+}
+
+// WriteTo streams the archive. It fails when a file no longer has the size it had
+// when the folder was walked, since the receiver relies on the announced sizes.
+func (a *FolderArchive) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriterSize(w, 32*1024)
+	var written int64
+
+	header := append([]byte(folderArchiveMagic), byte(len(a.algorithm)))
+	header = append(header, a.algorithm...)
+	n, err := bw.Write(header)
+	written += int64(n)
+	if err != nil {
+		return written, err
+	}
+
+	for _, entry := range a.entries {
+		header := make([]byte, 0, entryHeaderSize+len(entry.name))
+		header = append(header, entry.kind)
+		header = binary.BigEndian.AppendUint16(header, uint16(len(entry.name)))
+		header = append(header, entry.name...)
+		header = binary.BigEndian.AppendUint32(header, uint32(entry.mode))
+		header = binary.BigEndian.AppendUint64(header, uint64(entry.size))
+		n, err := bw.Write(header)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+
+		switch entry.kind {
+		case entrySymlink:
+			n, err := bw.WriteString(entry.target)
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+		case entryFile:
+			n, err := a.writeFile(bw, entry)
+			written += n
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+
+	if err := bw.WriteByte(entryEnd); err != nil {
+		return written, err
+	}
+	written++
+	return written, bw.Flush()
+}
+
+// writeFile copies one file followed by the digest of what was copied
+func (a *FolderArchive) writeFile(w io.Writer, entry archiveEntry) (int64, error) {
+	file, err := os.Open(filepath.Join(a.root, filepath.FromSlash(entry.name)))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	hash, err := NewHash(a.algorithm)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(io.MultiWriter(w, hash), io.LimitReader(file, entry.size))
+	if err != nil {
+		return n, err
+	}
+	if n != entry.size {
+		return n, fmt.Errorf("%s changed while it was being sent", entry.name)
+	}
+	// Anything beyond the announced size means the file grew
+	if extra, _ := file.Read(make([]byte, 1)); extra > 0 {
+		return n, fmt.Errorf("%s changed while it was being sent", entry.name)
+	}
+
+	m, err := w.Write(hash.Sum(nil))
+	return n + int64(m), err
+}
+
+// ExtractFolderArchive unpacks an archive stream into destPath as it is read. Every
+// file is checked against its own checksum. Entries with absolute paths, entries that
+// would land outside destPath and symlinks pointing outside of it are rejected, as are
+// archives exceeding limits. The first entry rejected is reported as an *EntryError.
+func ExtractFolderArchive(r io.Reader, destPath string, limits ExtractLimits) error {
+	br := bufio.NewReaderSize(r, 32*1024)
+
+	magic := make([]byte, len(folderArchiveMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return err
+	}
+	if string(magic) != folderArchiveMagic {
+		return fmt.Errorf("not a folder archive")
+	}
+	algLen, err := br.ReadByte()
+	if err != nil {
+		return err
+	}
+	name := make([]byte, algLen)
+	if _, err := io.ReadFull(br, name); err != nil {
+		return err
+	}
+	algorithm, err := ParseHashAlgorithm(string(name))
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(destPath, os.ModePerm); err != nil {
+		return err
+	}
+	root, err := filepath.Abs(destPath)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for count := 0; ; count++ {
+		kind, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if kind == entryEnd {
+			return nil
+		}
+		if limits.MaxEntries > 0 && count >= limits.MaxEntries {
+			return fmt.Errorf("archive has more than %d entries", limits.MaxEntries)
+		}
+
+		entry, err := readEntryHeader(br, kind)
+		if err != nil {
+			return err
+		}
+		filePath, err := entryPath(root, filepath.FromSlash(entry.name))
+		if err != nil {
+			return &EntryError{Entry: entry.name, Reason: err.Error()}
+		}
+
+		switch entry.kind {
+		case entryDir:
+			if err := os.MkdirAll(filePath, os.ModePerm); err != nil {
+				return err
+			}
+			continue
+		case entrySymlink:
+			if entry.size > maxSymlinkTarget {
+				return &EntryError{Entry: entry.name, Reason: "symlink target too long"}
+			}
+		}
+
+		if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+			return err
+		}
+		// An earlier symlink entry must not redirect later entries outside the root
+		if err := checkInside(root, filepath.Dir(filePath)); err != nil {
+			return &EntryError{Entry: entry.name, Reason: err.Error()}
+		}
+
+		if entry.kind == entrySymlink {
+			target := make([]byte, entry.size)
+			if _, err := io.ReadFull(br, target); err != nil {
+				return err
+			}
+			if err := createSymlink(root, filePath, string(target)); err != nil {
+				return &EntryError{Entry: entry.name, Reason: err.Error()}
+			}
+			continue
+		}
+
+		total += entry.size
+		if limits.MaxTotalSize > 0 && total > limits.MaxTotalSize {
+			return &EntryError{Entry: entry.name, Reason: fmt.Sprintf("archive expands beyond %d bytes", limits.MaxTotalSize)}
+		}
+		if err := extractArchiveFile(br, filePath, entry, algorithm); err != nil {
+			if errors.Is(err, errChecksumMismatch) {
+				return &EntryError{Entry: entry.name, Reason: err.Error()}
+			}
+			return err
+		}
+	}
+}
+
+var errChecksumMismatch = errors.New("checksum mismatch, the file was corrupted in transit")
+
+func readEntryHeader(r io.Reader, kind byte) (archiveEntry, error) {
+	if kind != entryDir && kind != entryFile && kind != entrySymlink {
+		return archiveEntry{}, fmt.Errorf("invalid archive entry type %q", kind)
+	}
+	var nameLen uint16
+	if err := binary.Read(r, binary.BigEndian, &nameLen); err != nil {
+		return archiveEntry{}, err
+	}
+	name := make([]byte, nameLen)
+	if _, err := io.ReadFull(r, name); err != nil {
+		return archiveEntry{}, err
+	}
+	var fields struct {
+		Mode uint32
+		Size int64
+	}
+	if err := binary.Read(r, binary.BigEndian, &fields); err != nil {
+		return archiveEntry{}, err
+	}
+	if fields.Size < 0 {
+		return archiveEntry{}, fmt.Errorf("invalid size for archive entry %q", name)
+	}
+	return archiveEntry{
+		kind: kind,
+		name: string(name),
+		mode: os.FileMode(fields.Mode).Perm(),
+		size: fields.Size,
+	}, nil
+}
+
+// extractArchiveFile writes one file entry and verifies the checksum that follows it.
+// A corrupted file is removed.
+func extractArchiveFile(r io.Reader, filePath string, entry archiveEntry, algorithm HashAlgorithm) error {
+	hash, err := NewHash(algorithm)
+	if err != nil {
+		return err
+	}
+
+	// Never write through a symlink left at this path by an earlier entry
+	if info, err := os.Lstat(filePath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		os.Remove(filePath)
+	}
+
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, entry.mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(io.MultiWriter(file, hash), r, entry.size)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	expected := make([]byte, hash.Size())
+	if _, err := io.ReadFull(r, expected); err != nil {
+		return err
+	}
+	if !bytes.Equal(expected, hash.Sum(nil)) {
+		os.Remove(filePath)
+		return errChecksumMismatch
+	}
+	return nil
+}
+
+// createSymlink recreates a symlink whose target stays inside root. The target is
+// cleaned first, so ".." can only lead it and is never applied after following another
+// symlink, and the part of it that exists already is resolved before it is checked.
+func createSymlink(root, filePath, link string) error {
+	if filepath.IsAbs(link) || strings.HasPrefix(link, "/") {
+		return fmt.Errorf("symlink to absolute path %s", link)
+	}
+	link = filepath.Clean(link)
+	dir, err := filepath.EvalSymlinks(filepath.Dir(filePath))
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(dir, link)
+	if !isInside(root, target) {
+		return fmt.Errorf("symlink points outside the destination")
+	}
+	if err := checkInside(root, existingPrefix(target)); err != nil {
+		return fmt.Errorf("symlink points outside the destination through another symlink")
+	}
+	os.Remove(filePath)
+	return os.Symlink(link, filePath)
+}
+
+// existingPrefix returns the longest leading part of path that exists
+func existingPrefix(path string) string {
+	for {
+		if _, err := os.Lstat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
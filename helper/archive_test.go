@@ -0,0 +1,281 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testEntry is one entry of an archive stream built by archiveStream
+type testEntry struct {
+	kind    byte
+	name    string
+	content string // file contents or symlink target
+	size    int64  // announced size, the length of content when zero
+	digest  []byte // digest sent after a file, the real one when nil
+}
+
+// archiveStream builds a folder archive stream by hand, so entries a real sender would
+// never produce can be fed to ExtractFolderArchive
+func archiveStream(t *testing.T, entries ...testEntry) []byte {
+	t.Helper()
+	stream := append([]byte(folderArchiveMagic), byte(len(SHA256)))
+	stream = append(stream, SHA256...)
+	for _, entry := range entries {
+		size := entry.size
+		if size == 0 {
+			size = int64(len(entry.content))
+		}
+		stream = append(stream, entry.kind)
+		stream = binary.BigEndian.AppendUint16(stream, uint16(len(entry.name)))
+		stream = append(stream, entry.name...)
+		stream = binary.BigEndian.AppendUint32(stream, 0644)
+		stream = binary.BigEndian.AppendUint64(stream, uint64(size))
+		stream = append(stream, entry.content...)
+		if entry.kind == entryFile {
+			digest := entry.digest
+			if digest == nil {
+				hash, _ := NewHash(SHA256)
+				hash.Write([]byte(entry.content))
+				digest = hash.Sum(nil)
+			}
+			stream = append(stream, digest...)
+		}
+	}
+	return append(stream, entryEnd)
+}
+
+func TestExtractFolderArchive(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []testEntry
+		limits  ExtractLimits
+		rejects string // entry the extraction stops at, none when empty
+		wantErr bool
+	}{
+		{
+			name: "folder",
+			entries: []testEntry{
+				{kind: entryDir, name: "docs"},
+				{kind: entryFile, name: "docs/a.txt", content: "hello"},
+				{kind: entrySymlink, name: "docs/link", content: "a.txt"},
+				{kind: entrySymlink, name: "up", content: "docs/../docs/a.txt"},
+			},
+		},
+		{
+			name:    "parent directory",
+			entries: []testEntry{{kind: entryFile, name: "../escaped.txt", content: "x"}},
+			rejects: "../escaped.txt",
+		},
+		{
+			name:    "parent directory further in",
+			entries: []testEntry{{kind: entryFile, name: "docs/../../escaped.txt", content: "x"}},
+			rejects: "docs/../../escaped.txt",
+		},
+		{
+			name:    "absolute path",
+			entries: []testEntry{{kind: entryFile, name: "/tmp/escaped.txt", content: "x"}},
+			rejects: "/tmp/escaped.txt",
+		},
+		{
+			name:    "symlink to an absolute path",
+			entries: []testEntry{{kind: entrySymlink, name: "link", content: "/etc/passwd"}},
+			rejects: "link",
+		},
+		{
+			name:    "symlink out of the folder",
+			entries: []testEntry{{kind: entrySymlink, name: "link", content: "../outside"}},
+			rejects: "link",
+		},
+		{
+			name: "symlink out through another symlink",
+			entries: []testEntry{
+				{kind: entrySymlink, name: "here", content: "."},
+				{kind: entrySymlink, name: "here/link", content: ".."},
+			},
+			rejects: "here/link",
+		},
+		{
+			name: "symlink chain out of the folder",
+			entries: []testEntry{
+				{kind: entryDir, name: "a/b"},
+				{kind: entrySymlink, name: "deep", content: "a/b"},
+				{kind: entrySymlink, name: "deep/link", content: "../../.."},
+			},
+			rejects: "deep/link",
+		},
+		{
+			name:    "symlink target too long",
+			entries: []testEntry{{kind: entrySymlink, name: "link", content: strings.Repeat("a", maxSymlinkTarget+1)}},
+			rejects: "link",
+		},
+		{
+			name: "too large",
+			entries: []testEntry{
+				{kind: entryFile, name: "a.bin", content: strings.Repeat("a", 60)},
+				{kind: entryFile, name: "b.bin", content: strings.Repeat("b", 60)},
+			},
+			limits:  ExtractLimits{MaxTotalSize: 100},
+			rejects: "b.bin",
+		},
+		{
+			name:    "size announced too large",
+			entries: []testEntry{{kind: entryFile, name: "a.bin", content: "a", size: 1 << 40}},
+			limits:  ExtractLimits{MaxTotalSize: 100},
+			rejects: "a.bin",
+		},
+		{
+			name:    "larger than announced",
+			entries: []testEntry{{kind: entryFile, name: "a.bin", content: strings.Repeat("a", 60)}},
+			limits:  ExtractLimitsFor(50),
+			rejects: "a.bin",
+		},
+		{
+			name: "too many entries",
+			entries: []testEntry{
+				{kind: entryDir, name: "a"},
+				{kind: entryDir, name: "b"},
+				{kind: entryDir, name: "c"},
+			},
+			limits:  ExtractLimits{MaxEntries: 2},
+			wantErr: true,
+		},
+		{
+			name:    "corrupted file",
+			entries: []testEntry{{kind: entryFile, name: "a.txt", content: "hello", digest: make([]byte, 32)}},
+			rejects: "a.txt",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			dest := filepath.Join(parent, "dest")
+			err := ExtractFolderArchive(bytes.NewReader(archiveStream(t, tt.entries...)), dest, tt.limits)
+
+			var entryErr *EntryError
+			switch {
+			case tt.rejects != "":
+				if !errors.As(err, &entryErr) || entryErr.Entry != tt.rejects {
+					t.Fatalf("ExtractFolderArchive() error = %v, want entry %q rejected", err, tt.rejects)
+				}
+			case tt.wantErr:
+				if err == nil {
+					t.Fatal("ExtractFolderArchive() succeeded")
+				}
+			case err != nil:
+				t.Fatalf("ExtractFolderArchive() error = %v", err)
+			}
+
+			// Nothing may land next to the destination
+			siblings, _ := os.ReadDir(parent)
+			for _, sibling := range siblings {
+				if sibling.Name() != "dest" {
+					t.Errorf("extraction created %s outside the destination", sibling.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestExtractFolderArchiveContents(t *testing.T) {
+	dest := t.TempDir()
+	stream := archiveStream(t,
+		testEntry{kind: entryFile, name: "docs/a.txt", content: "hello"},
+		testEntry{kind: entrySymlink, name: "docs/link", content: "a.txt"},
+	)
+	if err := ExtractFolderArchive(bytes.NewReader(stream), dest, ExtractLimitsFor(1<<20)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dest, "docs", "link"))
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("reading through the extracted link = %q, %v", data, err)
+	}
+}
+
+func TestExtractFolderArchiveExistingSymlink(t *testing.T) {
+	parent := t.TempDir()
+	dest := filepath.Join(parent, "dest")
+	outside := filepath.Join(parent, "outside")
+	for _, dir := range []string{dest, outside} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A link left in the destination by someone else must not be followed out of it
+	if err := os.Symlink(outside, filepath.Join(dest, "elsewhere")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		entry testEntry
+	}{
+		{"file", testEntry{kind: entryFile, name: "elsewhere/file.txt", content: "x"}},
+		{"symlink", testEntry{kind: entrySymlink, name: "link", content: "elsewhere/file.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ExtractFolderArchive(bytes.NewReader(archiveStream(t, tt.entry)), dest, ExtractLimitsFor(1<<20))
+			var entryErr *EntryError
+			if !errors.As(err, &entryErr) {
+				t.Fatalf("ExtractFolderArchive() error = %v, want %s rejected", err, tt.entry.name)
+			}
+			if files, _ := os.ReadDir(outside); len(files) != 0 {
+				t.Fatalf("extraction wrote %s outside the destination", files[0].Name())
+			}
+		})
+	}
+}
+
+func TestFolderArchiveRoundTrip(t *testing.T) {
+	source := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(source, "sub", "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"top.txt":      "top",
+		"sub/deep.txt": strings.Repeat("deep", 10000),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(source, filepath.FromSlash(name)), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("deep.txt", filepath.Join(source, "sub", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := NewFolderArchive(source, SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stream bytes.Buffer
+	n, err := archive.WriteTo(&stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != archive.Size() {
+		t.Fatalf("WriteTo() wrote %d bytes, Size() announced %d", n, archive.Size())
+	}
+
+	dest := t.TempDir()
+	if err := ExtractFolderArchive(&stream, dest, ExtractLimitsFor(1<<20)); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		data, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+		if err != nil || string(data) != content {
+			t.Errorf("%s was not extracted as sent: %v", name, err)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(dest, "sub", "link")); err != nil || target != "deep.txt" {
+		t.Errorf("sub/link = %q, %v, want a link to deep.txt", target, err)
+	}
+	if info, err := os.Stat(filepath.Join(dest, "sub", "empty")); err != nil || !info.IsDir() {
+		t.Errorf("empty folder was not extracted: %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package helper
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// HashAlgorithm identifies a checksum algorithm in transfer metadata
+type HashAlgorithm string
+
+const (
+	MD5    HashAlgorithm = "md5"
+	SHA1   HashAlgorithm = "sha1"
+	SHA256 HashAlgorithm = "sha256"
+	SHA512 HashAlgorithm = "sha512"
+)
+
+// SupportedHashes lists the algorithms this build understands, strongest first.
+// MD5 is only kept to talk to older clients, which know nothing else.
+var SupportedHashes = []HashAlgorithm{SHA512, SHA256, SHA1, MD5}
+
+// NewHash returns a fresh hash for an algorithm
+func NewHash(algorithm HashAlgorithm) (hash.Hash, error) {
+	switch algorithm {
+	case MD5:
+		return md5.New(), nil
+	case SHA1:
+		return sha1.New(), nil
+	case SHA256:
+		return sha256.New(), nil
+	case SHA512:
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm %q", algorithm)
+	}
+}
+
+// ParseHashAlgorithm checks that name is a supported algorithm
+func ParseHashAlgorithm(name string) (HashAlgorithm, error) {
+	algorithm := HashAlgorithm(strings.ToLower(name))
+	if _, err := NewHash(algorithm); err != nil {
+		return "", err
+	}
+	return algorithm, nil
+}
+
+// NegotiateHash picks the strongest algorithm both sides support. A peer that
+// announced nothing is an older client and gets MD5.
+func NegotiateHash(peer []HashAlgorithm) HashAlgorithm {
+	for _, ours := range SupportedHashes {
+		for _, theirs := range peer {
+			if ours == theirs {
+				return ours
+			}
+		}
+	}
+	return MD5
+}
+
+// Checksum is a digest together with the algorithm that produced it. Its text
+// form is "<algorithm>:<hex>", as carried in transfer metadata.
+type Checksum struct {
+	Algorithm HashAlgorithm
+	Value     string
+}
+
+func (c Checksum) String() string {
+	return string(c.Algorithm) + ":" + c.Value
+}
+
+// ParseChecksum reads the text form of a checksum. A bare hex digest comes from
+// an older client and is taken as MD5.
+func ParseChecksum(text string) (Checksum, error) {
+	name, value, found := strings.Cut(text, ":")
+	if !found {
+		name, value = string(MD5), text
+	}
+	algorithm, err := ParseHashAlgorithm(name)
+	if err != nil {
+		return Checksum{}, err
+	}
+	digest, err := hex.DecodeString(value)
+	if err != nil {
+		return Checksum{}, fmt.Errorf("invalid %s checksum: %v", algorithm, err)
+	}
+	h, _ := NewHash(algorithm)
+	if len(digest) != h.Size() {
+		return Checksum{}, fmt.Errorf("invalid %s checksum length", algorithm)
+	}
+	return Checksum{Algorithm: algorithm, Value: hex.EncodeToString(digest)}, nil
+}
+
+// CalculateFileChecksum hashes a file with the given algorithm
+func CalculateFileChecksum(filePath string, algorithm HashAlgorithm) (Checksum, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return Checksum{}, err
+	}
+	defer file.Close()
+
+	h, err := NewHash(algorithm)
+	if err != nil {
+		return Checksum{}, err
+	}
+	if _, err := io.Copy(h, file); err != nil {
+		return Checksum{}, err
+	}
+	return Checksum{Algorithm: algorithm, Value: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// CalculateDataChecksum hashes everything a reader yields without consuming it.
+// Returns the checksum and a new reader that can be used normally.
+func CalculateDataChecksum(reader io.Reader, algorithm HashAlgorithm) (Checksum, io.Reader, error) {
+	h, err := NewHash(algorithm)
+	if err != nil {
+		return Checksum{}, nil, err
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return Checksum{}, nil, err
+	}
+
+	h.Write(data)
+	checksum := Checksum{Algorithm: algorithm, Value: hex.EncodeToString(h.Sum(nil))}
+
+	// Return a new reader with the same data
+	return checksum, bytes.NewReader(data), nil
+}
+
+// VerifyChecksum checks if two checksums match. Digests made with different algorithms never do.
+func VerifyChecksum(original, received Checksum) bool {
+	return original.Algorithm == received.Algorithm && strings.EqualFold(original.Value, received.Value)
+}
@@ -0,0 +1,19 @@
+package helper
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"strings"
+)
+
+// CertFingerprint returns the SHA-256 fingerprint of a certificate in the colon
+// separated form people compare by eye, for example "SHA256:AB:CD:..."
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	pairs := make([]string, len(sum))
+	for i, b := range sum {
+		pairs[i] = strings.ToUpper(hex.EncodeToString([]byte{b}))
+	}
+	return "SHA256:" + strings.Join(pairs, ":")
+}
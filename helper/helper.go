@@ -1,58 +1,17 @@
 package helper
 
 import (
-	"archive/zip"
-	"bytes"
-	"crypto/md5"
+	crand "crypto/rand"
 	"path/filepath"
 	"encoding/hex"
 	"fmt"
-	"io"
 	"math/rand"
 	"net"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 )
 
-//computes an MD5 hash of a file
-func CalculateFileChecksum(filePath string) (string, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
-
-	hash := md5.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return "", err
-	}
-
-	return hex.EncodeToString(hash.Sum(nil)), nil
-}
-
-// computes an MD5 hash from a reader without consuming it
-// Returns the checksum and a new reader that can be used normally
-func CalculateDataChecksum(reader io.Reader) (string, io.Reader, error) {
-	hash := md5.New()
-	data, err := io.ReadAll(reader)
-	if err != nil {
-		return "", nil, err
-	}
-	
-	hash.Write(data)
-	checksum := hex.EncodeToString(hash.Sum(nil))
-	
-	// Return a new reader with the same data
-	return checksum, bytes.NewReader(data), nil
-}
-
-// checks if two checksums match
-func VerifyChecksum(original, received string) bool {
-	return original == received
-}
-
 func CheckServerAvailability(address string) (bool, string) {
 	conn, err := net.DialTimeout("tcp", address, 3*time.Second)
 	if err != nil {
@@ -86,107 +45,76 @@ func GenerateUserId() string {
 	return strconv.Itoa(rand.Intn(10000000))
 }
 
-// CreateZipFromFolder creates a zip archive from a folder
-func CreateZipFromFolder(folderPath string, zipPath string) error {
-	zipFile, err := os.Create(zipPath)
-	if err != nil {
-		return fmt.Errorf("failed to create zip file: %v", err)
+// GenerateSessionToken returns a random token that lets a client resume its identity
+func GenerateSessionToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := crand.Read(token); err != nil {
+		return "", err
 	}
-	defer zipFile.Close()
-
-	archive := zip.NewWriter(zipFile)
-	defer archive.Close()
-
-	return filepath.Walk(folderPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		// Get the relative path for the zip
-		relPath, err := filepath.Rel(folderPath, path)
-		if err != nil {
-			return err
-		}
-
-		// Skip if it's the root folder
-		if relPath == "." {
-			return nil
-		}
+	return hex.EncodeToString(token), nil
+}
 
-		// Create zip header
-		header, err := zip.FileInfoHeader(info)
-		if err != nil {
-			return err
-		}
+// ExtractLimits bounds what ExtractFolderArchive is willing to unpack, so a small
+// archive cannot expand into something that fills the disk
+type ExtractLimits struct {
+	MaxEntries   int
+	MaxTotalSize int64
+}
 
-		// Set relative path as name
-		header.Name = relPath
+// Most entries an archive may have, enough for real folders
+const maxArchiveEntries = 100000
 
-		// Set compression
-		header.Method = zip.Deflate
+// ExtractLimitsFor returns the limits for an archive announced to be size bytes long.
+// Its files cannot add up to more than the stream carrying them, so an archive is never
+// unpacked beyond what the receiver agreed to take.
+func ExtractLimitsFor(size int64) ExtractLimits {
+	return ExtractLimits{MaxEntries: maxArchiveEntries, MaxTotalSize: size}
+}
 
-		writer, err := archive.CreateHeader(header)
-		if err != nil {
-			return err
-		}
+// EntryError reports the archive entry that made extraction stop
+type EntryError struct {
+	Entry  string
+	Reason string
+}
 
-		// If it's a directory, just return
-		if info.IsDir() {
-			return nil
-		}
+func (e *EntryError) Error() string {
+	return fmt.Sprintf("rejected archive entry %q: %s", e.Entry, e.Reason)
+}
 
-		// Copy file contents
-		file, err := os.Open(path)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
+// ValidateName checks that a file or folder name chosen by a peer is a single path
+// element, so joining it onto a folder cannot leave that folder
+func ValidateName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") || filepath.Base(name) != name || filepath.VolumeName(name) != "" {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	return nil
+}
 
-		_, err = io.Copy(writer, file)
-		return err
-	})
+// entryPath maps an entry name onto root, refusing names that would end up elsewhere
+func entryPath(root, name string) (string, error) {
+	if name == "" || filepath.IsAbs(name) || strings.HasPrefix(name, "/") || strings.HasPrefix(name, "\\") || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("absolute path")
+	}
+	filePath := filepath.Join(root, name)
+	if !isInside(root, filePath) {
+		return "", fmt.Errorf("path escapes the destination")
+	}
+	return filePath, nil
 }
 
-// ExtractZip extracts a zip archive to the specified destination
-func ExtractZip(zipPath string, destPath string) error {
-	archive, err := zip.OpenReader(zipPath)
+// checkInside resolves symlinks in an existing path and verifies it stays under root
+func checkInside(root, path string) error {
+	resolved, err := filepath.EvalSymlinks(path)
 	if err != nil {
-		return fmt.Errorf("failed to open zip file: %v", err)
+		return err
 	}
-	defer archive.Close()
-
-	for _, file := range archive.File {
-		filePath := filepath.Join(destPath, file.Name)
-
-		if file.FileInfo().IsDir() {
-			os.MkdirAll(filePath, os.ModePerm)
-			continue
-		}
-
-		// Ensure parent directory exists
-		if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
-			return err
-		}
-
-		dstFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, file.Mode())
-		if err != nil {
-			return err
-		}
-
-		srcFile, err := file.Open()
-		if err != nil {
-			dstFile.Close()
-			return err
-		}
-
-		_, err = io.Copy(dstFile, srcFile)
-		srcFile.Close()
-		dstFile.Close()
-
-		if err != nil {
-			return err
-		}
+	if !isInside(root, resolved) {
+		return fmt.Errorf("path escapes the destination through a symlink")
 	}
-
 	return nil
 }
+
+func isInside(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
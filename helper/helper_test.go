@@ -0,0 +1,30 @@
+package helper
+
+import "testing"
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"report.pdf", true},
+		{"my folder", true},
+		{".hidden", true},
+		{"..too", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../report.pdf", false},
+		{"docs/report.pdf", false},
+		{"/etc/passwd", false},
+		{`..\report.pdf`, false},
+		{`C:\report.pdf`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateName(tt.name); (err == nil) != tt.valid {
+				t.Fatalf("ValidateName(%q) error = %v, want valid %v", tt.name, err, tt.valid)
+			}
+		})
+	}
+}
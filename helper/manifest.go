@@ -0,0 +1,207 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// DefaultChunkSize is the size of the pieces a file is verified and retransmitted in
+const DefaultChunkSize = 4 << 20
+
+// ChunkManifest lists the digest of every fixed-size chunk of a file. The last
+// chunk is shorter when the size is not a multiple of the chunk size.
+type ChunkManifest struct {
+	Algorithm HashAlgorithm
+	ChunkSize int64
+	Size      int64
+	Chunks    [][]byte
+}
+
+// BuildManifest hashes a file chunk by chunk, and as a whole in the same pass
+func BuildManifest(filePath string, algorithm HashAlgorithm, chunkSize int64) (*ChunkManifest, Checksum, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, Checksum{}, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, Checksum{}, err
+	}
+	builder, err := NewManifestBuilder(algorithm, chunkSize, info.Size())
+	if err != nil {
+		return nil, Checksum{}, err
+	}
+	n, err := io.Copy(builder, file)
+	if err != nil {
+		return nil, Checksum{}, err
+	}
+	if n != info.Size() {
+		return nil, Checksum{}, fmt.Errorf("%s changed while it was being hashed", filePath)
+	}
+	manifest, checksum := builder.Manifest()
+	return manifest, checksum, nil
+}
+
+// ManifestBuilder hashes a file of known size chunk by chunk, and as a whole, while
+// its bytes are written to it in order. This lets a file be hashed as it is streamed.
+type ManifestBuilder struct {
+	manifest *ChunkManifest
+	whole    hash.Hash
+	chunk    hash.Hash
+	filled   int64
+	onChunk  func(index int)
+}
+
+// NewManifestBuilder prepares to hash size bytes in chunks of chunkSize
+func NewManifestBuilder(algorithm HashAlgorithm, chunkSize, size int64) (*ManifestBuilder, error) {
+	whole, err := NewHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if chunkSize <= 0 || size < 0 {
+		return nil, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	chunk, _ := NewHash(algorithm)
+	return &ManifestBuilder{
+		manifest: &ChunkManifest{Algorithm: algorithm, ChunkSize: chunkSize, Size: size},
+		whole:    whole,
+		chunk:    chunk,
+	}, nil
+}
+
+// Write implements io.Writer. A chunk's digest is taken as soon as its last byte arrives.
+func (b *ManifestBuilder) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		index := len(b.manifest.Chunks)
+		if int64(index)*b.manifest.ChunkSize >= b.manifest.Size {
+			return written, fmt.Errorf("more data than the %d bytes announced", b.manifest.Size)
+		}
+		_, length := b.manifest.ChunkRange(index)
+		take := min(length-b.filled, int64(len(p)))
+		b.chunk.Write(p[:take])
+		b.whole.Write(p[:take])
+		b.filled += take
+		written += int(take)
+		p = p[take:]
+
+		if b.filled == length {
+			b.manifest.Chunks = append(b.manifest.Chunks, b.chunk.Sum(nil))
+			b.chunk.Reset()
+			b.filled = 0
+			if b.onChunk != nil {
+				b.onChunk(index)
+			}
+		}
+	}
+	return written, nil
+}
+
+// Manifest returns the digests of the chunks and of the whole file written so far
+func (b *ManifestBuilder) Manifest() (*ChunkManifest, Checksum) {
+	return b.manifest, Checksum{Algorithm: b.manifest.Algorithm, Value: hex.EncodeToString(b.whole.Sum(nil))}
+}
+
+// NewChunkManifest checks that the announced digests describe a file of size bytes
+func NewChunkManifest(algorithm HashAlgorithm, chunkSize, size int64, chunks [][]byte) (*ChunkManifest, error) {
+	h, err := NewHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if chunkSize <= 0 || size < 0 {
+		return nil, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	if count := (size + chunkSize - 1) / chunkSize; int64(len(chunks)) != count {
+		return nil, fmt.Errorf("manifest lists %d chunks, a file of %d bytes has %d", len(chunks), size, count)
+	}
+	for i, digest := range chunks {
+		if len(digest) != h.Size() {
+			return nil, fmt.Errorf("invalid digest for chunk %d", i)
+		}
+	}
+	return &ChunkManifest{Algorithm: algorithm, ChunkSize: chunkSize, Size: size, Chunks: chunks}, nil
+}
+
+// Count returns the number of chunks
+func (m *ChunkManifest) Count() int {
+	return len(m.Chunks)
+}
+
+// ChunkRange returns the offset and length of a chunk
+func (m *ChunkManifest) ChunkRange(index int) (int64, int64) {
+	offset := int64(index) * m.ChunkSize
+	length := m.ChunkSize
+	if offset+length > m.Size {
+		length = m.Size - offset
+	}
+	return offset, length
+}
+
+// Verify reports whether digest is the one listed for a chunk
+func (m *ChunkManifest) Verify(index int, digest []byte) bool {
+	return index >= 0 && index < len(m.Chunks) && bytes.Equal(m.Chunks[index], digest)
+}
+
+// ChunkVerifier checks the chunks of a file while its bytes are written to it in
+// order, starting at the beginning of the file. Each chunk is checked as soon as it
+// is complete when the expected digests are known up front, or by Expect once they
+// arrive after the data.
+type ChunkVerifier struct {
+	expected *ChunkManifest
+	builder  *ManifestBuilder
+	failed   []int
+}
+
+// NewVerifier returns a verifier for the chunks of the manifest
+func (m *ChunkManifest) NewVerifier() *ChunkVerifier {
+	builder, _ := NewManifestBuilder(m.Algorithm, m.ChunkSize, m.Size)
+	v := &ChunkVerifier{expected: m, builder: builder}
+	builder.onChunk = v.check
+	return v
+}
+
+// Write implements io.Writer
+func (v *ChunkVerifier) Write(p []byte) (int, error) {
+	return v.builder.Write(p)
+}
+
+func (v *ChunkVerifier) check(index int) {
+	if index < len(v.expected.Chunks) && !v.expected.Verify(index, v.builder.manifest.Chunks[index]) {
+		v.failed = append(v.failed, index)
+	}
+}
+
+// Expect supplies digests that were sent after the data and checks the chunks received so far
+func (v *ChunkVerifier) Expect(m *ChunkManifest) error {
+	if m.Algorithm != v.expected.Algorithm || m.ChunkSize != v.expected.ChunkSize || m.Size != v.expected.Size {
+		return fmt.Errorf("chunk digests do not match the announced manifest")
+	}
+	v.expected = m
+	v.failed = nil
+	for index := range v.builder.manifest.Chunks {
+		v.check(index)
+	}
+	return nil
+}
+
+// Manifest returns the manifest the chunks are checked against
+func (v *ChunkVerifier) Manifest() *ChunkManifest {
+	return v.expected
+}
+
+// Failed returns the chunks that did not match the manifest so far
+func (v *ChunkVerifier) Failed() []int {
+	return v.failed
+}
+
+// Checksum returns the digest of everything written to the verifier
+func (v *ChunkVerifier) Checksum() Checksum {
+	_, checksum := v.builder.Manifest()
+	return checksum
+}
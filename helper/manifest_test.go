@@ -0,0 +1,135 @@
+package helper
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testManifest builds the manifest of data in chunks of chunkSize
+func testManifest(t *testing.T, data []byte, chunkSize int64) *ChunkManifest {
+	t.Helper()
+	builder, err := NewManifestBuilder(SHA256, chunkSize, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := builder.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	manifest, _ := builder.Manifest()
+	return manifest
+}
+
+func TestChunkRanges(t *testing.T) {
+	data := []byte("0123456789")
+	path := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	manifest, checksum, err := BuildManifest(path, SHA256, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Count() != 3 {
+		t.Fatalf("Count() = %d, want 3", manifest.Count())
+	}
+	ranges := [][2]int64{{0, 4}, {4, 4}, {8, 2}}
+	for i, want := range ranges {
+		if offset, length := manifest.ChunkRange(i); offset != want[0] || length != want[1] {
+			t.Errorf("ChunkRange(%d) = %d, %d, want %d, %d", i, offset, length, want[0], want[1])
+		}
+	}
+	whole, err := CalculateFileChecksum(path, SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checksum != whole {
+		t.Fatalf("BuildManifest() checksum = %v, want %v", checksum, whole)
+	}
+	// Writing in pieces that straddle chunk boundaries gives the same digests
+	builder, _ := NewManifestBuilder(SHA256, 4, int64(len(data)))
+	for _, piece := range [][]byte{data[:3], data[3:9], data[9:]} {
+		if _, err := builder.Write(piece); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if streamed, _ := builder.Manifest(); !reflect.DeepEqual(streamed.Chunks, manifest.Chunks) {
+		t.Fatal("streamed digests differ from the file's")
+	}
+	if _, err := builder.Write([]byte{0}); err == nil {
+		t.Fatal("Write() accepted more data than announced")
+	}
+}
+
+func TestNewChunkManifestChecksShape(t *testing.T) {
+	digest := make([]byte, 32)
+	tests := []struct {
+		name      string
+		chunkSize int64
+		size      int64
+		chunks    [][]byte
+		wantErr   bool
+	}{
+		{"complete", 4, 10, [][]byte{digest, digest, digest}, false},
+		{"empty file", 4, 0, nil, false},
+		{"missing chunk", 4, 10, [][]byte{digest, digest}, true},
+		{"extra chunk", 4, 8, [][]byte{digest, digest, digest}, true},
+		{"short digest", 4, 10, [][]byte{digest, digest, digest[:16]}, true},
+		{"zero chunk size", 0, 10, nil, true},
+	}
+	for _, tt := range tests {
+		if _, err := NewChunkManifest(SHA256, tt.chunkSize, tt.size, tt.chunks); (err != nil) != tt.wantErr {
+			t.Errorf("%s: NewChunkManifest() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestChunkVerifierFindsCorruptChunks(t *testing.T) {
+	data := bytes.Repeat([]byte("abcd"), 5)
+	manifest := testManifest(t, data, 8)
+	corrupted := bytes.Clone(data)
+	corrupted[9] ^= 0xff
+
+	verifier := manifest.NewVerifier()
+	if _, err := verifier.Write(corrupted); err != nil {
+		t.Fatal(err)
+	}
+	if got := verifier.Failed(); !reflect.DeepEqual(got, []int{1}) {
+		t.Fatalf("Failed() = %v, want [1]", got)
+	}
+	if verifier.Checksum() == testChecksum(t, data) {
+		t.Fatal("Checksum() of corrupted data matches the original")
+	}
+
+	// With the digests in a trailer nothing can fail until they arrive
+	header := &ChunkManifest{Algorithm: SHA256, ChunkSize: 8, Size: int64(len(data))}
+	verifier = header.NewVerifier()
+	if _, err := verifier.Write(corrupted); err != nil {
+		t.Fatal(err)
+	}
+	if got := verifier.Failed(); len(got) != 0 {
+		t.Fatalf("Failed() = %v before the digests arrived", got)
+	}
+	if err := verifier.Expect(testManifest(t, data, 4)); err == nil {
+		t.Fatal("Expect() accepted digests for another chunk size")
+	}
+	if err := verifier.Expect(manifest); err != nil {
+		t.Fatal(err)
+	}
+	if got := verifier.Failed(); !reflect.DeepEqual(got, []int{1}) {
+		t.Fatalf("Failed() after Expect() = %v, want [1]", got)
+	}
+}
+
+// testChecksum returns the checksum of data as a ManifestBuilder reports it
+func testChecksum(t *testing.T, data []byte) Checksum {
+	t.Helper()
+	builder, _ := NewManifestBuilder(SHA256, DefaultChunkSize, int64(len(data)))
+	if _, err := builder.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	_, checksum := builder.Manifest()
+	return checksum
+}
@@ -0,0 +1,71 @@
+package helper
+
+import (
+	"bufio"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// Work factor of new password hashes, as recommended for PBKDF2-HMAC-SHA256
+const passwordIterations = 600000
+
+// PasswordHash is a salted PBKDF2-HMAC-SHA256 hash of a password. The iteration count
+// is stored with it so it can be raised later without breaking existing entries.
+type PasswordHash struct {
+	Salt       []byte `json:"salt"`
+	Hash       []byte `json:"hash"`
+	Iterations int    `json:"iterations"`
+}
+
+// HashPassword hashes a password under a fresh random salt
+func HashPassword(password string) (PasswordHash, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return PasswordHash{}, err
+	}
+	hash, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, sha256.Size)
+	if err != nil {
+		return PasswordHash{}, err
+	}
+	return PasswordHash{Salt: salt, Hash: hash, Iterations: passwordIterations}, nil
+}
+
+// Verify reports whether password is the one that was hashed, in constant time
+func (h PasswordHash) Verify(password string) bool {
+	if h.Iterations < 1 || len(h.Hash) == 0 {
+		return false
+	}
+	hash, err := pbkdf2.Key(sha256.New, password, h.Salt, h.Iterations, len(h.Hash))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(hash, h.Hash) == 1
+}
+
+// PasswordsEqual compares two passwords in constant time, whatever their lengths
+func PasswordsEqual(given, expected string) bool {
+	a, b := sha256.Sum256([]byte(given)), sha256.Sum256([]byte(expected))
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+
+// ReadPassword reads a password from the terminal without echoing it. When input does
+// not come from a terminal, the next line of reader is taken as it is.
+func ReadPassword(reader *bufio.Reader) (string, error) {
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		password, err := term.ReadPassword(fd)
+		fmt.Println()
+		return string(password), err
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,60 @@
+package helper
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPasswordHashVerify(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(hash.Salt, other.Salt) || bytes.Equal(hash.Hash, other.Hash) {
+		t.Fatal("two hashes of the same password share their salt or hash")
+	}
+
+	tests := []struct {
+		name     string
+		hash     PasswordHash
+		password string
+		want     bool
+	}{
+		{"right password", hash, "correct horse", true},
+		{"wrong password", hash, "correct horse ", false},
+		{"empty password", hash, "", false},
+		{"other salt", PasswordHash{Salt: other.Salt, Hash: hash.Hash, Iterations: hash.Iterations}, "correct horse", false},
+		{"fewer iterations", PasswordHash{Salt: hash.Salt, Hash: hash.Hash, Iterations: hash.Iterations - 1}, "correct horse", false},
+		{"no iterations", PasswordHash{Salt: hash.Salt, Hash: hash.Hash}, "correct horse", false},
+		{"empty entry", PasswordHash{}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.hash.Verify(tt.password); got != tt.want {
+				t.Fatalf("Verify(%q) = %v, want %v", tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordsEqual(t *testing.T) {
+	tests := []struct {
+		given, expected string
+		want            bool
+	}{
+		{"secret", "secret", true},
+		{"secret", "Secret", false},
+		{"secret", "secret2", false},
+		{"", "secret", false},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		if got := PasswordsEqual(tt.given, tt.expected); got != tt.want {
+			t.Errorf("PasswordsEqual(%q, %q) = %v, want %v", tt.given, tt.expected, got, tt.want)
+		}
+	}
+}
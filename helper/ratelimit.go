@@ -0,0 +1,151 @@
+package helper
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Longest a throttled read sleeps before it looks at the rate again, so a changed
+// limit takes effect on transfers that are already running
+const maxThrottleSleep = 100 * time.Millisecond
+
+// Smallest burst a limiter allows, so slow limits still move whole frames
+const minBurst = 16 << 10
+
+// RateLimiter is a token bucket of bytes per second. Everything that waits on the same
+// limiter shares its rate, and a rate of zero lets everything through.
+type RateLimiter struct {
+	mutex  sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter for bytesPerSecond, zero for no limit
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	return &RateLimiter{rate: max(bytesPerSecond, 0), last: time.Now()}
+}
+
+// SetRate changes the limit, zero removes it
+func (l *RateLimiter) SetRate(bytesPerSecond int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.rate = max(bytesPerSecond, 0)
+	l.tokens = min(l.tokens, float64(l.burst()))
+}
+
+// Rate returns the limit in bytes per second, zero when there is none
+func (l *RateLimiter) Rate() int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.rate
+}
+
+// burst is how many bytes may pass at once after a quiet spell. Callers must hold the mutex.
+func (l *RateLimiter) burst() int64 {
+	return max(l.rate/4, minBurst)
+}
+
+// WaitN blocks until n bytes may pass
+func (l *RateLimiter) WaitN(n int) {
+	for {
+		l.mutex.Lock()
+		if l.rate == 0 {
+			l.mutex.Unlock()
+			return
+		}
+		now := time.Now()
+		l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*float64(l.rate), float64(l.burst()))
+		l.last = now
+		need := float64(min(int64(n), l.burst()))
+		if l.tokens >= need {
+			l.tokens -= float64(n)
+			l.mutex.Unlock()
+			return
+		}
+		wait := time.Duration((need - l.tokens) / float64(l.rate) * float64(time.Second))
+		l.mutex.Unlock()
+		time.Sleep(min(wait, maxThrottleSleep))
+	}
+}
+
+// limitedReader throttles reads by every limiter it was given
+type limitedReader struct {
+	reader   io.Reader
+	limiters []*RateLimiter
+}
+
+// NewLimitedReader returns a reader that waits on each of the limiters for the bytes it
+// reads. Nil limiters are skipped, so callers can pass the ones that may not exist.
+func NewLimitedReader(reader io.Reader, limiters ...*RateLimiter) io.Reader {
+	active := make([]*RateLimiter, 0, len(limiters))
+	for _, limiter := range limiters {
+		if limiter != nil {
+			active = append(active, limiter)
+		}
+	}
+	return &limitedReader{reader: reader, limiters: active}
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	// Reads are kept to the smallest burst so a slow limit is not overshot
+	for _, limiter := range r.limiters {
+		limiter.mutex.Lock()
+		if limiter.rate > 0 {
+			p = p[:min(int64(len(p)), limiter.burst())]
+		}
+		limiter.mutex.Unlock()
+	}
+	n, err := r.reader.Read(p)
+	for _, limiter := range r.limiters {
+		limiter.WaitN(n)
+	}
+	return n, err
+}
+
+// ParseRate reads a rate such as "5MB/s", "500KB" or "off". Units are powers of 1024
+// and "off", "none" or "0" mean no limit.
+func ParseRate(text string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(text))
+	value = strings.TrimSuffix(value, "/S")
+	switch value {
+	case "OFF", "NONE", "0":
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSuffix(value, unit.suffix)
+			multiplier = unit.size
+			break
+		}
+	}
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid rate %q, use a value such as 5MB/s, 500KB/s or off", text)
+	}
+	return int64(number * float64(multiplier)), nil
+}
+
+// FormatRate describes a rate in bytes per second for display
+func FormatRate(bytesPerSecond int64) string {
+	switch {
+	case bytesPerSecond <= 0:
+		return "unlimited"
+	case bytesPerSecond >= 1<<30:
+		return fmt.Sprintf("%.1f GB/s", float64(bytesPerSecond)/(1<<30))
+	case bytesPerSecond >= 1<<20:
+		return fmt.Sprintf("%.1f MB/s", float64(bytesPerSecond)/(1<<20))
+	case bytesPerSecond >= 1<<10:
+		return fmt.Sprintf("%.1f KB/s", float64(bytesPerSecond)/(1<<10))
+	}
+	return fmt.Sprintf("%d B/s", bytesPerSecond)
+}
@@ -0,0 +1,92 @@
+package helper
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    int64
+		wantErr bool
+	}{
+		{"5MB/s", 5 << 20, false},
+		{"500kb", 500 << 10, false},
+		{" 1.5 M/s ", 3 << 19, false},
+		{"2G", 2 << 30, false},
+		{"100B/s", 100, false},
+		{"4096", 4096, false},
+		{"off", 0, false},
+		{"None", 0, false},
+		{"0", 0, false},
+		{"", 0, true},
+		{"fast", 0, true},
+		{"-1MB", 0, true},
+		{"5TB", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRate(tt.text)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseRate(%q) = %d, %v, want %d, error %v", tt.text, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestFormatRate(t *testing.T) {
+	tests := map[int64]string{
+		0:          "unlimited",
+		512:        "512 B/s",
+		1536:       "1.5 KB/s",
+		5 << 20:    "5.0 MB/s",
+		3 << 29:    "1.5 GB/s",
+		-(1 << 20): "unlimited",
+	}
+	for rate, want := range tests {
+		if got := FormatRate(rate); got != want {
+			t.Errorf("FormatRate(%d) = %q, want %q", rate, got, want)
+		}
+	}
+}
+
+// timedCopy reads size bytes through the limiters and returns how long it took
+func timedCopy(t *testing.T, size int, limiters ...*RateLimiter) time.Duration {
+	t.Helper()
+	start := time.Now()
+	n, err := io.Copy(io.Discard, NewLimitedReader(bytes.NewReader(make([]byte, size)), limiters...))
+	if err != nil || n != int64(size) {
+		t.Fatalf("copied %d bytes, error %v, want %d", n, err, size)
+	}
+	return time.Since(start)
+}
+
+func TestRateLimiterThrottles(t *testing.T) {
+	// 48 KB at 64 KB/s takes at least half a second once the 16 KB burst is spent
+	limiter := NewRateLimiter(64 << 10)
+	if elapsed := timedCopy(t, 48<<10, limiter); elapsed < 400*time.Millisecond || elapsed > 3*time.Second {
+		t.Fatalf("48 KB at 64 KB/s took %v", elapsed)
+	}
+
+	// Nil and lifted limiters let everything through
+	limiter.SetRate(0)
+	if elapsed := timedCopy(t, 4<<20, nil, limiter); elapsed > 500*time.Millisecond {
+		t.Fatalf("unlimited copy took %v", elapsed)
+	}
+	if limiter.Rate() != 0 {
+		t.Fatalf("Rate() = %d after removing the limit", limiter.Rate())
+	}
+}
+
+func TestRateLimiterTakesNewRate(t *testing.T) {
+	// At 16 KB/s this copy would take a minute, lifting the limit lets it finish at once
+	limiter := NewRateLimiter(16 << 10)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		limiter.SetRate(0)
+	}()
+	if elapsed := timedCopy(t, 1<<20, limiter); elapsed > 2*time.Second {
+		t.Fatalf("copy took %v after the limit was lifted", elapsed)
+	}
+}
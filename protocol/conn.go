@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+// Conn wraps a net.Conn and exchanges frames over it. Sends are serialized so
+// several goroutines can share one connection without interleaving frames.
+type Conn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+}
+
+// NewConn creates a framed connection on top of conn
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+// Send writes a single frame
+func (c *Conn) Send(frame Frame) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return WriteFrame(c.conn, frame)
+}
+
+// Receive blocks until the next frame arrives
+func (c *Conn) Receive() (Frame, error) {
+	return ReadFrame(c.reader)
+}
+
+// SendCommand sends a control command
+func (c *Conn) SendCommand(command string) error {
+	return c.Send(Frame{Type: FrameCommand, Payload: []byte(command)})
+}
+
+// SendChat sends a chat message
+func (c *Conn) SendChat(text string) error {
+	return c.Send(Frame{Type: FrameChat, Payload: []byte(text)})
+}
+
+// SendError sends an error message back to the peer
+func (c *Conn) SendError(message string) error {
+	return c.Send(Frame{Type: FrameError, Payload: []byte(message)})
+}
+
+// Close closes the underlying connection
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// RemoteAddr returns the address of the peer
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetReadDeadline sets the deadline for the next Receive
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for the next Send
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,164 @@
+package protocol
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// DataChunkSize is the largest amount of file data carried by one data frame
+const DataChunkSize = 32 * 1024
+
+// ErrMalformedData is returned when a data frame payload cannot be decoded
+var ErrMalformedData = errors.New("malformed data frame")
+
+// EncodeData builds a data frame payload: one length byte, the transfer ID, then the chunk
+func EncodeData(transferID string, chunk []byte) ([]byte, error) {
+	if len(transferID) == 0 || len(transferID) > 255 {
+		return nil, fmt.Errorf("invalid transfer ID %q", transferID)
+	}
+	payload := make([]byte, 1+len(transferID)+len(chunk))
+	payload[0] = byte(len(transferID))
+	copy(payload[1:], transferID)
+	copy(payload[1+len(transferID):], chunk)
+	return payload, nil
+}
+
+// DecodeData splits a data frame payload into its transfer ID and chunk
+func DecodeData(payload []byte) (string, []byte, error) {
+	if len(payload) < 1 {
+		return "", nil, ErrMalformedData
+	}
+	idLen := int(payload[0])
+	if idLen == 0 || len(payload) < 1+idLen {
+		return "", nil, ErrMalformedData
+	}
+	return string(payload[1 : 1+idLen]), payload[1+idLen:], nil
+}
+
+// ErrDataAuthentication is returned when a sealed chunk does not decrypt, because it
+// was altered, moved or replayed on the way or sealed with another key
+var ErrDataAuthentication = errors.New("data frame failed authentication")
+
+// Sealed chunks and sealed commands authenticate different data, so one can never be
+// passed off as the other
+const (
+	sealedChunk   byte = 'D'
+	sealedCommand byte = 'C'
+)
+
+// chunkData is what a sealed chunk authenticates besides its contents: the transfer,
+// the offset of the chunk in the stream and where the stream ends. A chunk that was
+// moved, dropped or replayed elsewhere in the stream, or a stream cut short or
+// announced with another size, fails to open.
+func chunkData(transferID string, offset, end int64) []byte {
+	data := make([]byte, 1+16, 1+16+len(transferID))
+	data[0] = sealedChunk
+	binary.BigEndian.PutUint64(data[1:], uint64(offset))
+	binary.BigEndian.PutUint64(data[9:], uint64(end))
+	return append(data, transferID...)
+}
+
+// SealData encrypts the chunk at offset of a stream ending at end, under a fresh random
+// nonce which goes in front of the ciphertext
+func SealData(aead cipher.AEAD, transferID string, offset, end int64, chunk []byte) ([]byte, error) {
+	return seal(aead, chunkData(transferID, offset, end), chunk)
+}
+
+// OpenData decrypts a chunk sealed by SealData, which must have been given the same
+// offset and end
+func OpenData(aead cipher.AEAD, transferID string, offset, end int64, sealed []byte) ([]byte, error) {
+	return open(aead, chunkData(transferID, offset, end), sealed)
+}
+
+// commandData is what a sealed command authenticates besides its text: the transfer
+// and the number of commands sealed before it on the data channel. Only the sending
+// side of a transfer seals commands, so the numbers run in that one direction, and a
+// command that was dropped, reordered or replayed fails to open.
+func commandData(transferID string, seq uint64) []byte {
+	data := make([]byte, 1+8, 1+8+len(transferID))
+	data[0] = sealedCommand
+	binary.BigEndian.PutUint64(data[1:], seq)
+	return append(data, transferID...)
+}
+
+// SealCommand encrypts command number seq sent on the data channel of a transfer
+func SealCommand(aead cipher.AEAD, transferID string, seq uint64, command string) ([]byte, error) {
+	return seal(aead, commandData(transferID, seq), []byte(command))
+}
+
+// OpenCommand decrypts a command sealed by SealCommand, which must have been given
+// the same number
+func OpenCommand(aead cipher.AEAD, transferID string, seq uint64, sealed []byte) (string, error) {
+	command, err := open(aead, commandData(transferID, seq), sealed)
+	return string(command), err
+}
+
+func seal(aead cipher.AEAD, additional, plaintext []byte) ([]byte, error) {
+	sealed := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(sealed); err != nil {
+		return nil, err
+	}
+	return aead.Seal(sealed, sealed, plaintext, additional), nil
+}
+
+func open(aead cipher.AEAD, additional, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrDataAuthentication
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additional)
+	if err != nil {
+		return nil, ErrDataAuthentication
+	}
+	return plaintext, nil
+}
+
+// DataWriter is an io.Writer that wraps everything written to it into data
+// frames for a single transfer. With a Cipher every chunk is sealed first, bound to
+// Offset, where it lies in the stream, and End, where the stream ends.
+type DataWriter struct {
+	Conn       *Conn
+	TransferID string
+	Cipher     cipher.AEAD
+	Offset     int64
+	End        int64
+}
+
+// NewDataWriter creates a DataWriter for the given transfer
+func NewDataWriter(conn *Conn, transferID string) *DataWriter {
+	return &DataWriter{Conn: conn, TransferID: transferID}
+}
+
+// Write implements io.Writer, splitting p into frames of at most DataChunkSize bytes
+func (dw *DataWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		end := written + DataChunkSize
+		if end > len(p) {
+			end = len(p)
+		}
+		chunk := p[written:end]
+		if dw.Cipher != nil {
+			if dw.Offset+int64(len(chunk)) > dw.End {
+				return written, fmt.Errorf("data beyond the end of the stream at %d", dw.End)
+			}
+			var err error
+			if chunk, err = SealData(dw.Cipher, dw.TransferID, dw.Offset, dw.End, chunk); err != nil {
+				return written, err
+			}
+		}
+		payload, err := EncodeData(dw.TransferID, chunk)
+		if err != nil {
+			return written, err
+		}
+		if err := dw.Conn.Send(Frame{Type: FrameData, Payload: payload}); err != nil {
+			return written, err
+		}
+		dw.Offset += int64(end - written)
+		written = end
+	}
+	return written, nil
+}
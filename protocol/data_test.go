@@ -0,0 +1,218 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"net"
+	"testing"
+)
+
+func testCipher(t *testing.T, keyByte byte) cipher.AEAD {
+	t.Helper()
+	block, err := aes.NewCipher(bytes.Repeat([]byte{keyByte}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+func TestDecodeData(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		id      string
+		chunk   []byte
+		err     error
+	}{
+		{"chunk", []byte("\x04abcdhello"), "abcd", []byte("hello"), nil},
+		{"empty chunk", []byte("\x04abcd"), "abcd", []byte{}, nil},
+		{"empty", nil, "", nil, ErrMalformedData},
+		{"no ID", []byte("\x00hello"), "", nil, ErrMalformedData},
+		{"ID cut short", []byte("\x08abcd"), "", nil, ErrMalformedData},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, chunk, err := DecodeData(tt.payload)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("DecodeData() error = %v, want %v", err, tt.err)
+			}
+			if err == nil && (id != tt.id || !bytes.Equal(chunk, tt.chunk)) {
+				t.Fatalf("DecodeData() = %q, %q, want %q, %q", id, chunk, tt.id, tt.chunk)
+			}
+		})
+	}
+}
+
+func TestEncodeDataRejectsBadIDs(t *testing.T) {
+	for _, id := range []string{"", string(bytes.Repeat([]byte{'a'}, 256))} {
+		if _, err := EncodeData(id, []byte("x")); err == nil {
+			t.Errorf("EncodeData(%d byte ID) succeeded", len(id))
+		}
+	}
+}
+
+func TestOpenDataRejectsTampering(t *testing.T) {
+	aead := testCipher(t, 1)
+	const id, offset, end = "a1b2c3d4", 32768, 100000
+	chunk := []byte("the chunk at 32768")
+	sealed, err := SealData(aead, id, offset, end, chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flip := func(i int) []byte {
+		changed := bytes.Clone(sealed)
+		changed[i] ^= 0x01
+		return changed
+	}
+
+	tests := []struct {
+		name   string
+		aead   cipher.AEAD
+		id     string
+		offset int64
+		end    int64
+		sealed []byte
+		err    error
+	}{
+		{"untouched", aead, id, offset, end, sealed, nil},
+		{"nonce changed", aead, id, offset, end, flip(0), ErrDataAuthentication},
+		{"ciphertext changed", aead, id, offset, end, flip(aead.NonceSize()), ErrDataAuthentication},
+		{"tag changed", aead, id, offset, end, flip(len(sealed) - 1), ErrDataAuthentication},
+		{"cut short", aead, id, offset, end, sealed[:len(sealed)-1], ErrDataAuthentication},
+		{"too short for a tag", aead, id, offset, end, sealed[:aead.NonceSize()], ErrDataAuthentication},
+		{"moved to another offset", aead, id, offset + DataChunkSize, end, sealed, ErrDataAuthentication},
+		{"replayed at the start", aead, id, 0, end, sealed, ErrDataAuthentication},
+		{"stream end changed", aead, id, offset, end - 1, sealed, ErrDataAuthentication},
+		{"another transfer", aead, "a1b2c3d5", offset, end, sealed, ErrDataAuthentication},
+		{"another key", testCipher(t, 2), id, offset, end, sealed, ErrDataAuthentication},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opened, err := OpenData(tt.aead, tt.id, tt.offset, tt.end, tt.sealed)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("OpenData() error = %v, want %v", err, tt.err)
+			}
+			if err == nil && !bytes.Equal(opened, chunk) {
+				t.Fatalf("OpenData() = %q, want %q", opened, chunk)
+			}
+		})
+	}
+}
+
+func TestSealedCommandsAndChunksDoNotMix(t *testing.T) {
+	aead := testCipher(t, 1)
+	const id = "a1b2c3d4"
+
+	command, err := SealCommand(aead, id, 0, "/CHECKSUM sha256:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened, err := OpenCommand(aead, id, 0, command); err != nil || opened != "/CHECKSUM sha256:00" {
+		t.Fatalf("OpenCommand() = %q, %v", opened, err)
+	}
+	if _, err := OpenCommand(aead, "a1b2c3d5", 0, command); !errors.Is(err, ErrDataAuthentication) {
+		t.Fatalf("OpenCommand() of another transfer error = %v, want %v", err, ErrDataAuthentication)
+	}
+	if _, err := OpenData(aead, id, 0, 100, command); !errors.Is(err, ErrDataAuthentication) {
+		t.Fatalf("OpenData() of a sealed command error = %v, want %v", err, ErrDataAuthentication)
+	}
+
+	chunk, err := SealData(aead, id, 0, 100, []byte("/CANCEL"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenCommand(aead, id, 0, chunk); !errors.Is(err, ErrDataAuthentication) {
+		t.Fatalf("OpenCommand() of a sealed chunk error = %v, want %v", err, ErrDataAuthentication)
+	}
+}
+
+func TestOpenCommandBindsSequence(t *testing.T) {
+	aead := testCipher(t, 1)
+	const id = "a1b2c3d4"
+	commands := []string{"/MANIFEST sha256 1048576 2", "/CHUNK_HASHES 00 11", "/CHECKSUM sha256:22"}
+	sealed := make([][]byte, len(commands))
+	for i, command := range commands {
+		var err error
+		if sealed[i], err = SealCommand(aead, id, uint64(i), command); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		seq    uint64
+		sealed []byte
+		want   string
+	}{
+		{"in order", 1, sealed[1], commands[1]},
+		{"replayed", 2, sealed[1], ""},
+		{"dropped one before", 1, sealed[2], ""},
+		{"moved up", 0, sealed[2], ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opened, err := OpenCommand(aead, id, tt.seq, tt.sealed)
+			if tt.want == "" {
+				if !errors.Is(err, ErrDataAuthentication) {
+					t.Fatalf("OpenCommand() error = %v, want %v", err, ErrDataAuthentication)
+				}
+				return
+			}
+			if err != nil || opened != tt.want {
+				t.Fatalf("OpenCommand() = %q, %v, want %q", opened, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDataWriterBindsOffsets(t *testing.T) {
+	aead := testCipher(t, 1)
+	const id = "a1b2c3d4"
+	data := bytes.Repeat([]byte("0123456789"), 4000) // a little over one chunk
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	writer := &DataWriter{Conn: NewConn(client), TransferID: id, Cipher: aead, Offset: 1000, End: 1000 + int64(len(data))}
+	done := make(chan error, 1)
+	go func() {
+		_, err := writer.Write(data)
+		done <- err
+	}()
+
+	reader := NewConn(server)
+	offset := int64(1000)
+	var received []byte
+	for len(received) < len(data) {
+		frame, err := reader.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		frameId, sealed, err := DecodeData(frame.Payload)
+		if err != nil || frameId != id {
+			t.Fatalf("DecodeData() = %q, %v", frameId, err)
+		}
+		chunk, err := OpenData(aead, id, offset, writer.End, sealed)
+		if err != nil {
+			t.Fatalf("OpenData() at %d error = %v", offset, err)
+		}
+		received = append(received, chunk...)
+		offset += int64(len(chunk))
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("received data differs from what was written")
+	}
+
+	if _, err := writer.Write([]byte("x")); err == nil {
+		t.Fatal("Write() beyond the end of the stream succeeded")
+	}
+}
@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is the protocol version servers announce in their beacon, raised whenever a
+// change keeps clients and servers of different versions from working together
+const Version = 1
+
+// DiscoveryPort is the UDP port servers broadcast their beacon to
+const DiscoveryPort = 9876
+
+// beaconPrefix starts every beacon, which is
+//
+//	DRIZLINK_SERVER:<ip>:<port>:<version>:<users>:<tls>:<name>
+//
+// An empty IP means the address the beacon came from. Older servers only send the IP
+// and port.
+const beaconPrefix = "DRIZLINK_SERVER:"
+
+// Beacon is what a server announces about itself on the local network
+type Beacon struct {
+	IP      string
+	Port    string
+	Version int
+	Users   int
+	TLS     bool
+	Name    string
+}
+
+// EncodeBeacon returns the payload of a beacon
+func EncodeBeacon(beacon Beacon) []byte {
+	return fmt.Appendf(nil, "%s%s:%s:%d:%d:%t:%s",
+		beaconPrefix, beacon.IP, beacon.Port, beacon.Version, beacon.Users, beacon.TLS, beacon.Name)
+}
+
+// ParseBeacon reads a beacon. Fields an older server leaves out are zero, and TLS is
+// taken to be off for them since they predate it.
+func ParseBeacon(payload []byte) (Beacon, error) {
+	message := string(payload)
+	if !strings.HasPrefix(message, beaconPrefix) {
+		return Beacon{}, fmt.Errorf("not a server beacon")
+	}
+	parts := strings.SplitN(strings.TrimPrefix(message, beaconPrefix), ":", 6)
+	if len(parts) != 2 && len(parts) != 6 {
+		return Beacon{}, fmt.Errorf("malformed server beacon")
+	}
+	beacon := Beacon{IP: parts[0], Port: parts[1]}
+	if _, err := strconv.Atoi(beacon.Port); err != nil {
+		return Beacon{}, fmt.Errorf("malformed server beacon")
+	}
+	if len(parts) == 2 {
+		return beacon, nil
+	}
+
+	var err error
+	if beacon.Version, err = strconv.Atoi(parts[2]); err != nil {
+		return Beacon{}, fmt.Errorf("malformed server beacon")
+	}
+	if beacon.Users, err = strconv.Atoi(parts[3]); err != nil {
+		return Beacon{}, fmt.Errorf("malformed server beacon")
+	}
+	if beacon.TLS, err = strconv.ParseBool(parts[4]); err != nil {
+		return Beacon{}, fmt.Errorf("malformed server beacon")
+	}
+	beacon.Name = parts[5]
+	return beacon, nil
+}
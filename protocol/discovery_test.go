@@ -0,0 +1,69 @@
+package protocol
+
+import "testing"
+
+func TestParseBeacon(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    Beacon
+		wantErr bool
+	}{
+		{
+			name:    "current server",
+			payload: "DRIZLINK_SERVER::8080:1:3:true:office",
+			want:    Beacon{Port: "8080", Version: 1, Users: 3, TLS: true, Name: "office"},
+		},
+		{
+			name:    "name with colons",
+			payload: "DRIZLINK_SERVER::8080:1:0:false:lab: floor 2",
+			want:    Beacon{Port: "8080", Version: 1, Name: "lab: floor 2"},
+		},
+		{
+			name:    "empty name",
+			payload: "DRIZLINK_SERVER:10.0.0.5:9000:2:1:false:",
+			want:    Beacon{IP: "10.0.0.5", Port: "9000", Version: 2, Users: 1},
+		},
+		{
+			name:    "older server",
+			payload: "DRIZLINK_SERVER:192.168.1.10:8080",
+			want:    Beacon{IP: "192.168.1.10", Port: "8080"},
+		},
+		{name: "other prefix", payload: "SOMETHING_ELSE:1.2.3.4:8080", wantErr: true},
+		{name: "empty", payload: "", wantErr: true},
+		{name: "prefix only", payload: "DRIZLINK_SERVER:", wantErr: true},
+		{name: "port only", payload: "DRIZLINK_SERVER:8080", wantErr: true},
+		{name: "port not a number", payload: "DRIZLINK_SERVER:1.2.3.4:http", wantErr: true},
+		{name: "fields missing", payload: "DRIZLINK_SERVER::8080:1:3", wantErr: true},
+		{name: "bad version", payload: "DRIZLINK_SERVER::8080:v1:3:true:x", wantErr: true},
+		{name: "bad user count", payload: "DRIZLINK_SERVER::8080:1:many:true:x", wantErr: true},
+		{name: "bad TLS flag", payload: "DRIZLINK_SERVER::8080:1:3:maybe:x", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseBeacon([]byte(tt.payload))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseBeacon(%q) error = %v, wantErr %v", tt.payload, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("ParseBeacon(%q) = %+v, want %+v", tt.payload, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBeaconRoundTrip(t *testing.T) {
+	beacons := []Beacon{
+		{Port: "8080", Version: Version, Users: 12, TLS: true, Name: "my server"},
+		{IP: "10.1.2.3", Port: "65535", Version: Version, Name: "a:b:c"},
+	}
+	for _, beacon := range beacons {
+		got, err := ParseBeacon(EncodeBeacon(beacon))
+		if err != nil {
+			t.Fatalf("ParseBeacon(EncodeBeacon(%+v)) error = %v", beacon, err)
+		}
+		if got != beacon {
+			t.Fatalf("ParseBeacon(EncodeBeacon(%+v)) = %+v", beacon, got)
+		}
+	}
+}
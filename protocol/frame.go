@@ -0,0 +1,92 @@
+// Package protocol implements the length-prefixed frame format shared by the
+// ItShare server and client. Every message on the wire is a frame made of a
+// one byte type, a four byte big-endian payload length and the payload itself,
+// so chat, control commands and file data can never bleed into each other.
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// FrameType identifies what a frame carries
+type FrameType byte
+
+const (
+	FrameCommand FrameType = iota + 1 // control commands such as /FILE_REQUEST or USERS:
+	FrameChat                         // chat text to be displayed as-is
+	FrameData                         // file payload bytes tagged with a transfer ID
+	FrameError                        // error reported back to the requester
+)
+
+const (
+	// HeaderSize is the number of bytes preceding every payload
+	HeaderSize = 5
+	// MaxPayloadSize bounds a single frame so a bad peer cannot make us allocate arbitrarily
+	MaxPayloadSize = 1 << 20
+)
+
+// ErrFrameTooLarge is returned when a frame exceeds MaxPayloadSize
+var ErrFrameTooLarge = errors.New("frame payload exceeds maximum size")
+
+// Frame is a single message on the wire
+type Frame struct {
+	Type    FrameType
+	Payload []byte
+}
+
+// String representation of FrameType
+func (t FrameType) String() string {
+	switch t {
+	case FrameCommand:
+		return "Command"
+	case FrameChat:
+		return "Chat"
+	case FrameData:
+		return "Data"
+	case FrameError:
+		return "Error"
+	default:
+		return fmt.Sprintf("Unknown(%d)", byte(t))
+	}
+}
+
+// WriteFrame encodes a frame and writes it with a single call to w
+func WriteFrame(w io.Writer, frame Frame) error {
+	if len(frame.Payload) > MaxPayloadSize {
+		return ErrFrameTooLarge
+	}
+
+	buf := make([]byte, HeaderSize+len(frame.Payload))
+	buf[0] = byte(frame.Type)
+	binary.BigEndian.PutUint32(buf[1:HeaderSize], uint32(len(frame.Payload)))
+	copy(buf[HeaderSize:], frame.Payload)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadFrame reads exactly one frame from r
+func ReadFrame(r io.Reader) (Frame, error) {
+	var header [HeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return Frame{}, err
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > MaxPayloadSize {
+		return Frame{}, ErrFrameTooLarge
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Frame{}, err
+	}
+
+	return Frame{Type: FrameType(header[0]), Payload: payload}, nil
+}
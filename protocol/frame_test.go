@@ -0,0 +1,106 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestWriteFrameLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		err  error
+	}{
+		{"empty", 0, nil},
+		{"one byte", 1, nil},
+		{"data chunk", DataChunkSize, nil},
+		{"largest", MaxPayloadSize, nil},
+		{"too large", MaxPayloadSize + 1, ErrFrameTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			payload := bytes.Repeat([]byte{'x'}, tt.size)
+			err := WriteFrame(&buf, Frame{Type: FrameData, Payload: payload})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("WriteFrame() error = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				if buf.Len() != 0 {
+					t.Fatalf("WriteFrame() wrote %d bytes of a rejected frame", buf.Len())
+				}
+				return
+			}
+			if buf.Len() != HeaderSize+tt.size {
+				t.Fatalf("WriteFrame() wrote %d bytes, want %d", buf.Len(), HeaderSize+tt.size)
+			}
+
+			frame, err := ReadFrame(&buf)
+			if err != nil {
+				t.Fatalf("ReadFrame() error = %v", err)
+			}
+			if frame.Type != FrameData || !bytes.Equal(frame.Payload, payload) {
+				t.Fatalf("ReadFrame() = %v frame of %d bytes, want Data frame of %d", frame.Type, len(frame.Payload), tt.size)
+			}
+		})
+	}
+}
+
+// header encodes a frame header announcing size bytes of payload
+func header(frameType FrameType, size uint32) []byte {
+	buf := []byte{byte(frameType), 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(buf[1:], size)
+	return buf
+}
+
+func TestReadFrameRejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		err   error
+	}{
+		{"nothing", nil, io.EOF},
+		{"short header", []byte{byte(FrameCommand), 0, 0}, io.ErrUnexpectedEOF},
+		{"announced too large", header(FrameData, MaxPayloadSize+1), ErrFrameTooLarge},
+		{"announced huge", header(FrameData, 0xffffffff), ErrFrameTooLarge},
+		{"payload missing", header(FrameChat, 4), io.ErrUnexpectedEOF},
+		{"payload cut short", append(header(FrameChat, 4), 'h', 'i'), io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadFrame(bytes.NewReader(tt.input))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("ReadFrame() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestReadFrameKeepsFramesApart(t *testing.T) {
+	var buf bytes.Buffer
+	frames := []Frame{
+		{Type: FrameCommand, Payload: []byte("/USERS")},
+		{Type: FrameChat, Payload: []byte("hello\n/not a command")},
+		{Type: FrameError, Payload: []byte{}},
+	}
+	for _, frame := range frames {
+		if err := WriteFrame(&buf, frame); err != nil {
+			t.Fatalf("WriteFrame() error = %v", err)
+		}
+	}
+	for i, want := range frames {
+		got, err := ReadFrame(&buf)
+		if err != nil {
+			t.Fatalf("frame %d: ReadFrame() error = %v", i, err)
+		}
+		if got.Type != want.Type || !bytes.Equal(got.Payload, want.Payload) {
+			t.Fatalf("frame %d: got %v %q, want %v %q", i, got.Type, got.Payload, want.Type, want.Payload)
+		}
+	}
+	if _, err := ReadFrame(&buf); err != io.EOF {
+		t.Fatalf("ReadFrame() after the last frame error = %v, want EOF", err)
+	}
+}
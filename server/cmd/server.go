@@ -5,16 +5,89 @@ import (
 	"ItShare/server/interfaces"
 	connection "ItShare/server/internal"
 	"ItShare/utils"
+	"bufio"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"os"
 	"strings"
 	"time"
 )
 
 func main() {
 	port := flag.String("port", "8080", "The port to listen on")
+	queueSize := flag.Int("queue-size", 256, "Frames buffered per client before the overflow policy applies")
+	writeTimeout := flag.Duration("write-timeout", 10*time.Second, "How long a write to a client may block before it is disconnected")
+	overflow := flag.String("overflow", string(interfaces.OverflowDrop), "What to do when a client's queue is full: drop or disconnect")
+	useTLS := flag.Bool("tls", true, "Serve clients over TLS, turn off only for clients that cannot use it")
+	certFile := flag.String("cert", "", "TLS certificate file, a self-signed one is generated when omitted")
+	keyFile := flag.String("key", "", "Private key file of --cert")
+	relayLimit := flag.String("relay-limit", "off", "Bandwidth all relayed transfers share, such as 50MB/s")
+	userRelayLimit := flag.String("user-relay-limit", "off", "Bandwidth each sender's relayed transfers share, such as 5MB/s")
+	password := flag.String("password", "", "Password every client must log in with, also read from $ITSHARE_PASSWORD")
+	usersFile := flag.String("users", "", "File of users with their own salted password hashes")
+	addUser := flag.String("add-user", "", "Set the password of a user in the --users file and exit")
+	discovery := flag.Bool("discovery", true, "Broadcast a beacon so clients on the local network can find the server")
+	discoveryInterval := flag.Duration("discovery-interval", 2*time.Second, "How often the discovery beacon is broadcast")
+	name := flag.String("name", "", "Name the server announces in its discovery beacon, the host name by default")
 	flag.Parse()
 
+	if *addUser != "" {
+		if *usersFile == "" {
+			fmt.Println(utils.ErrorColor("❌ Error: --add-user needs --users"))
+			return
+		}
+		addAccount(*usersFile, *addUser)
+		return
+	}
+	if *password == "" {
+		*password = os.Getenv("ITSHARE_PASSWORD")
+	}
+	accounts := make(map[string]helper.PasswordHash)
+	if *usersFile != "" {
+		var err error
+		if accounts, err = connection.LoadAccounts(*usersFile); err != nil {
+			fmt.Println(utils.ErrorColor("❌ Error loading the users file: " + err.Error()))
+			return
+		}
+		if len(accounts) == 0 {
+			fmt.Println(utils.ErrorColor("❌ Error: " + *usersFile + " has no users, add them with --add-user"))
+			return
+		}
+	}
+
+	policy := interfaces.OverflowPolicy(*overflow)
+	if policy != interfaces.OverflowDrop && policy != interfaces.OverflowDisconnect {
+		fmt.Println(utils.ErrorColor("❌ Error: --overflow must be drop or disconnect"))
+		return
+	}
+	if *queueSize < 1 || *writeTimeout <= 0 {
+		fmt.Println(utils.ErrorColor("❌ Error: --queue-size and --write-timeout must be positive"))
+		return
+	}
+	if *discoveryInterval <= 0 {
+		fmt.Println(utils.ErrorColor("❌ Error: --discovery-interval must be positive"))
+		return
+	}
+	if *name == "" {
+		if hostname, err := os.Hostname(); err == nil {
+			*name = hostname
+		} else {
+			*name = "ItShare"
+		}
+	}
+
+	relayRate, err := helper.ParseRate(*relayLimit)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error: --relay-limit: " + err.Error()))
+		return
+	}
+	userRelayRate, err := helper.ParseRate(*userRelayLimit)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error: --user-relay-limit: " + err.Error()))
+		return
+	}
+
 	formattedPort := *port
 	if !strings.HasPrefix(formattedPort, ":") {
 		formattedPort = ":" + formattedPort
@@ -26,15 +99,85 @@ func main() {
 		return
 	}
 
+	var tlsConfig *tls.Config
+	var fingerprint string
+	if *useTLS {
+		tlsConfig, fingerprint, err = connection.LoadTLSConfig(*certFile, *keyFile)
+		if err != nil {
+			fmt.Println(utils.ErrorColor("❌ Error loading the TLS certificate: " + err.Error()))
+			return
+		}
+	}
+
 	utils.PrintBanner()
 	fmt.Println(utils.InfoColor("Starting server on port " + *port + "..."))
+	if tlsConfig != nil {
+		fmt.Println(utils.InfoColor("🔒 TLS certificate fingerprint: " + fingerprint))
+	} else {
+		fmt.Println(utils.WarningColor("⚠ TLS is off, traffic is not encrypted"))
+	}
+	switch {
+	case len(accounts) > 0 && *password != "":
+		fmt.Println(utils.InfoColor(fmt.Sprintf("🔑 Logins need a password: %d users with their own, everyone else the shared one", len(accounts))))
+	case len(accounts) > 0:
+		fmt.Println(utils.InfoColor(fmt.Sprintf("🔑 Logins need a password, %d users may log in", len(accounts))))
+	case *password != "":
+		fmt.Println(utils.InfoColor("🔑 Logins need the shared password"))
+	default:
+		fmt.Println(utils.WarningColor("⚠ No password is set, anyone who can reach the server can log in"))
+	}
+	if tlsConfig == nil && (len(accounts) > 0 || *password != "") {
+		fmt.Println(utils.WarningColor("⚠ Passwords are sent in the clear without TLS"))
+	}
 
 	server := interfaces.Server{
-		Address:     formattedPort,
-		Connections: make(map[string]*interfaces.User),
-		IpAddresses: make(map[string]*interfaces.User),
-		Messages:    make(chan interfaces.Message),
+		Address:        formattedPort,
+		QueueSize:      *queueSize,
+		WriteTimeout:   *writeTimeout,
+		OverflowPolicy: policy,
+		Connections:    make(map[string]*interfaces.User),
+		Sessions:       make(map[string]*interfaces.User),
+		Relays:         make(map[string]*interfaces.Relay),
+		Rooms:          make(map[string]*interfaces.Room),
+		NextRoomId:     1,
+		Messages:       make(chan interfaces.Message),
+		RelayLimit:     helper.NewRateLimiter(relayRate),
+		UserRelayRate:  userRelayRate,
+		UserLimiters:   make(map[string]*helper.RateLimiter),
+		TLSConfig:      tlsConfig,
+		Password:       *password,
+		Accounts:       accounts,
+		LoginFailures:  make(map[string]*interfaces.LoginFailures),
 	}
 	go connection.StartHeartBeat(100*time.Second, &server)
+	if *discovery {
+		go connection.StartDiscoveryBeacon(&server, *name, *discoveryInterval)
+	}
 	connection.Start(&server)
 }
+
+// addAccount asks twice for the password of a user and saves its hash in the users file
+func addAccount(usersFile, username string) {
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Println(utils.InfoColor("Enter the password of " + username + ":"))
+	password, err := helper.ReadPassword(reader)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error reading the password: " + err.Error()))
+		return
+	}
+	fmt.Println(utils.InfoColor("Enter it again:"))
+	again, err := helper.ReadPassword(reader)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error reading the password: " + err.Error()))
+		return
+	}
+	if password == "" || password != again {
+		fmt.Println(utils.ErrorColor("❌ Error: the passwords are empty or do not match"))
+		return
+	}
+	if err := connection.AddAccount(usersFile, username, password); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error saving the user: " + err.Error()))
+		return
+	}
+	fmt.Println(utils.SuccessColor("✅ Saved the password of " + username + " in " + usersFile))
+}
@@ -1,16 +1,55 @@
 package interfaces
 
 import (
-	"net"
+	"ItShare/helper"
+	"ItShare/protocol"
+	"crypto/tls"
 	"sync"
+	"time"
 )
 
 type Server struct {
-	Address     string
-	Connections map[string]*User
-	IpAddresses map[string]*User
-	Messages    chan Message
-	Mutex       sync.Mutex
+	Address        string
+	QueueSize      int
+	WriteTimeout   time.Duration
+	OverflowPolicy OverflowPolicy
+	Connections    map[string]*User
+	Sessions       map[string]*User
+	Relays         map[string]*Relay
+	Rooms          map[string]*Room
+	NextRoomId     int
+	Grants         []*Grant
+	Messages       chan Message
+	Mutex          sync.Mutex
+	// Connections are served over TLS unless this is nil
+	TLSConfig *tls.Config
+	// Relayed data is held to a cap for the whole server and one for each sender
+	RelayLimit    *helper.RateLimiter
+	UserRelayRate int64
+	UserLimiters  map[string]*helper.RateLimiter
+	// Logins need the shared password, or the user's own from the users file, when
+	// either is set
+	Password      string
+	Accounts      map[string]helper.PasswordHash
+	LoginFailures map[string]*LoginFailures
+}
+
+// Grant lets one user answer a single request of another, such as a lookup listing,
+// a download or a resumed transfer, until it expires
+type Grant struct {
+	Purpose   string
+	FromId    string
+	ToId      string
+	RequestId string
+	Expires   time.Time
+}
+
+// LoginFailures counts the failed logins from one IP address, which is locked out for
+// a while once there are too many
+type LoginFailures struct {
+	Count       int
+	Last        time.Time
+	LockedUntil time.Time
 }
 
 type Message struct {
@@ -24,8 +63,50 @@ type User struct {
 	UserId        string
 	Username      string
 	StoreFilePath string
-	Conn          net.Conn
+	Conn          *protocol.Conn
+	Outbox        *Outbox
 	IsOnline      bool
 	IpAddress     string
+	SessionToken  string
+	ActiveRoomId  string
+	// Checksum algorithms the client announced, none for older clients
+	Hashes []string
+	// Public identity key the client published, used for end-to-end encryption
+	PublicKey string
 }
 
+// Room groups users for scoped chat and file sharing. Users join only when the owner
+// invited them or approved their request.
+type Room struct {
+	RoomId    string
+	Name      string
+	OwnerId   string
+	Members   map[string]*User
+	CreatedAt time.Time
+	// IDs of users the owner invited who have not joined yet
+	Invited map[string]bool
+	// Users who asked to join and wait for the owner's approval
+	Requests map[string]*User
+}
+
+// Relay tracks a transfer whose data frames are being forwarded from sender to recipient.
+// Each side attaches its own data connection, separate from its control connection.
+// An offered transfer carries no data until its recipient has accepted it. A file
+// split over parallel streams has one extra relay per stream beyond the first.
+// Either side may pause the transfer, which the relay tracks as the requests pass.
+type Relay struct {
+	TransferId      string
+	SenderId        string
+	RecipientId     string
+	Size            int64
+	Forwarded       int64
+	Accepted        bool
+	DirectToken     string
+	SenderConn      *protocol.Conn
+	RecipientConn   *protocol.Conn
+	RecipientReady  chan struct{}
+	Streams         map[int]*Relay
+	Parent          *Relay // the transfer's own relay, for the relay of an extra stream
+	SenderPaused    bool
+	RecipientPaused bool
+}
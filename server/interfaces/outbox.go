@@ -0,0 +1,145 @@
+package interfaces
+
+import (
+	"ItShare/protocol"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy decides what happens when a user's outbound queue is full
+type OverflowPolicy string
+
+const (
+	// OverflowDrop discards chat and heartbeat frames for a slow client.
+	// Control and data frames cannot be dropped safely and still disconnect it.
+	OverflowDrop OverflowPolicy = "drop"
+	// OverflowDisconnect closes the connection of a client that cannot keep up
+	OverflowDisconnect OverflowPolicy = "disconnect"
+)
+
+var (
+	// ErrOutboxClosed is returned when sending to a connection that has gone away
+	ErrOutboxClosed = errors.New("outbound queue closed")
+	// ErrOutboxFull is returned when a frame was dropped because the queue is full
+	ErrOutboxFull = errors.New("outbound queue full")
+)
+
+// Outbox is a bounded queue of frames written to one connection by a dedicated
+// goroutine, so a stalled peer never blocks the goroutine that queued the frame
+type Outbox struct {
+	frames       chan protocol.Frame
+	closed       chan struct{}
+	closeOnce    sync.Once
+	conn         *protocol.Conn
+	writeTimeout time.Duration
+	policy       OverflowPolicy
+	dropped      atomic.Int64
+}
+
+// NewOutbox creates the queue for conn and starts its writer
+func NewOutbox(conn *protocol.Conn, size int, writeTimeout time.Duration, policy OverflowPolicy) *Outbox {
+	outbox := &Outbox{
+		frames:       make(chan protocol.Frame, size),
+		closed:       make(chan struct{}),
+		conn:         conn,
+		writeTimeout: writeTimeout,
+		policy:       policy,
+	}
+	go outbox.writeLoop()
+	return outbox
+}
+
+func (o *Outbox) writeLoop() {
+	for {
+		select {
+		case frame := <-o.frames:
+			o.conn.SetWriteDeadline(time.Now().Add(o.writeTimeout))
+			if err := o.conn.Send(frame); err != nil {
+				fmt.Printf("Error writing to %s: %v\n", o.conn.RemoteAddr(), err)
+				o.Close()
+				return
+			}
+		case <-o.closed:
+			return
+		}
+	}
+}
+
+// Send queues a frame without blocking, applying the overflow policy when the queue is full
+func (o *Outbox) Send(frame protocol.Frame) error {
+	select {
+	case <-o.closed:
+		return ErrOutboxClosed
+	default:
+	}
+
+	select {
+	case o.frames <- frame:
+		return nil
+	case <-o.closed:
+		return ErrOutboxClosed
+	default:
+	}
+
+	if o.policy == OverflowDrop && droppable(frame) {
+		if o.dropped.Add(1)%100 == 1 {
+			fmt.Printf("Outbound queue for %s is full, dropping frames\n", o.conn.RemoteAddr())
+		}
+		return ErrOutboxFull
+	}
+
+	fmt.Printf("Outbound queue for %s is full, disconnecting\n", o.conn.RemoteAddr())
+	o.Close()
+	return ErrOutboxClosed
+}
+
+// SendWait queues a frame, waiting up to timeout for room. It is used for relayed
+// data so a slow recipient slows the sender down instead of losing bytes.
+func (o *Outbox) SendWait(frame protocol.Frame, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case o.frames <- frame:
+		return nil
+	case <-o.closed:
+		return ErrOutboxClosed
+	case <-timer.C:
+		fmt.Printf("Outbound queue for %s stayed full for %s, disconnecting\n", o.conn.RemoteAddr(), timeout)
+		o.Close()
+		return ErrOutboxClosed
+	}
+}
+
+// SendCommand queues a control command
+func (o *Outbox) SendCommand(command string) error {
+	return o.Send(protocol.Frame{Type: protocol.FrameCommand, Payload: []byte(command)})
+}
+
+// SendChat queues a chat message
+func (o *Outbox) SendChat(text string) error {
+	return o.Send(protocol.Frame{Type: protocol.FrameChat, Payload: []byte(text)})
+}
+
+// SendError queues an error message
+func (o *Outbox) SendError(message string) error {
+	return o.Send(protocol.Frame{Type: protocol.FrameError, Payload: []byte(message)})
+}
+
+// Close stops the writer and closes the connection, which also ends its read loop
+func (o *Outbox) Close() {
+	o.closeOnce.Do(func() {
+		close(o.closed)
+		o.conn.Close()
+	})
+}
+
+// droppable reports whether losing the frame only costs the user a message or a heartbeat
+func droppable(frame protocol.Frame) bool {
+	if frame.Type == protocol.FrameChat {
+		return true
+	}
+	return frame.Type == protocol.FrameCommand && string(frame.Payload) == "PING"
+}
@@ -0,0 +1,210 @@
+package connection
+
+import (
+	"ItShare/helper"
+	"ItShare/protocol"
+	"ItShare/server/interfaces"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// A login that needs a password goes:
+//
+//	client: /LOGIN <username> <storeFilePath>
+//	server: /AUTH_REQUIRED
+//	client: /PASSWORD <password>
+//	server: /AUTH_FAILED, and the client may try again, or /SESSION <token> <userId>
+//
+// Servers without a password answer /LOGIN with /SESSION right away.
+
+// How many passwords a client may try on one connection
+const maxPasswordTries = 3
+
+// Failed logins from one IP address within loginFailureWindow lock it out for
+// loginLockout once there are maxLoginFailures of them
+const (
+	maxLoginFailures   = 5
+	loginFailureWindow = 15 * time.Minute
+	loginLockout       = 5 * time.Minute
+)
+
+// How long the answer to a wrong password is held back, which slows down guessing
+const failedLoginDelay = time.Second
+
+// AuthRequired reports whether logging in to the server needs a password
+func AuthRequired(server *interfaces.Server) bool {
+	return server.Password != "" || len(server.Accounts) > 0
+}
+
+// LoadAccounts reads a users file, which maps usernames to their password hashes
+func LoadAccounts(path string) (map[string]helper.PasswordHash, error) {
+	accounts := make(map[string]helper.PasswordHash)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return accounts, nil
+	}
+	if err != nil {
+		return accounts, err
+	}
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return accounts, fmt.Errorf("corrupt users file %s: %v", path, err)
+	}
+	// Names are the same whatever their case, so two that differ only in it are one
+	// user with two passwords
+	for username := range accounts {
+		for other := range accounts {
+			if username < other && sameName(username, other) {
+				return accounts, fmt.Errorf("users file %s has both %s and %s, which are the same name", path, username, other)
+			}
+		}
+	}
+	return accounts, nil
+}
+
+// findAccount returns the password hash of username in accounts, whatever its case
+func findAccount(accounts map[string]helper.PasswordHash, username string) (helper.PasswordHash, bool) {
+	if hash, exists := accounts[username]; exists {
+		return hash, true
+	}
+	for name, hash := range accounts {
+		if sameName(name, username) {
+			return hash, true
+		}
+	}
+	return helper.PasswordHash{}, false
+}
+
+// AddAccount sets the password of a user in a users file, creating the file if needed
+func AddAccount(path, username, password string) error {
+	if err := validateUsername(username); err != nil {
+		return err
+	}
+	accounts, err := LoadAccounts(path)
+	if err != nil {
+		return err
+	}
+	hash, err := helper.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	// A name that only differs in case is the same user, whose password this replaces
+	for name := range accounts {
+		if sameName(name, username) {
+			delete(accounts, name)
+		}
+	}
+	accounts[username] = hash
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// checkPassword reports whether password lets username in. A user in the users file
+// needs their own password, whatever case they give their name in, anyone else the
+// shared one.
+func checkPassword(server *interfaces.Server, username, password string) bool {
+	if hash, exists := findAccount(server.Accounts, username); exists {
+		return hash.Verify(password)
+	}
+	if server.Password != "" {
+		return helper.PasswordsEqual(password, server.Password)
+	}
+	return false
+}
+
+// loginLockedFor returns how long logins from ip are still refused
+func loginLockedFor(server *interfaces.Server, ip string) time.Duration {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+	failures, exists := server.LoginFailures[ip]
+	if !exists {
+		return 0
+	}
+	return max(time.Until(failures.LockedUntil), 0)
+}
+
+// recordLoginFailure counts a failed login from ip and returns how long the address is
+// locked out because of it, zero while it may keep trying
+func recordLoginFailure(server *interfaces.Server, ip string) time.Duration {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+	now := time.Now()
+	for address, failures := range server.LoginFailures {
+		if now.Sub(failures.Last) > loginFailureWindow && now.After(failures.LockedUntil) {
+			delete(server.LoginFailures, address)
+		}
+	}
+
+	failures, exists := server.LoginFailures[ip]
+	if !exists {
+		failures = &interfaces.LoginFailures{}
+		server.LoginFailures[ip] = failures
+	}
+	failures.Count++
+	failures.Last = now
+	if failures.Count < maxLoginFailures {
+		return 0
+	}
+	failures.Count = 0
+	failures.LockedUntil = now.Add(loginLockout)
+	return loginLockout
+}
+
+// clearLoginFailures forgets the failed logins from ip after it logged in
+func clearLoginFailures(server *interfaces.Server, ip string) {
+	server.Mutex.Lock()
+	delete(server.LoginFailures, ip)
+	server.Mutex.Unlock()
+}
+
+// authenticate asks a client logging in as username for its password, reporting whether
+// it gave a right one. Clients that fail are told why before they are turned away.
+func authenticate(conn *protocol.Conn, server *interfaces.Server, username, ip string) bool {
+	if !AuthRequired(server) {
+		return true
+	}
+	if wait := loginLockedFor(server, ip); wait > 0 {
+		fmt.Printf("Refused login as %s from %s: locked out\n", username, ip)
+		_ = conn.SendError(fmt.Sprintf("Too many failed logins, try again in %s", wait.Round(time.Second)))
+		return false
+	}
+	if err := conn.SendCommand("/AUTH_REQUIRED"); err != nil {
+		return false
+	}
+
+	for try := 1; ; try++ {
+		frame, err := conn.Receive()
+		if err != nil {
+			return false
+		}
+		message := string(frame.Payload)
+		if !strings.HasPrefix(message, "/PASSWORD ") {
+			_ = conn.SendError("Invalid arguments. Use: /PASSWORD <password>")
+			return false
+		}
+		if checkPassword(server, username, strings.TrimPrefix(message, "/PASSWORD ")) {
+			clearLoginFailures(server, ip)
+			return true
+		}
+
+		fmt.Printf("Failed login as %s from %s\n", username, ip)
+		locked := recordLoginFailure(server, ip)
+		time.Sleep(failedLoginDelay)
+		switch {
+		case locked > 0:
+			_ = conn.SendError(fmt.Sprintf("Too many failed logins, try again in %s", locked.Round(time.Second)))
+			return false
+		case try >= maxPasswordTries:
+			_ = conn.SendError("Too many failed logins")
+			return false
+		}
+		if err := conn.SendCommand("/AUTH_FAILED"); err != nil {
+			return false
+		}
+	}
+}
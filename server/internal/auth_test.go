@@ -0,0 +1,53 @@
+package connection
+
+import (
+	"ItShare/helper"
+	"ItShare/server/interfaces"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := helper.HashPassword("alice-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &interfaces.Server{
+		Password: "shared",
+		Accounts: map[string]helper.PasswordHash{"Alice": hash},
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		want     bool
+	}{
+		{"account", "Alice", "alice-secret", true},
+		{"account in other case", "aLiCe", "alice-secret", true},
+		{"account with the shared password", "Alice", "shared", false},
+		{"account in other case with the shared password", "ALICE", "shared", false},
+		{"account with a wrong password", "alice", "wrong", false},
+		{"no account", "bob", "shared", true},
+		{"no account with a wrong password", "bob", "alice-secret", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkPassword(server, tt.username, tt.password); got != tt.want {
+				t.Fatalf("checkPassword(%q, %q) = %v, want %v", tt.username, tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadAccountsRefusesNamesDifferingInCase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	data := `{"alice": {"salt": "", "hash": "", "iterations": 1}, "ALICE": {"salt": "", "hash": "", "iterations": 1}}`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadAccounts(path); err == nil {
+		t.Fatal("LoadAccounts() accepted alice and ALICE")
+	}
+}
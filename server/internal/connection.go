@@ -2,13 +2,14 @@ package connection
 
 import (
 	"ItShare/helper"
+	"ItShare/protocol"
 	"ItShare/server/interfaces"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"strconv"
 	"strings"
 	"time"
-
 )
 
 func Connect(address string) (net.Listener, error) {
@@ -20,7 +21,7 @@ func Connect(address string) (net.Listener, error) {
 	return listener, nil
 }
 
-func Close(conn net.Conn) {
+func Close(conn *protocol.Conn) {
 	conn.Close()
 }
 
@@ -30,6 +31,9 @@ func Start(server *interfaces.Server) {
 		fmt.Println("error in listen")
 		panic(err)
 	}
+	if server.TLSConfig != nil {
+		listen = tls.NewListener(listen, server.TLSConfig)
+	}
 
 	defer listen.Close()
 	fmt.Println("Server started on", server.Address)
@@ -41,69 +45,127 @@ func Start(server *interfaces.Server) {
 			continue
 		}
 
-		go HandleConnection(conn, server)
+		go HandleConnection(protocol.NewConn(conn), server)
 	}
 }
 
-func HandleConnection(conn net.Conn, server *interfaces.Server) {
-	ipAddr := conn.RemoteAddr().String()
-	ip := strings.Split(ipAddr, ":")[0]
+func HandleConnection(conn *protocol.Conn, server *interfaces.Server) {
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		ip = conn.RemoteAddr().String()
+	}
 	fmt.Println("New connection from", ip)
-	if existingUser := server.IpAddresses[ip]; existingUser != nil {
-		fmt.Println("Connection already exists for IP:", ip)
-		// Send reconnection signal with existing user data
-		reconnectMsg := fmt.Sprintf("/RECONNECT %s %s", existingUser.Username, existingUser.StoreFilePath)
-		_, err := conn.Write([]byte(reconnectMsg))
-		if err != nil {
-			fmt.Println("Error sending reconnect signal:", err)
-			return
-		}
-
-		// Update connection and online status
-		server.Mutex.Lock()
-		existingUser.Conn = conn
-		existingUser.IsOnline = true
-		server.Mutex.Unlock()
 
-		// Encrypt and broadcast welcome back message
-		welcomeMsg := fmt.Sprintf("User %s has rejoined the chat", existingUser.Username)
-		BroadcastMessage(welcomeMsg, server, existingUser)
-
-		// Start handling messages for the reconnected user
-		handleUserMessages(conn, existingUser, server)
+	frame, err := conn.Receive()
+	if err != nil {
+		fmt.Println("error in read username")
 		return
 	}
 
-	buffer := make([]byte, 1024)
-	n, err := conn.Read(buffer)
-	if err != nil {
-		fmt.Println("error in read username")
+	// Transfer payloads arrive on connections of their own, see data.go
+	if message := string(frame.Payload); strings.HasPrefix(message, "/DATA ") {
+		HandleDataConnection(conn, server, message)
 		return
 	}
-	username := string(buffer[:n])
 
-	n, err = conn.Read(buffer)
+	// A returning client presents the token it was issued instead of logging in again
+	if message := string(frame.Payload); strings.HasPrefix(message, "/RESUME_SESSION ") {
+		token := strings.TrimSpace(strings.TrimPrefix(message, "/RESUME_SESSION "))
+		if existingUser := resumeSession(conn, server, token, ip); existingUser != nil {
+			// Restore the room indicator on the client
+			if room := activeRoom(server, existingUser); room != nil {
+				_ = existingUser.Outbox.SendCommand(fmt.Sprintf("/ROOM_SELECTED %s %s", room.RoomId, room.Name))
+			}
+
+			// Broadcast welcome back message
+			welcomeMsg := fmt.Sprintf("User %s has rejoined the chat", existingUser.Username)
+			BroadcastMessage(welcomeMsg, server, existingUser)
+
+			// Start handling messages for the reconnected user
+			handleUserMessages(conn, existingUser, server)
+			return
+		}
+
+		// Unknown token, fall back to a normal login
+		frame, err = conn.Receive()
+		if err != nil {
+			fmt.Println("error in read username")
+			return
+		}
+	}
+	var username, storeFilePath string
+	if message := string(frame.Payload); strings.HasPrefix(message, "/LOGIN ") {
+		parts := strings.SplitN(message, " ", 3)
+		username = strings.TrimSpace(parts[1])
+		if len(parts) == 3 {
+			storeFilePath = strings.TrimSpace(parts[2])
+		}
+		if err := validateUsername(username); err != nil {
+			conn.SendError("Invalid username: " + err.Error())
+			conn.Close()
+			return
+		}
+		if !authenticate(conn, server, username, ip) {
+			conn.Close()
+			return
+		}
+	} else {
+		// Older clients send their username and store path as two plain frames and
+		// cannot answer for a password
+		if AuthRequired(server) {
+			fmt.Println("Refused login without a password from", ip)
+			conn.SendError("This server requires a password, please update your client")
+			conn.Close()
+			return
+		}
+		username = strings.TrimSpace(message)
+		if err := validateUsername(username); err != nil {
+			conn.SendError("Invalid username: " + err.Error())
+			conn.Close()
+			return
+		}
+
+		frame, err = conn.Receive()
+		if err != nil {
+			fmt.Println("error in read storeFilePath")
+			return
+		}
+		storeFilePath = strings.TrimSpace(string(frame.Payload))
+	}
+
+	token, err := helper.GenerateSessionToken()
 	if err != nil {
-		fmt.Println("error in read storeFilePath")
+		fmt.Println("Error generating session token:", err)
+		conn.SendError("Server could not create a session")
 		return
 	}
-	storeFilePath := string(buffer[:n])
-
-	userId := helper.GenerateUserId()
 
 	user := &interfaces.User{
-		UserId:        userId,
 		Username:      username,
 		StoreFilePath: storeFilePath,
 		Conn:          conn,
+		Outbox:        interfaces.NewOutbox(conn, server.QueueSize, server.WriteTimeout, server.OverflowPolicy),
 		IsOnline:      true,
 		IpAddress:     ip,
+		SessionToken:  token,
 	}
 
-	server.Mutex.Lock()
-	server.Connections[user.UserId] = user
-	server.IpAddresses[ip] = user
-	server.Mutex.Unlock()
+	// authenticate only lets a name with an account in with that account's password
+	_, ownsName := findAccount(server.Accounts, username)
+	if err := registerUser(server, user, ownsName); err != nil {
+		fmt.Printf("Refused login as %s from %s: %v\n", username, ip, err)
+		// Nothing went through the outbox yet, so the error can be written directly
+		conn.SendError("Login failed: " + err.Error())
+		user.Outbox.Close()
+		return
+	}
+	userId := user.UserId
+
+	err = user.Outbox.SendCommand(fmt.Sprintf("/SESSION %s %s", token, userId))
+	if err != nil {
+		fmt.Println("Error sending session token:", err)
+		return
+	}
 
 	welcomeMsg := fmt.Sprintf("User %s has joined the chat", username)
 	BroadcastMessage(welcomeMsg, server, user)
@@ -114,142 +176,396 @@ func HandleConnection(conn net.Conn, server *interfaces.Server) {
 	handleUserMessages(conn, user, server)
 }
 
-func handleUserMessages(conn net.Conn, user *interfaces.User, server *interfaces.Server) {
+// resumeSession hands the identity behind token to conn. It returns nil and
+// tells the client to log in normally when the token is unknown.
+func resumeSession(conn *protocol.Conn, server *interfaces.Server, token, ip string) *interfaces.User {
+	server.Mutex.Lock()
+	existingUser := server.Sessions[token]
+	if existingUser == nil {
+		server.Mutex.Unlock()
+		fmt.Println("Rejected unknown session token from", ip)
+		_ = conn.SendCommand("/RESUME_FAILED")
+		return nil
+	}
+
+	// The token holder wins over a stale connection that has not timed out yet
+	previousOutbox := existingUser.Outbox
+	existingUser.Conn = conn
+	existingUser.Outbox = interfaces.NewOutbox(conn, server.QueueSize, server.WriteTimeout, server.OverflowPolicy)
+	existingUser.IsOnline = true
+	existingUser.IpAddress = ip
+	server.Mutex.Unlock()
+
+	if previousOutbox != nil {
+		previousOutbox.Close()
+	}
+	// Transfers streamed over the previous connection cannot continue on this one
+	interruptRelays(server, existingUser)
+
+	fmt.Printf("User %s (ID: %s) resumed their session from %s\n", existingUser.Username, existingUser.UserId, ip)
+
+	// Send reconnection signal with existing user data
+	reconnectMsg := fmt.Sprintf("/RECONNECT %s %s %s", existingUser.UserId, existingUser.Username, existingUser.StoreFilePath)
+	if err := existingUser.Outbox.SendCommand(reconnectMsg); err != nil {
+		fmt.Println("Error sending reconnect signal:", err)
+	}
+	return existingUser
+}
+
+func handleUserMessages(conn *protocol.Conn, user *interfaces.User, server *interfaces.Server) {
 	for {
-		buffer := make([]byte, 1024)
-		n, err := conn.Read(buffer)
+		frame, err := conn.Receive()
 		if err != nil {
-			fmt.Printf("User disconnected: %s\n", user.Username)
 			server.Mutex.Lock()
-			user.IsOnline = false
+			replaced := user.Conn != conn
+			if !replaced {
+				user.IsOnline = false
+			}
 			server.Mutex.Unlock()
+			if replaced {
+				// The session was resumed on a newer connection
+				return
+			}
+			user.Outbox.Close()
+			interruptRelays(server, user)
+			fmt.Printf("User disconnected: %s\n", user.Username)
 			offlineMsg := fmt.Sprintf("User %s is now offline", user.Username)
 			BroadcastMessage(offlineMsg, server, user)
 			return
 		}
 
-		messageContent := string(buffer[:n])
+		switch frame.Type {
+		case protocol.FrameData:
+			user.Outbox.SendError("File data must be sent on a data connection")
+			continue
+		case protocol.FrameChat:
+			// Chat stays inside the selected room, if any
+			if room := activeRoom(server, user); room != nil {
+				BroadcastRoomMessage(string(frame.Payload), server, room, user)
+			} else {
+				BroadcastMessage(string(frame.Payload), server, user)
+			}
+			continue
+		case protocol.FrameCommand:
+		default:
+			fmt.Printf("Ignoring %s frame from %s\n", frame.Type, user.Username)
+			continue
+		}
+
+		messageContent := string(frame.Payload)
 
 		switch {
 		case messageContent == "/exit":
 			server.Mutex.Lock()
 			user.IsOnline = false
 			server.Mutex.Unlock()
+			user.Outbox.Close()
+			interruptRelays(server, user)
+			// The user ended the session, so its token must not bring it back
+			server.Mutex.Lock()
+			retireUser(server, user)
+			server.Mutex.Unlock()
+			fmt.Printf("User %s (ID: %s) logged out\n", user.Username, user.UserId)
 			offlineMsg := fmt.Sprintf("User %s is now offline", user.Username)
 			BroadcastMessage(offlineMsg, server, user)
 			return
 		case strings.HasPrefix(messageContent, "/FILE_REQUEST"):
-			args := strings.SplitN(messageContent, " ", 5) // Updated to include checksum
+			args := strings.Fields(messageContent)
 			if len(args) < 4 {
-				fmt.Println("Invalid arguments. Use: /FILE_REQUEST <userId> <filename> <fileSize> [checksum]")
+				user.Outbox.SendError("Invalid arguments. Use: /FILE_REQUEST <userId> <filename> <fileSize> [checksum] [transferId] [directPort]")
 				continue
 			}
 			recipientId := args[1]
 			fileName := args[2]
-			fileSizeStr := strings.TrimSpace(args[3])
-			fileSize, err := strconv.ParseInt(fileSizeStr, 10, 64)
-			
-			// Include checksum in filename if provided
-			if len(args) == 5 {
-				checksum := strings.TrimSpace(args[4])
-				fileName = fileName + "|" + checksum
-			}
-			
+			fileSize, err := strconv.ParseInt(args[3], 10, 64)
 			if err != nil {
-				fmt.Println("Invalid fileSize. Use: /FILE_REQUEST <userId> <filename> <fileSize> [checksum]")
+				user.Outbox.SendError("Invalid fileSize. Use: /FILE_REQUEST <userId> <filename> <fileSize> [checksum] [transferId] [directPort]")
 				continue
 			}
 
-			HandleFileTransfer(server, conn, recipientId, fileName, fileSize)
+			// The checksum is "<algorithm>:<hex>", older clients send a bare MD5
+			checksum, transferId := "", ""
+			if len(args) >= 5 {
+				checksum = args[4]
+			}
+			if len(args) >= 6 {
+				transferId = args[5]
+			}
+			directPort := ""
+			if len(args) >= 7 {
+				directPort = args[6]
+			}
+
+			HandleFileTransfer(server, user, recipientId, fileName, fileSize, checksum, transferId, directPort)
 			continue
 		case strings.HasPrefix(messageContent, "/FOLDER_REQUEST"):
-			args := strings.SplitN(messageContent, " ", 5) // Updated to include checksum
+			args := strings.Fields(messageContent)
 			if len(args) < 4 {
-				fmt.Println("Invalid arguments. Use: /FOLDER_REQUEST <userId> <folderName> <folderSize> [checksum]")
+				user.Outbox.SendError("Invalid arguments. Use: /FOLDER_REQUEST <userId> <folderName> <folderSize> [checksum] [transferId] [directPort]")
 				continue
 			}
 			recipientId := args[1]
 			folderName := args[2]
-			folderSizeStr := strings.TrimSpace(args[3])
-			folderSize, err := strconv.ParseInt(folderSizeStr, 10, 64)
-			
-			// Include checksum in foldername if provided
-			if len(args) == 5 {
-				checksum := strings.TrimSpace(args[4])
-				folderName = folderName + "|" + checksum
-			}
-			
+			folderSize, err := strconv.ParseInt(args[3], 10, 64)
 			if err != nil {
-				fmt.Println("Invalid folderSize. Use: /FOLDER_REQUEST <userId> <folderName> <folderSize> [checksum]")
+				user.Outbox.SendError("Invalid folderSize. Use: /FOLDER_REQUEST <userId> <folderName> <folderSize> [checksum] [transferId] [directPort]")
 				continue
 			}
 
-			HandleFolderTransfer(server, conn, recipientId, folderName, folderSize)
+			checksum, transferId := "", ""
+			if len(args) >= 5 {
+				checksum = args[4]
+			}
+			if len(args) >= 6 {
+				transferId = args[5]
+			}
+			directPort := ""
+			if len(args) >= 7 {
+				directPort = args[6]
+			}
+
+			HandleFolderTransfer(server, user, recipientId, folderName, folderSize, checksum, transferId, directPort)
 			continue
-		case messageContent == "PONG\n":
+		case strings.HasPrefix(messageContent, "/FILE_RESUME"):
+			args := strings.Fields(messageContent)
+			if len(args) != 5 && len(args) != 6 {
+				user.Outbox.SendError("Invalid arguments. Use: /FILE_RESUME <userId> <transferId> <fileSize> <offset> [directPort]")
+				continue
+			}
+			fileSize, sizeErr := strconv.ParseInt(args[3], 10, 64)
+			offset, offsetErr := strconv.ParseInt(args[4], 10, 64)
+			if sizeErr != nil || offsetErr != nil || offset < 0 || offset > fileSize {
+				user.Outbox.SendError("Invalid fileSize or offset. Use: /FILE_RESUME <userId> <transferId> <fileSize> <offset> [directPort]")
+				continue
+			}
+			directPort := ""
+			if len(args) == 6 {
+				directPort = args[5]
+			}
+			HandleFileResume(server, user, args[1], args[2], fileSize, offset, directPort)
 			continue
-		case strings.HasPrefix(messageContent, "/status"):
-			_, err = conn.Write([]byte("USERS:"))
-			if err != nil {
-				fmt.Println("Error sending user list header:", err)
+		case strings.HasPrefix(messageContent, "/DIRECT_CONNECTED"), strings.HasPrefix(messageContent, "/DIRECT_FAILED"):
+			args := strings.Fields(messageContent)
+			if len(args) != 2 {
+				user.Outbox.SendError("Invalid arguments. Use: " + args[0] + " <transferId>")
+				continue
+			}
+			HandleDirectResult(server, user, args[1], args[0] == "/DIRECT_CONNECTED")
+			continue
+		case strings.HasPrefix(messageContent, "/USER_QUERY"):
+			args := strings.Fields(messageContent)
+			if len(args) != 2 {
+				user.Outbox.SendError("Invalid arguments. Use: /USER_QUERY <username|userId>")
+				continue
+			}
+			HandleUserQuery(server, user, args[1])
+			continue
+		case strings.HasPrefix(messageContent, "/PUBKEY_QUERY"):
+			args := strings.Fields(messageContent)
+			if len(args) != 2 {
+				user.Outbox.SendError("Invalid arguments. Use: /PUBKEY_QUERY <userId>")
+				continue
+			}
+			HandlePublicKeyQuery(server, user, args[1])
+			continue
+		case strings.HasPrefix(messageContent, "/PUBKEY"):
+			args := strings.Fields(messageContent)
+			if len(args) != 2 {
+				user.Outbox.SendError("Invalid arguments. Use: /PUBKEY <key>")
+				continue
+			}
+			HandlePublicKey(server, user, args[1])
+			continue
+		case strings.HasPrefix(messageContent, "/HASHES_QUERY"):
+			args := strings.Fields(messageContent)
+			if len(args) != 2 {
+				user.Outbox.SendError("Invalid arguments. Use: /HASHES_QUERY <userId>")
+				continue
+			}
+			HandleHashesQuery(server, user, args[1])
+			continue
+		case strings.HasPrefix(messageContent, "/HASHES"):
+			HandleHashes(server, user, strings.Fields(messageContent)[1:])
+			continue
+		case strings.HasPrefix(messageContent, "/TRANSFER_ACCEPT"), strings.HasPrefix(messageContent, "/TRANSFER_REJECT"):
+			args := strings.Fields(messageContent)
+			if len(args) != 2 {
+				user.Outbox.SendError("Invalid arguments. Use: " + args[0] + " <transferId>")
 				continue
 			}
+			HandleTransferAnswer(server, user, args[1], args[0] == "/TRANSFER_ACCEPT")
+			continue
+		case strings.HasPrefix(messageContent, "/TRANSFER_CANCEL"):
+			args := strings.Fields(messageContent)
+			if len(args) != 2 && len(args) != 3 {
+				user.Outbox.SendError("Invalid arguments. Use: /TRANSFER_CANCEL <transferId> [userId]")
+				continue
+			}
+			peerId := ""
+			if len(args) == 3 {
+				peerId = args[2]
+			}
+			HandleTransferCancel(server, user, args[1], peerId)
+			continue
+		case strings.HasPrefix(messageContent, "/RESUME_REQUEST"):
+			args := strings.Fields(messageContent)
+			if len(args) != 4 {
+				user.Outbox.SendError("Invalid arguments. Use: /RESUME_REQUEST <userId> <transferId> <offset>")
+				continue
+			}
+			offset, err := strconv.ParseInt(args[3], 10, 64)
+			if err != nil || offset < 0 {
+				user.Outbox.SendError("Invalid offset. Use: /RESUME_REQUEST <userId> <transferId> <offset>")
+				continue
+			}
+			HandleResumeRequest(server, user, args[1], args[2], offset)
+			continue
+		case strings.HasPrefix(messageContent, "/RESUME_OFFER"):
+			args := strings.Fields(messageContent)
+			if len(args) != 3 {
+				user.Outbox.SendError("Invalid arguments. Use: /RESUME_OFFER <userId> <transferId>")
+				continue
+			}
+			HandleResumeOffer(server, user, args[1], args[2])
+			continue
+		case strings.HasPrefix(messageContent, "/RESUME_UNAVAILABLE"):
+			args := strings.Fields(messageContent)
+			if len(args) != 3 {
+				user.Outbox.SendError("Invalid arguments. Use: /RESUME_UNAVAILABLE <userId> <transferId>")
+				continue
+			}
+			HandleResumeUnavailable(server, user, args[1], args[2])
+			continue
+		case messageContent == "PONG":
+			continue
+		case strings.HasPrefix(messageContent, "/status"):
+			var statusList strings.Builder
+			statusList.WriteString("USERS:\n")
+			server.Mutex.Lock()
 			for _, user := range server.Connections {
 				if user.IsOnline {
-					statusMsg := fmt.Sprintf("%s (%s) is online\n", user.Username, user.UserId)
-					_, err = conn.Write([]byte(statusMsg))
-					if err != nil {
-						fmt.Println("Error sending user list:", err)
-						continue
-					}
+					statusList.WriteString(fmt.Sprintf("%s [ID: %s] online\n", user.Username, user.UserId))
 				}
 			}
+			server.Mutex.Unlock()
+			err = user.Outbox.SendCommand(statusList.String())
+			if err != nil {
+				fmt.Println("Error sending user list:", err)
+			}
 			continue
 		case strings.HasPrefix(messageContent, "/LOOK"):
 			args := strings.SplitN(messageContent, " ", 2)
 			if len(args) != 2 {
-				fmt.Println("Invalid arguments. Use: /LOOK <userId>")
+				user.Outbox.SendError("Invalid arguments. Use: /LOOK <userId>")
 				continue
 			}
 			recipientId := strings.TrimSpace(args[1])
-			HandleLookupRequest(server, conn, recipientId)
+			HandleLookupRequest(server, user, recipientId)
 			continue
 		case strings.HasPrefix(messageContent, "/DIR_LISTING"):
 			args := strings.SplitN(messageContent, " ", 3)
 			if len(args) != 3 {
-				fmt.Println("Invalid arguments. Use: /DIR_LISTING <userId> <files>")
+				user.Outbox.SendError("Invalid arguments. Use: /DIR_LISTING <userId> <files>")
 				continue
 			}
-			userId := strings.TrimSpace(args[1])
-			files := strings.TrimSpace(args[2])
-			HandleLookupResponse(server, conn, userId, strings.Split(files, " "))
+			requesterId := strings.TrimSpace(args[1])
+			HandleLookupResponse(server, user, requesterId, args[2])
 			continue
 		case strings.HasPrefix(messageContent, "/DOWNLOAD_REQUEST"):
 			args := strings.SplitN(messageContent, " ", 3)
 			if len(args) != 3 {
-				fmt.Println("Invalid arguments. Use: /DOWNLOAD_REQUEST <userId> <filename>")
+				user.Outbox.SendError("Invalid arguments. Use: /DOWNLOAD_REQUEST <userId> <filename>")
 				continue
 			}
 			senderId := strings.TrimSpace(args[1])
 			recipientId := user.UserId
 			filePath := strings.TrimSpace(args[2])
-			HandleDownloadRequest(server, conn, senderId, recipientId, filePath)
+			HandleDownloadRequest(server, user, senderId, recipientId, filePath)
+			continue
+		case strings.HasPrefix(messageContent, "/DOWNLOAD_ERROR"):
+			args := strings.SplitN(messageContent, " ", 3)
+			if len(args) != 3 {
+				user.Outbox.SendError("Invalid arguments. Use: /DOWNLOAD_ERROR <userId> <reason>")
+				continue
+			}
+			HandleDownloadError(server, user, strings.TrimSpace(args[1]), args[2])
+			continue
+		case strings.HasPrefix(messageContent, "/createroom"):
+			args := strings.Fields(messageContent)
+			if len(args) < 3 {
+				user.Outbox.SendError("Invalid arguments. Use: /createroom <roomName> <userId1> [userId2] ...")
+				continue
+			}
+			if strings.Contains(args[1], "|") {
+				user.Outbox.SendError("Room names cannot contain '|'")
+				continue
+			}
+			HandleCreateRoom(server, user, args[1], args[2:])
+			continue
+		case strings.HasPrefix(messageContent, "/joinroom"):
+			args := strings.Fields(messageContent)
+			if len(args) != 2 {
+				user.Outbox.SendError("Invalid arguments. Use: /joinroom <roomId>")
+				continue
+			}
+			HandleJoinRoom(server, user, args[1])
+			continue
+		case strings.HasPrefix(messageContent, "/invite"):
+			args := strings.Fields(messageContent)
+			if len(args) != 3 {
+				user.Outbox.SendError("Invalid arguments. Use: /invite <roomId> <userId>")
+				continue
+			}
+			HandleInviteToRoom(server, user, args[1], args[2])
+			continue
+		case strings.HasPrefix(messageContent, "/leaveroom"):
+			args := strings.Fields(messageContent)
+			if len(args) != 2 {
+				user.Outbox.SendError("Invalid arguments. Use: /leaveroom <roomId>")
+				continue
+			}
+			HandleLeaveRoom(server, user, args[1])
+			continue
+		case strings.HasPrefix(messageContent, "/selectroom"):
+			args := strings.Fields(messageContent)
+			if len(args) != 2 {
+				user.Outbox.SendError("Invalid arguments. Use: /selectroom <roomId|global>")
+				continue
+			}
+			HandleSelectRoom(server, user, args[1])
+			continue
+		case messageContent == "/listrooms":
+			HandleListRooms(server, user)
+			continue
+		case strings.HasPrefix(messageContent, "/roominfo"):
+			args := strings.Fields(messageContent)
+			if len(args) != 2 {
+				user.Outbox.SendError("Invalid arguments. Use: /roominfo <roomId>")
+				continue
+			}
+			HandleRoomInfo(server, user, args[1])
 			continue
 		default:
-			BroadcastMessage(messageContent, server, user)
+			user.Outbox.SendError("Unknown command: " + strings.SplitN(messageContent, " ", 2)[0])
 		}
 	}
 }
 
-
 func BroadcastMessage(content string, server *interfaces.Server, sender *interfaces.User) {
+	// Only the map walk happens under the lock, the frames are queued afterwards
 	server.Mutex.Lock()
-	defer server.Mutex.Unlock()
+	outboxes := make([]*interfaces.Outbox, 0, len(server.Connections))
 	for _, recipient := range server.Connections {
 		if recipient.IsOnline && recipient != sender {
-			_, _ = recipient.Conn.Write([]byte(fmt.Sprintf("%s: %s\n", sender.Username, content)))
+			outboxes = append(outboxes, recipient.Outbox)
 		}
 	}
+	server.Mutex.Unlock()
+
+	message := fmt.Sprintf("%s: %s", sender.Username, content)
+	for _, outbox := range outboxes {
+		_ = outbox.SendChat(message)
+	}
 }
 
 func StartHeartBeat(interval time.Duration, server *interfaces.Server) {
@@ -257,22 +573,19 @@ func StartHeartBeat(interval time.Duration, server *interfaces.Server) {
 	go func() {
 		for range ticker.C {
 			server.Mutex.Lock()
+			outboxes := make([]*interfaces.Outbox, 0, len(server.Connections))
 			for _, user := range server.Connections {
 				if user.IsOnline {
-					_, err := user.Conn.Write([]byte("PING\n"))
-					if err != nil {
-						fmt.Printf("User disconnected: %s\n", user.Username)
-						user.IsOnline = false
-						BroadcastMessage(fmt.Sprintf("User %s is now offline", user.Username), server, user)
-					}
+					outboxes = append(outboxes, user.Outbox)
 				}
 			}
 			server.Mutex.Unlock()
+
+			// A peer that cannot take the ping is closed by its writer, and its
+			// read loop then reports it offline
+			for _, outbox := range outboxes {
+				_ = outbox.SendCommand("PING")
+			}
 		}
 	}()
 }
-
-
-
-
-
@@ -0,0 +1,324 @@
+package connection
+
+import (
+	"ItShare/helper"
+	"ItShare/protocol"
+	"ItShare/server/interfaces"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long a sender's data connection waits for the receiver to attach its own
+const dataAttachTimeout = 30 * time.Second
+
+// Most parallel streams relayed for a single transfer
+const maxRelayStreams = 16
+
+// HandleDataConnection attaches a connection opened for a single transfer to its relay.
+// The handshake is "/DATA <sessionToken> <transferId> <send|receive> [stream]", after
+// which the connection carries only the payload of that transfer. Streams beyond the
+// first belong to a file split over parallel connections and get relays of their own.
+func HandleDataConnection(conn *protocol.Conn, server *interfaces.Server, handshake string) {
+	args := strings.Fields(handshake)
+	stream := 0
+	if len(args) == 5 {
+		var err error
+		if stream, err = strconv.Atoi(args[4]); err != nil || stream < 1 || stream >= maxRelayStreams {
+			args = nil
+		}
+	}
+	if len(args) != 4 && len(args) != 5 {
+		_ = conn.SendError("Invalid arguments. Use: /DATA <sessionToken> <transferId> <send|receive> [stream]")
+		conn.Close()
+		return
+	}
+	token, transferId, role := args[1], args[2], args[3]
+
+	server.Mutex.Lock()
+	user := server.Sessions[token]
+	relay, exists := server.Relays[transferId]
+	var reason string
+	if exists && stream > 0 && user != nil {
+		if !relay.Accepted || (user.UserId != relay.SenderId && user.UserId != relay.RecipientId) {
+			reason = fmt.Sprintf("Cannot open stream %d of transfer %s", stream, transferId)
+		} else {
+			relay = streamRelay(relay, stream)
+		}
+	}
+	switch {
+	case reason != "":
+	case user == nil:
+		reason = "Unknown session"
+	case !exists:
+		reason = fmt.Sprintf("Transfer %s not found", transferId)
+	case role == "send" && !relay.Accepted:
+		reason = fmt.Sprintf("Transfer %s has not been accepted", transferId)
+	case role == "send" && relay.SenderId == user.UserId && relay.SenderConn == nil:
+		relay.SenderConn = conn
+	case role == "receive" && relay.RecipientId == user.UserId && relay.RecipientConn == nil:
+		relay.RecipientConn = conn
+		close(relay.RecipientReady)
+	default:
+		reason = fmt.Sprintf("Cannot %s data for transfer %s", role, transferId)
+	}
+	server.Mutex.Unlock()
+
+	if reason != "" {
+		fmt.Printf("Rejected data connection for %s: %s\n", transferId, reason)
+		_ = conn.SendError(reason)
+		conn.Close()
+		return
+	}
+
+	// The receiving side is only written to, by the sender's goroutine
+	if role == "send" {
+		pumpRelay(server, relay)
+	}
+}
+
+// pumpRelay forwards frames from the sender's data connection to the receiver's
+// until the sender closes it, then tears the relay down
+func pumpRelay(server *interfaces.Server, relay *interfaces.Relay) {
+	defer removeRelayIf(server, relay)
+
+	select {
+	case <-relay.RecipientReady:
+	case <-time.After(dataAttachTimeout):
+		fmt.Printf("Receiver of transfer %s never connected\n", relay.TransferId)
+		return
+	}
+
+	server.Mutex.Lock()
+	senderConn, recipientConn := relay.SenderConn, relay.RecipientConn
+	server.Mutex.Unlock()
+
+	go relayReplies(server, relay, recipientConn, senderConn)
+	limiters := relayLimiters(server, relay.SenderId)
+
+	for {
+		frame, err := senderConn.Receive()
+		if err != nil {
+			break
+		}
+
+		if frame.Type == protocol.FrameCommand {
+			trackPause(server, relay, relay.SenderId, string(frame.Payload))
+		}
+		if frame.Type == protocol.FrameData {
+			for _, limiter := range limiters {
+				limiter.WaitN(len(frame.Payload))
+			}
+		}
+		setRelayDeadline(server, relay, recipientConn)
+		if err := recipientConn.Send(frame); err != nil {
+			server.Mutex.Lock()
+			cancelled := server.Relays[relay.TransferId] != relay
+			server.Mutex.Unlock()
+			if cancelled {
+				return
+			}
+			fmt.Printf("Error relaying data to %s: %v\n", relay.RecipientId, err)
+			notifyInterrupted(server, relay.SenderId, relay.TransferId)
+			return
+		}
+
+		if frame.Type == protocol.FrameData {
+			if _, chunk, err := protocol.DecodeData(frame.Payload); err == nil {
+				server.Mutex.Lock()
+				relay.Forwarded += int64(len(chunk))
+				server.Mutex.Unlock()
+			}
+		}
+	}
+
+	server.Mutex.Lock()
+	forwarded := relay.Forwarded
+	server.Mutex.Unlock()
+	fmt.Printf("Transferred %d bytes from %s\n", forwarded, relay.SenderId)
+}
+
+// relayReplies forwards the receiver's commands back to the sender, such as its
+// verdict on the chunks it got. A receiver that goes away also cuts the sender off,
+// which may be waiting for that verdict rather than sending. After a cancel the
+// sender closes on its own, so it is not cut off before it has read the request.
+func relayReplies(server *interfaces.Server, relay *interfaces.Relay, recipientConn, senderConn *protocol.Conn) {
+	cancelled := false
+	for {
+		frame, err := recipientConn.Receive()
+		if err != nil {
+			if !cancelled {
+				senderConn.Close()
+			}
+			return
+		}
+		if frame.Type != protocol.FrameCommand {
+			continue
+		}
+		cancelled = cancelled || string(frame.Payload) == "/CANCEL"
+		trackPause(server, relay, relay.RecipientId, string(frame.Payload))
+		senderConn.SetWriteDeadline(time.Now().Add(server.WriteTimeout))
+		if err := senderConn.Send(frame); err != nil {
+			fmt.Printf("Error relaying reply to %s: %v\n", relay.SenderId, err)
+			return
+		}
+	}
+}
+
+// trackPause records a pause or resume passing through the relay. A paused receiver
+// stops reading, so writes to it lose their deadline until the transfer continues.
+func trackPause(server *interfaces.Server, relay *interfaces.Relay, userId, command string) {
+	paused := command == "/PAUSE"
+	if !paused && command != "/RESUME" {
+		return
+	}
+
+	server.Mutex.Lock()
+	if userId == relay.SenderId {
+		relay.SenderPaused = paused
+	} else {
+		relay.RecipientPaused = paused
+	}
+	conns := []*protocol.Conn{relay.RecipientConn}
+	for _, child := range relay.Streams {
+		conns = append(conns, child.RecipientConn)
+	}
+	server.Mutex.Unlock()
+
+	if paused {
+		fmt.Printf("Transfer %s paused by %s\n", relay.TransferId, userId)
+		for _, conn := range conns {
+			if conn != nil {
+				conn.SetWriteDeadline(time.Time{})
+			}
+		}
+	} else {
+		fmt.Printf("Transfer %s resumed by %s\n", relay.TransferId, userId)
+	}
+}
+
+// relayLimiters returns the caps a sender's relayed data is held to, the one for the
+// whole server and the sender's own
+func relayLimiters(server *interfaces.Server, senderId string) []*helper.RateLimiter {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+	limiter, exists := server.UserLimiters[senderId]
+	if !exists {
+		limiter = helper.NewRateLimiter(server.UserRelayRate)
+		server.UserLimiters[senderId] = limiter
+	}
+	return []*helper.RateLimiter{server.RelayLimit, limiter}
+}
+
+// setRelayDeadline bounds the next write to a receiver, unless the transfer is paused
+// and the receiver is expected to stop reading
+func setRelayDeadline(server *interfaces.Server, relay *interfaces.Relay, conn *protocol.Conn) {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+	if relay.Parent != nil {
+		relay = relay.Parent
+	}
+	if relay.SenderPaused || relay.RecipientPaused {
+		conn.SetWriteDeadline(time.Time{})
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(server.WriteTimeout))
+}
+
+// removeRelayIf removes the relay unless it has already been replaced, for
+// example by a resumed transfer reusing the same ID
+func removeRelayIf(server *interfaces.Server, relay *interfaces.Relay) {
+	server.Mutex.Lock()
+	if server.Relays[relay.TransferId] == relay {
+		delete(server.Relays, relay.TransferId)
+	}
+	server.Mutex.Unlock()
+	closeRelay(server, relay)
+}
+
+// streamRelay returns the relay of one extra stream of a transfer, creating it when the
+// first side attaches. Callers must hold server.Mutex.
+func streamRelay(relay *interfaces.Relay, stream int) *interfaces.Relay {
+	if relay.Streams == nil {
+		relay.Streams = make(map[int]*interfaces.Relay)
+	}
+	child, exists := relay.Streams[stream]
+	if !exists {
+		child = &interfaces.Relay{
+			TransferId:     relay.TransferId,
+			SenderId:       relay.SenderId,
+			RecipientId:    relay.RecipientId,
+			Accepted:       true,
+			RecipientReady: make(chan struct{}),
+			Parent:         relay,
+		}
+		relay.Streams[stream] = child
+	}
+	return child
+}
+
+// closeRelay closes whichever data connections are attached to a relay and its streams
+func closeRelay(server *interfaces.Server, relay *interfaces.Relay) {
+	server.Mutex.Lock()
+	conns := []*protocol.Conn{relay.SenderConn, relay.RecipientConn}
+	for _, child := range relay.Streams {
+		conns = append(conns, child.SenderConn, child.RecipientConn)
+	}
+	server.Mutex.Unlock()
+	for _, conn := range conns {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+// offerDirect lets the receiver try to reach the sender without the relay. The
+// endpoint is built from the address the server sees the sender on, so a sender
+// cannot point receivers at some other host. It returns the one-time token the
+// receiver must present, or "" when no direct connection was offered.
+func offerDirect(sender *interfaces.User, recipient *interfaces.Outbox, transferId, directPort string) string {
+	if directPort == "" || transferId == "" {
+		return ""
+	}
+	port, err := strconv.Atoi(directPort)
+	if err != nil || port < 1 || port > 65535 {
+		return ""
+	}
+	token, err := helper.GenerateSessionToken()
+	if err != nil {
+		return ""
+	}
+
+	endpoint := net.JoinHostPort(sender.IpAddress, directPort)
+	err = recipient.SendCommand(fmt.Sprintf("/DIRECT_OFFER %s %s %s", transferId, endpoint, token))
+	if err != nil {
+		return ""
+	}
+	return token
+}
+
+// HandleDirectResult is told by the receiver whether it reached the sender directly.
+// A direct transfer no longer needs its relay, a failed one makes the sender fall back to it.
+func HandleDirectResult(server *interfaces.Server, recipient *interfaces.User, transferId string, connected bool) {
+	server.Mutex.Lock()
+	relay, exists := server.Relays[transferId]
+	var sender *interfaces.Outbox
+	if exists {
+		sender = outboxOf(server.Connections[relay.SenderId])
+	}
+	server.Mutex.Unlock()
+	if !exists || relay.RecipientId != recipient.UserId || sender == nil {
+		return
+	}
+
+	if connected {
+		fmt.Printf("Transfer %s goes directly from %s to %s\n", transferId, relay.SenderId, relay.RecipientId)
+		removeRelayIf(server, relay)
+		return
+	}
+
+	fmt.Printf("Transfer %s falls back to the relay\n", transferId)
+	_ = sender.SendCommand(fmt.Sprintf("/DIRECT_FALLBACK %s", transferId))
+}
@@ -0,0 +1,102 @@
+package connection
+
+import (
+	"ItShare/protocol"
+	"ItShare/server/interfaces"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// StartDiscoveryBeacon broadcasts a beacon every interval so clients on the local
+// network can find the server without being told its address
+func StartDiscoveryBeacon(server *interfaces.Server, name string, interval time.Duration) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		fmt.Println("Error starting discovery beacon:", err)
+		return
+	}
+	defer conn.Close()
+
+	port := server.Address[strings.LastIndex(server.Address, ":")+1:]
+	fmt.Printf("Broadcasting discovery beacon as %q every %s\n", name, interval)
+	failing := false
+	for {
+		// Clients take the address the beacon came from, which is right for whichever
+		// network they are on
+		payload := protocol.EncodeBeacon(protocol.Beacon{
+			Port:    port,
+			Version: protocol.Version,
+			Users:   onlineUsers(server),
+			TLS:     server.TLSConfig != nil,
+			Name:    name,
+		})
+		var sendErr error
+		sent := false
+		for _, target := range broadcastAddresses() {
+			if _, err := conn.WriteToUDP(payload, target); err != nil {
+				sendErr = err
+				continue
+			}
+			sent = true
+		}
+		// Only report the first of a run of failures, the network may come back
+		if !sent && !failing {
+			fmt.Println("Error broadcasting discovery beacon:", sendErr)
+		}
+		failing = !sent
+
+		time.Sleep(interval)
+	}
+}
+
+// onlineUsers counts the users connected right now
+func onlineUsers(server *interfaces.Server) int {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+	count := 0
+	for _, user := range server.Connections {
+		if user.IsOnline {
+			count++
+		}
+	}
+	return count
+}
+
+// broadcastAddresses returns the broadcast address of every IPv4 network the server is
+// on, or the limited broadcast address when it finds none
+func broadcastAddresses() []*net.UDPAddr {
+	var targets []*net.UDPAddr
+	ifaces, err := net.Interfaces()
+	if err == nil {
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 {
+				continue
+			}
+			addrs, err := iface.Addrs()
+			if err != nil {
+				continue
+			}
+			for _, addr := range addrs {
+				network, ok := addr.(*net.IPNet)
+				if !ok || network.IP.To4() == nil {
+					continue
+				}
+				ip, mask := network.IP.To4(), net.IP(network.Mask).To4()
+				if mask == nil {
+					continue
+				}
+				broadcast := make(net.IP, net.IPv4len)
+				for i := range broadcast {
+					broadcast[i] = ip[i] | ^mask[i]
+				}
+				targets = append(targets, &net.UDPAddr{IP: broadcast, Port: protocol.DiscoveryPort})
+			}
+		}
+	}
+	if len(targets) == 0 {
+		targets = append(targets, &net.UDPAddr{IP: net.IPv4bcast, Port: protocol.DiscoveryPort})
+	}
+	return targets
+}
@@ -1,85 +1,214 @@
 package connection
 
 import (
+	"ItShare/helper"
 	"ItShare/server/interfaces"
 	"fmt"
-	"io"
-	"net"
 	"strings"
 )
 
-//sending file metadata including the checksum
-func HandleFileTransfer(server *interfaces.Server, conn net.Conn, recipientId, fileName string, fileSize int64) {
-	checksum := ""
-	fileNameWithChecksum := fileName
-	
-	parts := strings.SplitN(fileName, "|", 2)
-	if len(parts) == 2 {
-		fileName = parts[0]
-		checksum = parts[1]
+//sending file metadata including the checksum, then relaying the data frames that follow
+func HandleFileTransfer(server *interfaces.Server, sender *interfaces.User, recipientId, fileName string, fileSize int64, checksum, transferId, directPort string) {
+	if orNone(checksum) != "-" {
 		fmt.Println("Original checksum:", checksum)
 	}
-	
-	recipient, exists := server.Connections[recipientId]
-	if exists {
-		// Include checksum in response if available
-		_, err := recipient.Conn.Write([]byte(fmt.Sprintf("/FILE_RESPONSE %s %s %d %s", 
-		    recipientId, fileNameWithChecksum, fileSize, recipient.StoreFilePath)))
-		if err != nil {
-			fmt.Printf("Error sending file response to %s: %v\n", recipientId, err)
-		}
-		n, err := io.CopyN(recipient.Conn, conn, fileSize)
-		if err != nil {
-			fmt.Printf("Error receiving file from %s: %v\n", recipientId, err)
-		}
-		fmt.Printf("Transferred %d bytes from %s\n", n, recipientId)
-		if err != nil {
-			fmt.Printf("Error sending file to %s: %v\n", recipientId, err)
-		}
-	} else {
+	if err := helper.ValidateName(fileName); err != nil {
+		fmt.Printf("Refused file transfer from %s: %v\n", sender.UserId, err)
+		denyTransfer(sender.Outbox, transferId, err.Error())
+		return
+	}
+
+	recipient, recipientOutbox := onlineUser(server, recipientId)
+	if recipientOutbox == nil {
 		fmt.Printf("User %s not found\n", recipientId)
+		denyTransfer(sender.Outbox, transferId, fmt.Sprintf("User %s not found", recipientId))
+		return
+	}
+
+	if err := authorizeTransfer(server, sender, recipientId, downloadGrant, downloadOf(fileName)); err != nil {
+		fmt.Printf("Denied file transfer from %s to %s\n", sender.UserId, recipientId)
+		denyTransfer(sender.Outbox, transferId, err.Error())
+		return
+	}
+
+	if transferId != "" {
+		if err := registerRelay(server, transferId, sender.UserId, recipientId, fileSize, false); err != nil {
+			fmt.Printf("Refused file transfer from %s: %v\n", sender.UserId, err)
+			denyTransfer(sender.Outbox, transferId, err.Error())
+			return
+		}
+	}
+	directToken := offerDirect(sender, recipientOutbox, transferId, directPort)
+	awaitAnswer(server, transferId, directToken)
+
+	err := recipientOutbox.SendCommand(fmt.Sprintf("/FILE_RESPONSE %s %s %d %s %s %s",
+		sender.UserId, fileName, fileSize, orNone(transferId), orNone(checksum), recipient.StoreFilePath))
+	if err != nil {
+		fmt.Printf("Error sending file response to %s: %v\n", recipientId, err)
+		removeRelay(server, transferId)
+		denyTransfer(sender.Outbox, transferId, fmt.Sprintf("Could not reach user %s", recipientId))
+		return
 	}
+	// The sender hears back once the recipient accepts or rejects the offer
+	fmt.Printf("Offered file %s from %s to %s\n", transferId, sender.UserId, recipientId)
 }
 
-//sending the actual file
-func SendFile(server *interfaces.Server, senderId, recipientId, filePath string) {
-	server.Mutex.Lock()
-	defer server.Mutex.Unlock()
+// orNone fills an empty metadata field so the fields after it keep their place
+func orNone(field string) string {
+	if field == "" {
+		return "-"
+	}
+	return field
+}
 
-	_, exists := server.Connections[recipientId]
-	if !exists {
-		fmt.Printf("User %s not found\n", recipientId)
+// approveTransfer tells the sender it may start streaming data frames, passing on
+// the token a direct connection from the receiver will present, if one was offered
+func approveTransfer(sender *interfaces.Outbox, transferId, directToken string) {
+	if transferId == "" {
 		return
 	}
+	if directToken != "" {
+		_ = sender.SendCommand(fmt.Sprintf("/TRANSFER_READY %s %s", transferId, directToken))
+		return
+	}
+	_ = sender.SendCommand(fmt.Sprintf("/TRANSFER_READY %s", transferId))
+}
 
-	sender, exists := server.Connections[senderId]
-	if !exists {
-		fmt.Printf("User %s not found\n", senderId)
+// denyTransfer tells the sender why its transfer will not be relayed
+func denyTransfer(sender *interfaces.Outbox, transferId, reason string) {
+	if transferId == "" {
+		_ = sender.SendError(reason)
 		return
 	}
+	_ = sender.SendCommand(fmt.Sprintf("/TRANSFER_DENIED %s %s", transferId, reason))
+}
 
-	_, err := sender.Conn.Write([]byte(fmt.Sprintf("/sendfile %s %s\n", recipientId, filePath)))
-	if err != nil {
-		fmt.Printf("Error sending file to %s: %v\n", recipientId, err)
+// registerRelay prepares the relay of a transfer. accepted is false for offers
+// the recipient still has to answer. Senders pick transfer IDs, so one that is
+// already relayed is refused rather than taking over the other transfer.
+func registerRelay(server *interfaces.Server, transferId, senderId, recipientId string, size int64, accepted bool) error {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+	if _, exists := server.Relays[transferId]; exists {
+		return fmt.Errorf("transfer ID %s is already in use", transferId)
+	}
+	server.Relays[transferId] = &interfaces.Relay{
+		TransferId:     transferId,
+		SenderId:       senderId,
+		RecipientId:    recipientId,
+		Size:           size,
+		Accepted:       accepted,
+		RecipientReady: make(chan struct{}),
+	}
+	return nil
+}
+
+func removeRelay(server *interfaces.Server, transferId string) {
+	server.Mutex.Lock()
+	relay := server.Relays[transferId]
+	delete(server.Relays, transferId)
+	server.Mutex.Unlock()
+	if relay != nil {
+		closeRelay(server, relay)
 	}
 }
 
 //sending download req
-func HandleDownloadRequest(server *interfaces.Server, conn net.Conn, senderId, recipientId, filePath string) {
-	sender, exists := server.Connections[senderId]
-	if !exists {
+func HandleDownloadRequest(server *interfaces.Server, requester *interfaces.User, senderId, recipientId, filePath string) {
+	sender, senderOutbox := onlineUser(server, senderId)
+	if sender == nil {
 		fmt.Printf("User %s not found\n", senderId)
+		requester.Outbox.SendError(fmt.Sprintf("User %s not found", senderId))
 		return
 	}
 
-	if !sender.IsOnline {
+	if senderOutbox == nil {
 		fmt.Printf("User %s is not online\n", senderId)
+		requester.Outbox.SendError(fmt.Sprintf("User %s is not online", senderId))
 		return
 	}
 
-	_, err := sender.Conn.Write([]byte(fmt.Sprintf("/DOWNLOAD_REQUEST %s %s\n", recipientId, filePath)))
+	if _, err := authorizeRoomAccess(server, requester, senderId); err != nil {
+		fmt.Printf("Denied download by %s from %s\n", requester.UserId, senderId)
+		requester.Outbox.SendError(err.Error())
+		return
+	}
+	// The owner answers with a regular file or folder send back to the requester
+	grantAccess(server, downloadGrant, senderId, recipientId, filePath)
+
+	err := senderOutbox.SendCommand(fmt.Sprintf("/DOWNLOAD_REQUEST %s %s", recipientId, filePath))
 	if err != nil {
 		fmt.Printf("Error sending file request to %s: %v\n", senderId, err)
+		return
 	}
 	fmt.Println("Download request sent successfully")
 }
+
+// HandleDownloadError passes the reason a download was refused on to the user who asked
+// for it. The reason starts with the path that was asked for.
+func HandleDownloadError(server *interfaces.Server, owner *interfaces.User, requesterId, reason string) {
+	// Only answers to an authorized /download are forwarded, and they use up its grant
+	answers := func(requested string) bool { return strings.HasPrefix(reason, requested+": ") }
+	if !consumeGrant(server, downloadGrant, owner.UserId, requesterId, answers) {
+		fmt.Printf("Dropping unrequested download error from %s to %s\n", owner.UserId, requesterId)
+		return
+	}
+
+	_, requester := onlineUser(server, requesterId)
+	if requester == nil {
+		return
+	}
+	fmt.Printf("Download by %s from %s refused: %s\n", requesterId, owner.UserId, reason)
+	_ = requester.SendError(fmt.Sprintf("Download from %s failed: %s", owner.UserId, reason))
+}
+
+// HandleHashes records the checksum algorithms a client supports
+func HandleHashes(server *interfaces.Server, user *interfaces.User, hashes []string) {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+	user.Hashes = hashes
+}
+
+// HandleHashesQuery tells a sender which checksum algorithms a recipient announced,
+// so both can agree on the strongest one before anything is hashed
+func HandleHashesQuery(server *interfaces.Server, requester *interfaces.User, userId string) {
+	server.Mutex.Lock()
+	user, exists := server.Connections[userId]
+	var hashes []string
+	if exists {
+		hashes = user.Hashes
+	}
+	server.Mutex.Unlock()
+
+	reply := "/HASHES_OF " + userId
+	if len(hashes) > 0 {
+		reply += " " + strings.Join(hashes, " ")
+	}
+	_ = requester.Outbox.SendCommand(reply)
+}
+
+// HandlePublicKey records the public identity key a client published. The server only
+// passes it on, the matching private key never leaves the client.
+func HandlePublicKey(server *interfaces.Server, user *interfaces.User, key string) {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+	user.PublicKey = key
+}
+
+// HandlePublicKeyQuery tells a client the public key a user published, so both sides
+// of a transfer can derive its key
+func HandlePublicKeyQuery(server *interfaces.Server, requester *interfaces.User, userId string) {
+	server.Mutex.Lock()
+	user, exists := server.Connections[userId]
+	var key string
+	if exists {
+		key = user.PublicKey
+	}
+	server.Mutex.Unlock()
+
+	reply := "/PUBKEY_OF " + userId
+	if key != "" {
+		reply += " " + key
+	}
+	_ = requester.Outbox.SendCommand(reply)
+}
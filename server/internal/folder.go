@@ -1,62 +1,86 @@
 package connection
 
 import (
+	"ItShare/helper"
 	"ItShare/server/interfaces"
 	"fmt"
-	"io"
-	"net"
-	"strings"
 )
 
-func HandleFolderTransfer(server *interfaces.Server, conn net.Conn, recipientId, folderName string, folderSize int64) {
-	recipient, exists := server.Connections[recipientId]
-	if exists {
-		// Send folder transfer response to recipient
-		_, err := recipient.Conn.Write([]byte(fmt.Sprintf("/FOLDER_RESPONSE %s %s %d %s", recipientId, folderName, folderSize, recipient.StoreFilePath)))
-		if err != nil {
-			fmt.Printf("Error sending folder response to %s: %v\n", recipientId, err)
-			return
-		}
+func HandleFolderTransfer(server *interfaces.Server, sender *interfaces.User, recipientId, folderName string, folderSize int64, checksum, transferId, directPort string) {
+	if err := helper.ValidateName(folderName); err != nil {
+		fmt.Printf("Refused folder transfer from %s: %v\n", sender.UserId, err)
+		denyTransfer(sender.Outbox, transferId, err.Error())
+		return
+	}
 
-		// Forward the zipped folder data from sender to recipient
-		n, err := io.CopyN(recipient.Conn, conn, folderSize)
-		if err != nil {
-			fmt.Printf("Error transferring folder data: %v\n", err)
+	recipient, recipientOutbox := onlineUser(server, recipientId)
+	if recipientOutbox == nil {
+		fmt.Printf("User %s not found\n", recipientId)
+		denyTransfer(sender.Outbox, transferId, fmt.Sprintf("User %s not found", recipientId))
+		return
+	}
+
+	if err := authorizeTransfer(server, sender, recipientId, downloadGrant, downloadOf(folderName)); err != nil {
+		fmt.Printf("Denied folder transfer from %s to %s\n", sender.UserId, recipientId)
+		denyTransfer(sender.Outbox, transferId, err.Error())
+		return
+	}
+
+	if transferId != "" {
+		if err := registerRelay(server, transferId, sender.UserId, recipientId, folderSize, false); err != nil {
+			fmt.Printf("Refused folder transfer from %s: %v\n", sender.UserId, err)
+			denyTransfer(sender.Outbox, transferId, err.Error())
 			return
 		}
-		fmt.Printf("Transferred %d bytes of folder data\n", n)
-	} else {
-		fmt.Printf("User %s not found\n", recipientId)
 	}
+	directToken := offerDirect(sender, recipientOutbox, transferId, directPort)
+	awaitAnswer(server, transferId, directToken)
+
+	// Send folder transfer response to recipient, the archive stream follows once it is accepted
+	err := recipientOutbox.SendCommand(fmt.Sprintf("/FOLDER_RESPONSE %s %s %d %s %s %s",
+		sender.UserId, folderName, folderSize, orNone(transferId), orNone(checksum), recipient.StoreFilePath))
+	if err != nil {
+		fmt.Printf("Error sending folder response to %s: %v\n", recipientId, err)
+		removeRelay(server, transferId)
+		denyTransfer(sender.Outbox, transferId, fmt.Sprintf("Could not reach user %s", recipientId))
+		return
+	}
+	fmt.Printf("Offered folder %s from %s to %s\n", transferId, sender.UserId, recipientId)
 }
 
-func HandleLookupRequest(server *interfaces.Server, conn net.Conn, userId string) {
-	recipient, exists := server.Connections[userId]
-	fmt.Printf("StoreFilePath: %s\n", recipient.StoreFilePath)
-	if !exists {
+func HandleLookupRequest(server *interfaces.Server, requester *interfaces.User, userId string) {
+	recipient, recipientOutbox := onlineUser(server, userId)
+	if recipient == nil {
 		fmt.Printf("User %s not found\n", userId)
-		_, err := conn.Write([]byte(fmt.Sprintf("User %s not found\n", userId)))
+		err := requester.Outbox.SendError(fmt.Sprintf("User %s not found", userId))
 		if err != nil {
 			fmt.Printf("Error sending lookup response: %v\n", err)
 		}
 		return
 	}
 
-	if !recipient.IsOnline {
+	if recipientOutbox == nil {
 		fmt.Printf("User %s is not online\n", userId)
-		_, err := conn.Write([]byte(fmt.Sprintf("User %s is not online\n", userId)))
+		err := requester.Outbox.SendError(fmt.Sprintf("User %s is not online", userId))
 		if err != nil {
 			fmt.Printf("Error sending lookup response: %v\n", err)
 		}
 		return
 	}
 
-	// Send the lookup request to the recipient's connection
+	if _, err := authorizeRoomAccess(server, requester, userId); err != nil {
+		fmt.Printf("Denied lookup by %s of %s\n", requester.UserId, userId)
+		requester.Outbox.SendError(err.Error())
+		return
+	}
+	grantAccess(server, lookupGrant, userId, requester.UserId, "")
+
+	// Send the lookup request to the recipient's connection, naming who asked
 	fmt.Printf("StoreFilePath: %s\n", recipient.StoreFilePath)
-	_, err := recipient.Conn.Write([]byte(fmt.Sprintf("/LOOK_REQUEST %s %s\n", userId, recipient.StoreFilePath)))
+	err := recipientOutbox.SendCommand(fmt.Sprintf("/LOOK_REQUEST %s %s", requester.UserId, recipient.StoreFilePath))
 	if err != nil {
 		fmt.Printf("Error sending lookup request to recipient: %v\n", err)
-		_, respErr := conn.Write([]byte(fmt.Sprintf("Error looking up user %s's directory\n", userId)))
+		respErr := requester.Outbox.SendError(fmt.Sprintf("Error looking up user %s's directory", userId))
 		if respErr != nil {
 			fmt.Printf("Error sending error response: %v\n", respErr)
 		}
@@ -66,8 +90,20 @@ func HandleLookupRequest(server *interfaces.Server, conn net.Conn, userId string
 	fmt.Printf("Lookup request sent to user %s\n", userId)
 }
 
-func HandleLookupResponse(server *interfaces.Server, conn net.Conn, userId string, files []string) {
-	_, err := conn.Write([]byte(fmt.Sprintf("LOOK_RESPONSE %s %s\n", userId, strings.Join(files, " "))))
+func HandleLookupResponse(server *interfaces.Server, owner *interfaces.User, requesterId string, listing string) {
+	_, requester := onlineUser(server, requesterId)
+	if requester == nil {
+		fmt.Printf("User %s not found\n", requesterId)
+		return
+	}
+
+	// Only listings that answer an authorized /LOOK are forwarded
+	if !consumeGrant(server, lookupGrant, owner.UserId, requesterId, isRequest("")) {
+		fmt.Printf("Dropping unrequested listing from %s to %s\n", owner.UserId, requesterId)
+		return
+	}
+
+	err := requester.SendCommand(fmt.Sprintf("/LOOK_RESPONSE %s %s", owner.UserId, listing))
 	if err != nil {
 		fmt.Printf("Error sending lookup response: %v\n", err)
 		return
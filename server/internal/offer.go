@@ -0,0 +1,121 @@
+package connection
+
+import (
+	"ItShare/server/interfaces"
+	"fmt"
+	"time"
+)
+
+// How long a recipient has to accept or reject an offered transfer
+const offerTimeout = 2 * time.Minute
+
+// awaitAnswer holds an offered transfer until its recipient answers it or the offer expires.
+// The direct connection token is kept for the sender until then.
+func awaitAnswer(server *interfaces.Server, transferId, directToken string) {
+	if transferId == "" {
+		return
+	}
+	server.Mutex.Lock()
+	relay, exists := server.Relays[transferId]
+	if exists {
+		relay.DirectToken = directToken
+	}
+	server.Mutex.Unlock()
+	if !exists {
+		return
+	}
+
+	time.AfterFunc(offerTimeout, func() {
+		server.Mutex.Lock()
+		pending := server.Relays[transferId] == relay && !relay.Accepted
+		if pending {
+			delete(server.Relays, transferId)
+		}
+		server.Mutex.Unlock()
+		if pending {
+			fmt.Printf("Offer %s expired without an answer\n", transferId)
+			closeRelay(server, relay)
+			closeOffer(server, relay, "not answered in time")
+		}
+	})
+}
+
+// HandleTransferAnswer lets the recipient of an offer accept or reject it. An
+// accepted offer lets the sender start streaming, a rejected one is dropped.
+func HandleTransferAnswer(server *interfaces.Server, recipient *interfaces.User, transferId string, accepted bool) {
+	server.Mutex.Lock()
+	relay, exists := server.Relays[transferId]
+	pending := exists && relay.RecipientId == recipient.UserId && !relay.Accepted
+	var sender *interfaces.Outbox
+	if pending {
+		sender = outboxOf(server.Connections[relay.SenderId])
+		if accepted {
+			relay.Accepted = true
+		} else {
+			delete(server.Relays, transferId)
+		}
+	}
+	server.Mutex.Unlock()
+
+	if !pending {
+		_ = recipient.Outbox.SendError(fmt.Sprintf("No pending transfer %s", transferId))
+		return
+	}
+
+	if !accepted {
+		fmt.Printf("%s rejected transfer %s\n", recipient.Username, transferId)
+		closeRelay(server, relay)
+		if sender != nil {
+			denyTransfer(sender, transferId, fmt.Sprintf("Rejected by %s", recipient.Username))
+		}
+		return
+	}
+
+	fmt.Printf("%s accepted transfer %s\n", recipient.Username, transferId)
+	if sender != nil {
+		approveTransfer(sender, transferId, relay.DirectToken)
+	}
+}
+
+// closeOffer tells both sides that an unanswered offer is gone and why
+func closeOffer(server *interfaces.Server, relay *interfaces.Relay, reason string) {
+	server.Mutex.Lock()
+	sender := outboxOf(server.Connections[relay.SenderId])
+	recipient := outboxOf(server.Connections[relay.RecipientId])
+	server.Mutex.Unlock()
+
+	if sender != nil {
+		denyTransfer(sender, relay.TransferId, fmt.Sprintf("Offer to %s closed: %s", relay.RecipientId, reason))
+	}
+	if recipient != nil {
+		_ = recipient.SendCommand(fmt.Sprintf("/OFFER_CLOSED %s %s", relay.TransferId, reason))
+	}
+}
+
+// HandleTransferCancel ends an offer or a running transfer on behalf of one of its sides
+// and tells the other side. Transfers the server no longer relays, such as direct or
+// interrupted ones, name the peer themselves. The data connections of a running
+// transfer are closed by the clients once both know, see relayReplies.
+func HandleTransferCancel(server *interfaces.Server, user *interfaces.User, transferId, peerId string) {
+	server.Mutex.Lock()
+	relay, exists := server.Relays[transferId]
+	if exists && (relay.SenderId == user.UserId || relay.RecipientId == user.UserId) {
+		delete(server.Relays, transferId)
+		peerId = relay.RecipientId
+		if user.UserId == relay.RecipientId {
+			peerId = relay.SenderId
+		}
+	} else {
+		exists = false
+	}
+	peer := outboxOf(server.Connections[peerId])
+	server.Mutex.Unlock()
+
+	if exists && !relay.Accepted {
+		closeRelay(server, relay)
+	}
+	fmt.Printf("%s cancelled transfer %s\n", user.Username, transferId)
+	if peer != nil {
+		_ = peer.SendCommand(fmt.Sprintf("/TRANSFER_CANCELLED %s %s", user.UserId, transferId))
+	}
+}
@@ -0,0 +1,137 @@
+package connection
+
+import (
+	"ItShare/server/interfaces"
+	"fmt"
+)
+
+// HandleResumeRequest forwards a receiver's request to continue a transfer from
+// an offset to the original sender. The request counts as the receiver's consent,
+// so the sender's /FILE_RESUME is allowed even outside a shared room.
+func HandleResumeRequest(server *interfaces.Server, receiver *interfaces.User, senderId, transferId string, offset int64) {
+	sender, senderOutbox := onlineUser(server, senderId)
+	if sender == nil {
+		receiver.Outbox.SendError(fmt.Sprintf("User %s not found, cannot resume transfer %s", senderId, transferId))
+		return
+	}
+	if senderOutbox == nil {
+		// The sender offers the transfer again when it reconnects
+		fmt.Printf("Resume of %s waits for %s to come back online\n", transferId, senderId)
+		return
+	}
+
+	grantAccess(server, resumeGrant, senderId, receiver.UserId, transferId)
+	err := senderOutbox.SendCommand(fmt.Sprintf("/RESUME_REQUEST %s %s %d", receiver.UserId, transferId, offset))
+	if err != nil {
+		fmt.Printf("Error sending resume request to %s: %v\n", senderId, err)
+	}
+}
+
+// HandleResumeOffer lets a sender that just reconnected remind the receiver of an unfinished transfer
+func HandleResumeOffer(server *interfaces.Server, sender *interfaces.User, recipientId, transferId string) {
+	_, recipient := onlineUser(server, recipientId)
+	if recipient == nil {
+		return
+	}
+	_ = recipient.SendCommand(fmt.Sprintf("/RESUME_OFFER %s %s", sender.UserId, transferId))
+}
+
+// HandleResumeUnavailable tells the other side of a transfer that it cannot be continued,
+// so the receiver drops its partial file or the sender forgets the file
+func HandleResumeUnavailable(server *interfaces.Server, user *interfaces.User, peerId, transferId string) {
+	// A sender that declines does not need the grant given by the resume request
+	consumeGrant(server, resumeGrant, user.UserId, peerId, isRequest(transferId))
+
+	_, peer := onlineUser(server, peerId)
+	if peer == nil {
+		return
+	}
+	_ = peer.SendCommand(fmt.Sprintf("/RESUME_UNAVAILABLE %s %s", user.UserId, transferId))
+}
+
+// HandleFileResume relays the remainder of a file, starting at offset, under its original transfer ID
+func HandleFileResume(server *interfaces.Server, sender *interfaces.User, recipientId, transferId string, fileSize, offset int64, directPort string) {
+	_, recipient := onlineUser(server, recipientId)
+	if recipient == nil {
+		denyTransfer(sender.Outbox, transferId, fmt.Sprintf("User %s not found", recipientId))
+		return
+	}
+
+	if err := authorizeTransfer(server, sender, recipientId, resumeGrant, isRequest(transferId)); err != nil {
+		fmt.Printf("Denied resume of %s from %s to %s\n", transferId, sender.UserId, recipientId)
+		denyTransfer(sender.Outbox, transferId, err.Error())
+		return
+	}
+
+	// The receiver asked for the rest itself, so there is no offer to answer
+	if err := registerRelay(server, transferId, sender.UserId, recipientId, fileSize-offset, true); err != nil {
+		fmt.Printf("Refused resume of %s from %s: %v\n", transferId, sender.UserId, err)
+		denyTransfer(sender.Outbox, transferId, err.Error())
+		return
+	}
+	directToken := offerDirect(sender, recipient, transferId, directPort)
+
+	err := recipient.SendCommand(fmt.Sprintf("/RESUME_RESPONSE %s %s %d", sender.UserId, transferId, offset))
+	if err != nil {
+		fmt.Printf("Error sending resume response to %s: %v\n", recipientId, err)
+		removeRelay(server, transferId)
+		denyTransfer(sender.Outbox, transferId, fmt.Sprintf("Could not reach user %s", recipientId))
+		return
+	}
+	fmt.Printf("Resuming transfer %s from %s at byte %d\n", transferId, sender.UserId, offset)
+	approveTransfer(sender.Outbox, transferId, directToken)
+}
+
+// interruptRelays drops the relays a user takes part in and tells the other side,
+// so a sender stops streaming and a receiver keeps its partial file for later
+func interruptRelays(server *interfaces.Server, user *interfaces.User) {
+	type interruption struct {
+		transferId string
+		peerId     string
+	}
+
+	server.Mutex.Lock()
+	var interrupted []interruption
+	var withdrawn []*interfaces.Relay
+	var relays []*interfaces.Relay
+	for transferId, relay := range server.Relays {
+		if !relay.Accepted && (relay.SenderId == user.UserId || relay.RecipientId == user.UserId) {
+			// Nothing was sent yet, the offer simply goes away
+			withdrawn = append(withdrawn, relay)
+			delete(server.Relays, transferId)
+			continue
+		}
+		switch user.UserId {
+		case relay.SenderId:
+			interrupted = append(interrupted, interruption{transferId, relay.RecipientId})
+		case relay.RecipientId:
+			interrupted = append(interrupted, interruption{transferId, relay.SenderId})
+		default:
+			continue
+		}
+		relays = append(relays, relay)
+		delete(server.Relays, transferId)
+	}
+	server.Mutex.Unlock()
+
+	for _, relay := range relays {
+		closeRelay(server, relay)
+	}
+	for _, relay := range withdrawn {
+		closeRelay(server, relay)
+		closeOffer(server, relay, fmt.Sprintf("%s went offline", user.Username))
+	}
+	for _, i := range interrupted {
+		fmt.Printf("Transfer %s interrupted, %s disconnected\n", i.transferId, user.Username)
+		notifyInterrupted(server, i.peerId, i.transferId)
+	}
+}
+
+// notifyInterrupted tells a user that one of its transfers lost its other side
+func notifyInterrupted(server *interfaces.Server, userId, transferId string) {
+	_, peer := onlineUser(server, userId)
+	if peer == nil {
+		return
+	}
+	_ = peer.SendCommand(fmt.Sprintf("/TRANSFER_INTERRUPTED %s", transferId))
+}
@@ -0,0 +1,446 @@
+package connection
+
+import (
+	"ItShare/server/interfaces"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HandleCreateRoom creates a room owned by the user and invites the given users to
+// it. They become members only once they accept with /joinroom.
+func HandleCreateRoom(server *interfaces.Server, owner *interfaces.User, roomName string, inviteeIds []string) {
+	server.Mutex.Lock()
+	var missing []string
+	var invitees []*interfaces.User
+	for _, inviteeId := range inviteeIds {
+		invitee, exists := server.Connections[inviteeId]
+		if !exists {
+			missing = append(missing, inviteeId)
+			continue
+		}
+		if invitee != owner {
+			invitees = append(invitees, invitee)
+		}
+	}
+	if len(missing) > 0 {
+		server.Mutex.Unlock()
+		owner.Outbox.SendError(fmt.Sprintf("Cannot create room %s, unknown users: %s", roomName, strings.Join(missing, ", ")))
+		return
+	}
+
+	room := &interfaces.Room{
+		RoomId:    strconv.Itoa(server.NextRoomId),
+		Name:      roomName,
+		OwnerId:   owner.UserId,
+		Members:   map[string]*interfaces.User{owner.UserId: owner},
+		CreatedAt: time.Now(),
+		Invited:   make(map[string]bool),
+		Requests:  make(map[string]*interfaces.User),
+	}
+	var notify []*interfaces.Outbox
+	for _, invitee := range invitees {
+		room.Invited[invitee.UserId] = true
+		if invitee.IsOnline {
+			notify = append(notify, invitee.Outbox)
+		}
+	}
+	server.NextRoomId++
+	server.Rooms[room.RoomId] = room
+	server.Mutex.Unlock()
+
+	fmt.Printf("Room %s (ID: %s) created by %s\n", roomName, room.RoomId, owner.Username)
+
+	err := owner.Outbox.SendCommand(fmt.Sprintf("/ROOM_CREATED %s %s", room.RoomId, room.Name))
+	if err != nil {
+		fmt.Printf("Error sending room confirmation to %s: %v\n", owner.UserId, err)
+	}
+	for _, invitee := range invitees {
+		_ = owner.Outbox.SendCommand(fmt.Sprintf("/ROOM_INVITE_SENT %s %s %s", room.RoomId, invitee.UserId, invitee.Username))
+	}
+	for _, outbox := range notify {
+		_ = outbox.SendCommand(fmt.Sprintf("/ROOM_INVITED %s %s %s", room.RoomId, owner.Username, room.Name))
+	}
+}
+
+// HandleJoinRoom adds the user to a room the owner invited them to. Without an
+// invitation the owner is asked to approve the user with /invite.
+func HandleJoinRoom(server *interfaces.Server, user *interfaces.User, roomId string) {
+	server.Mutex.Lock()
+	room, exists := server.Rooms[roomId]
+	if !exists {
+		server.Mutex.Unlock()
+		user.Outbox.SendError(fmt.Sprintf("Room %s not found", roomId))
+		return
+	}
+	if _, isMember := room.Members[user.UserId]; isMember {
+		server.Mutex.Unlock()
+		user.Outbox.SendError(fmt.Sprintf("You are already a member of room %s", roomId))
+		return
+	}
+	if !room.Invited[user.UserId] {
+		if _, asked := room.Requests[user.UserId]; asked {
+			server.Mutex.Unlock()
+			user.Outbox.SendError(fmt.Sprintf("You already asked to join room %s, wait for its owner to approve", roomId))
+			return
+		}
+		room.Requests[user.UserId] = user
+		owner := outboxOf(room.Members[room.OwnerId])
+		server.Mutex.Unlock()
+
+		fmt.Printf("%s asked to join room %s (ID: %s)\n", user.Username, room.Name, room.RoomId)
+		_ = user.Outbox.SendCommand(fmt.Sprintf("/ROOM_JOIN_PENDING %s %s", room.RoomId, room.Name))
+		if owner != nil {
+			_ = owner.SendCommand(fmt.Sprintf("/ROOM_JOIN_REQUEST %s %s %s %s", room.RoomId, user.UserId, user.Username, room.Name))
+		}
+		return
+	}
+	delete(room.Invited, user.UserId)
+	server.Mutex.Unlock()
+
+	addRoomMember(server, room, user)
+}
+
+// HandleInviteToRoom lets the owner of a room invite a user, or approve a user who
+// asked to join, in which case the user becomes a member right away
+func HandleInviteToRoom(server *interfaces.Server, owner *interfaces.User, roomId, userId string) {
+	server.Mutex.Lock()
+	room, exists := server.Rooms[roomId]
+	if !exists {
+		server.Mutex.Unlock()
+		owner.Outbox.SendError(fmt.Sprintf("Room %s not found", roomId))
+		return
+	}
+	if room.OwnerId != owner.UserId {
+		server.Mutex.Unlock()
+		owner.Outbox.SendError(fmt.Sprintf("Only the owner of room %s can invite users to it", roomId))
+		return
+	}
+	if _, isMember := room.Members[userId]; isMember {
+		server.Mutex.Unlock()
+		owner.Outbox.SendError(fmt.Sprintf("User %s is already a member of room %s", userId, roomId))
+		return
+	}
+	if requester, asked := room.Requests[userId]; asked {
+		delete(room.Requests, userId)
+		server.Mutex.Unlock()
+
+		_ = owner.Outbox.SendCommand(fmt.Sprintf("/ROOM_APPROVED %s %s %s", room.RoomId, requester.UserId, requester.Username))
+		addRoomMember(server, room, requester)
+		return
+	}
+	invitee, exists := server.Connections[userId]
+	if !exists {
+		server.Mutex.Unlock()
+		owner.Outbox.SendError(fmt.Sprintf("User %s not found", userId))
+		return
+	}
+	room.Invited[userId] = true
+	inviteeOutbox := outboxOf(invitee)
+	server.Mutex.Unlock()
+
+	_ = owner.Outbox.SendCommand(fmt.Sprintf("/ROOM_INVITE_SENT %s %s %s", room.RoomId, invitee.UserId, invitee.Username))
+	if inviteeOutbox != nil {
+		_ = inviteeOutbox.SendCommand(fmt.Sprintf("/ROOM_INVITED %s %s %s", room.RoomId, owner.Username, room.Name))
+	}
+}
+
+// addRoomMember makes the user a member of the room and tells everyone in it
+func addRoomMember(server *interfaces.Server, room *interfaces.Room, user *interfaces.User) {
+	server.Mutex.Lock()
+	room.Members[user.UserId] = user
+	outbox := outboxOf(user)
+	server.Mutex.Unlock()
+
+	if outbox != nil {
+		if err := outbox.SendCommand(fmt.Sprintf("/ROOM_JOINED %s %s", room.RoomId, room.Name)); err != nil {
+			fmt.Printf("Error sending join confirmation to %s: %v\n", user.UserId, err)
+		}
+	}
+	BroadcastRoomMessage(fmt.Sprintf("User %s has joined the room", user.Username), server, room, user)
+}
+
+// HandleLeaveRoom removes the user from a room, handing ownership on or deleting the room when needed
+func HandleLeaveRoom(server *interfaces.Server, user *interfaces.User, roomId string) {
+	server.Mutex.Lock()
+	room, exists := server.Rooms[roomId]
+	if !exists {
+		server.Mutex.Unlock()
+		user.Outbox.SendError(fmt.Sprintf("Room %s not found", roomId))
+		return
+	}
+	if _, isMember := room.Members[user.UserId]; !isMember {
+		server.Mutex.Unlock()
+		user.Outbox.SendError(fmt.Sprintf("You are not a member of room %s", roomId))
+		return
+	}
+
+	if user.ActiveRoomId == roomId {
+		user.ActiveRoomId = ""
+	}
+	dropMember(server, room, user.UserId)
+	server.Mutex.Unlock()
+
+	err := user.Outbox.SendCommand(fmt.Sprintf("/ROOM_LEFT %s %s", room.RoomId, room.Name))
+	if err != nil {
+		fmt.Printf("Error sending leave confirmation to %s: %v\n", user.UserId, err)
+	}
+	BroadcastRoomMessage(fmt.Sprintf("User %s has left the room", user.Username), server, room, user)
+}
+
+// dropMember removes a member from a room, handing ownership on or closing the room
+// when needed. Callers must hold server.Mutex.
+func dropMember(server *interfaces.Server, room *interfaces.Room, userId string) {
+	delete(room.Members, userId)
+	if len(room.Members) == 0 {
+		delete(server.Rooms, room.RoomId)
+		fmt.Printf("Room %s (ID: %s) closed\n", room.Name, room.RoomId)
+	} else if room.OwnerId == userId {
+		// Hand the room to the member with the lowest ID so the result is predictable
+		memberIds := make([]string, 0, len(room.Members))
+		for memberId := range room.Members {
+			memberIds = append(memberIds, memberId)
+		}
+		sort.Strings(memberIds)
+		room.OwnerId = memberIds[0]
+	}
+}
+
+// HandleSelectRoom sets the room used for the user's chat, or "global" to go back to everyone
+func HandleSelectRoom(server *interfaces.Server, user *interfaces.User, roomId string) {
+	if roomId == "global" {
+		server.Mutex.Lock()
+		user.ActiveRoomId = ""
+		server.Mutex.Unlock()
+		_ = user.Outbox.SendCommand("/ROOM_SELECTED global")
+		return
+	}
+
+	server.Mutex.Lock()
+	room, exists := server.Rooms[roomId]
+	if !exists {
+		server.Mutex.Unlock()
+		user.Outbox.SendError(fmt.Sprintf("Room %s not found", roomId))
+		return
+	}
+	if _, isMember := room.Members[user.UserId]; !isMember {
+		server.Mutex.Unlock()
+		user.Outbox.SendError(fmt.Sprintf("You are not a member of room %s, use /joinroom %s first", roomId, roomId))
+		return
+	}
+	user.ActiveRoomId = roomId
+	server.Mutex.Unlock()
+
+	err := user.Outbox.SendCommand(fmt.Sprintf("/ROOM_SELECTED %s %s", room.RoomId, room.Name))
+	if err != nil {
+		fmt.Printf("Error sending room selection to %s: %v\n", user.UserId, err)
+	}
+}
+
+// HandleListRooms sends one line per room to the user
+func HandleListRooms(server *interfaces.Server, user *interfaces.User) {
+	var roomList strings.Builder
+	roomList.WriteString("/ROOMS\n")
+
+	server.Mutex.Lock()
+	for _, room := range sortedRooms(server) {
+		_, isMember := room.Members[user.UserId]
+		active := room.RoomId == user.ActiveRoomId
+		roomList.WriteString(fmt.Sprintf("%s|%s|%d|%t|%t\n", room.RoomId, room.Name, len(room.Members), isMember, active))
+	}
+	server.Mutex.Unlock()
+
+	err := user.Outbox.SendCommand(roomList.String())
+	if err != nil {
+		fmt.Printf("Error sending room list to %s: %v\n", user.UserId, err)
+	}
+}
+
+// HandleRoomInfo sends the details and member list of a room to one of its members
+func HandleRoomInfo(server *interfaces.Server, user *interfaces.User, roomId string) {
+	server.Mutex.Lock()
+	room, exists := server.Rooms[roomId]
+	if !exists {
+		server.Mutex.Unlock()
+		user.Outbox.SendError(fmt.Sprintf("Room %s not found", roomId))
+		return
+	}
+	if _, isMember := room.Members[user.UserId]; !isMember {
+		server.Mutex.Unlock()
+		user.Outbox.SendError(fmt.Sprintf("You are not a member of room %s", roomId))
+		return
+	}
+
+	ownerName := room.OwnerId
+	if owner, ok := room.Members[room.OwnerId]; ok {
+		ownerName = owner.Username
+	}
+
+	var info strings.Builder
+	info.WriteString(fmt.Sprintf("/ROOM_INFO %s|%s|%s|%s|%s\n",
+		room.RoomId, room.Name, room.OwnerId, ownerName, room.CreatedAt.Format(time.RFC3339)))
+	memberIds := make([]string, 0, len(room.Members))
+	for memberId := range room.Members {
+		memberIds = append(memberIds, memberId)
+	}
+	sort.Strings(memberIds)
+	for _, memberId := range memberIds {
+		member := room.Members[memberId]
+		info.WriteString(fmt.Sprintf("%s|%s|%t\n", member.UserId, member.Username, member.IsOnline))
+	}
+	server.Mutex.Unlock()
+
+	err := user.Outbox.SendCommand(info.String())
+	if err != nil {
+		fmt.Printf("Error sending room info to %s: %v\n", user.UserId, err)
+	}
+}
+
+// BroadcastRoomMessage sends a chat message to the online members of a room only
+func BroadcastRoomMessage(content string, server *interfaces.Server, room *interfaces.Room, sender *interfaces.User) {
+	server.Mutex.Lock()
+	outboxes := make([]*interfaces.Outbox, 0, len(room.Members))
+	for _, recipient := range room.Members {
+		if recipient.IsOnline && recipient != sender {
+			outboxes = append(outboxes, recipient.Outbox)
+		}
+	}
+	server.Mutex.Unlock()
+
+	message := fmt.Sprintf("[Room: %s] %s: %s", room.Name, sender.Username, content)
+	for _, outbox := range outboxes {
+		_ = outbox.SendChat(message)
+	}
+}
+
+// activeRoom returns the room the user has selected, if it still exists and they are still in it
+func activeRoom(server *interfaces.Server, user *interfaces.User) *interfaces.Room {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+	if user.ActiveRoomId == "" {
+		return nil
+	}
+	room, exists := server.Rooms[user.ActiveRoomId]
+	if !exists {
+		user.ActiveRoomId = ""
+		return nil
+	}
+	if _, isMember := room.Members[user.UserId]; !isMember {
+		user.ActiveRoomId = ""
+		return nil
+	}
+	return room
+}
+
+// sortedRooms returns the rooms ordered by numeric ID, callers must hold server.Mutex
+func sortedRooms(server *interfaces.Server) []*interfaces.Room {
+	rooms := make([]*interfaces.Room, 0, len(server.Rooms))
+	for _, room := range server.Rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		a, _ := strconv.Atoi(rooms[i].RoomId)
+		b, _ := strconv.Atoi(rooms[j].RoomId)
+		return a < b
+	})
+	return rooms
+}
+
+// authorizeRoomAccess checks that the requester has selected a room and that the
+// target user is a member of it. The returned error is meant to be shown to the requester.
+func authorizeRoomAccess(server *interfaces.Server, requester *interfaces.User, targetId string) (*interfaces.Room, error) {
+	room := activeRoom(server, requester)
+	if room == nil {
+		return nil, fmt.Errorf("Access denied: select a room shared with user %s first (/selectroom <roomId>)", targetId)
+	}
+
+	server.Mutex.Lock()
+	_, isMember := room.Members[targetId]
+	server.Mutex.Unlock()
+	if !isMember {
+		return nil, fmt.Errorf("Access denied: user %s is not a member of your active room %s", targetId, room.Name)
+	}
+	return room, nil
+}
+
+// grantPurpose is what a grant was given for and how long it may take to be used
+type grantPurpose struct {
+	name     string
+	lifetime time.Duration
+}
+
+var (
+	// A listing answers a /LOOK right away
+	lookupGrant = grantPurpose{"lookup", time.Minute}
+	// The file may wait in the owner's send queue behind other transfers
+	downloadGrant = grantPurpose{"download", 10 * time.Minute}
+	// A sender answers a resume request as soon as it gets it
+	resumeGrant = grantPurpose{"resume", 2 * time.Minute}
+)
+
+// grantAccess lets fromId answer one request from toId, identified by requestId
+func grantAccess(server *interfaces.Server, purpose grantPurpose, fromId, toId, requestId string) {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+	dropExpiredGrants(server)
+	server.Grants = append(server.Grants, &interfaces.Grant{
+		Purpose:   purpose.name,
+		FromId:    fromId,
+		ToId:      toId,
+		RequestId: requestId,
+		Expires:   time.Now().Add(purpose.lifetime),
+	})
+}
+
+// consumeGrant uses up the oldest grant for purpose from fromId to toId whose request
+// ID matches, reporting whether there was one
+func consumeGrant(server *interfaces.Server, purpose grantPurpose, fromId, toId string, matches func(requestId string) bool) bool {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+	dropExpiredGrants(server)
+	for i, grant := range server.Grants {
+		if grant.Purpose == purpose.name && grant.FromId == fromId && grant.ToId == toId && matches(grant.RequestId) {
+			server.Grants = append(server.Grants[:i], server.Grants[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// dropExpiredGrants forgets grants that were not used in time, callers must hold server.Mutex
+func dropExpiredGrants(server *interfaces.Server) {
+	now := time.Now()
+	kept := server.Grants[:0]
+	for _, grant := range server.Grants {
+		if now.Before(grant.Expires) {
+			kept = append(kept, grant)
+		}
+	}
+	clear(server.Grants[len(kept):])
+	server.Grants = kept
+}
+
+// isRequest returns a matcher for grants given for exactly requestId
+func isRequest(requestId string) func(string) bool {
+	return func(granted string) bool { return granted == requestId }
+}
+
+// authorizeTransfer allows a send when both users share the sender's active room,
+// or when it answers a request of the recipient that the server already authorized:
+// a download of the file with that name, or the resume of that transfer
+func authorizeTransfer(server *interfaces.Server, sender *interfaces.User, recipientId string, purpose grantPurpose, matches func(requestId string) bool) error {
+	if consumeGrant(server, purpose, sender.UserId, recipientId, matches) {
+		return nil
+	}
+	_, err := authorizeRoomAccess(server, sender, recipientId)
+	return err
+}
+
+// downloadOf returns a matcher for download grants whose requested path names the file
+// or folder that is sent
+func downloadOf(name string) func(string) bool {
+	return func(requested string) bool { return filepath.Base(requested) == name }
+}
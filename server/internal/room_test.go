@@ -0,0 +1,225 @@
+package connection
+
+import (
+	"ItShare/protocol"
+	"ItShare/server/interfaces"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testClient is the far end of a test user's connection, where the frames the server
+// queued for that user arrive
+type testClient struct {
+	frames chan protocol.Frame
+}
+
+func newTestServer() *interfaces.Server {
+	return &interfaces.Server{
+		Connections: make(map[string]*interfaces.User),
+		Sessions:    make(map[string]*interfaces.User),
+		Relays:      make(map[string]*interfaces.Relay),
+		Rooms:       make(map[string]*interfaces.Room),
+		NextRoomId:  1,
+	}
+}
+
+// addTestUser adds an online user to the server whose outbox writes to a pipe
+func addTestUser(t *testing.T, server *interfaces.Server, userId, username string) (*interfaces.User, *testClient) {
+	t.Helper()
+	serverSide, clientSide := net.Pipe()
+	conn := protocol.NewConn(serverSide)
+	outbox := interfaces.NewOutbox(conn, 64, time.Second, interfaces.OverflowDisconnect)
+	t.Cleanup(func() {
+		outbox.Close()
+		serverSide.Close()
+		clientSide.Close()
+	})
+
+	client := &testClient{frames: make(chan protocol.Frame, 64)}
+	go func() {
+		reader := protocol.NewConn(clientSide)
+		for {
+			frame, err := reader.Receive()
+			if err != nil {
+				return
+			}
+			client.frames <- frame
+		}
+	}()
+
+	user := &interfaces.User{UserId: userId, Username: username, Conn: conn, Outbox: outbox, IsOnline: true, SessionToken: "token-" + userId}
+	server.Connections[userId] = user
+	server.Sessions[user.SessionToken] = user
+	return user, client
+}
+
+// next returns the next frame the user was sent
+func (c *testClient) next(t *testing.T) protocol.Frame {
+	t.Helper()
+	select {
+	case frame := <-c.frames:
+		return frame
+	case <-time.After(2 * time.Second):
+		t.Fatal("no frame arrived")
+		return protocol.Frame{}
+	}
+}
+
+// expect checks that the next frame the user was sent has the given type and starts with prefix
+func (c *testClient) expect(t *testing.T, frameType protocol.FrameType, prefix string) {
+	t.Helper()
+	frame := c.next(t)
+	if frame.Type != frameType || !strings.HasPrefix(string(frame.Payload), prefix) {
+		t.Fatalf("got %s frame %q, want %s frame starting with %q", frame.Type, frame.Payload, frameType, prefix)
+	}
+}
+
+func TestCreateRoomOnlyInvites(t *testing.T) {
+	server := newTestServer()
+	owner, ownerClient := addTestUser(t, server, "1111", "mallory")
+	victim, victimClient := addTestUser(t, server, "2222", "alice")
+
+	HandleCreateRoom(server, owner, "team", []string{victim.UserId})
+	ownerClient.expect(t, protocol.FrameCommand, "/ROOM_CREATED 1 team")
+	ownerClient.expect(t, protocol.FrameCommand, "/ROOM_INVITE_SENT 1 2222 alice")
+	victimClient.expect(t, protocol.FrameCommand, "/ROOM_INVITED 1 mallory team")
+
+	room := server.Rooms["1"]
+	if _, isMember := room.Members[victim.UserId]; isMember {
+		t.Fatal("an invited user is a member before accepting")
+	}
+	if !room.Invited[victim.UserId] {
+		t.Fatal("the listed user was not invited")
+	}
+
+	HandleSelectRoom(server, owner, "1")
+	ownerClient.expect(t, protocol.FrameCommand, "/ROOM_SELECTED 1")
+
+	HandleLookupRequest(server, owner, victim.UserId)
+	ownerClient.expect(t, protocol.FrameError, "Access denied")
+	HandleDownloadRequest(server, owner, victim.UserId, owner.UserId, "secret.txt")
+	ownerClient.expect(t, protocol.FrameError, "Access denied")
+	if err := authorizeTransfer(server, owner, victim.UserId, downloadGrant, downloadOf("secret.txt")); err == nil {
+		t.Fatal("authorizeTransfer() allowed a send to a user who did not join")
+	}
+	if len(server.Grants) != 0 {
+		t.Fatalf("denied requests left %d grants", len(server.Grants))
+	}
+	// The requests never reached the invited user, the marker is the next thing they get
+	_ = victim.Outbox.SendCommand("/MARKER")
+	victimClient.expect(t, protocol.FrameCommand, "/MARKER")
+
+	HandleJoinRoom(server, victim, "1")
+	victimClient.expect(t, protocol.FrameCommand, "/ROOM_JOINED 1 team")
+	if _, err := authorizeRoomAccess(server, owner, victim.UserId); err != nil {
+		t.Fatalf("authorizeRoomAccess() after joining error = %v", err)
+	}
+}
+
+func TestCreateRoomRefusesUnknownUsers(t *testing.T) {
+	server := newTestServer()
+	owner, ownerClient := addTestUser(t, server, "1111", "mallory")
+
+	HandleCreateRoom(server, owner, "team", []string{"9999"})
+	ownerClient.expect(t, protocol.FrameError, "Cannot create room team, unknown users: 9999")
+	if len(server.Rooms) != 0 {
+		t.Fatal("a room was created")
+	}
+}
+
+func TestConsumeGrant(t *testing.T) {
+	server := newTestServer()
+	grantAccess(server, downloadGrant, "1111", "2222", "docs/report.pdf")
+	server.Grants = append(server.Grants, &interfaces.Grant{
+		Purpose: downloadGrant.name, FromId: "1111", ToId: "2222", RequestId: "old.pdf", Expires: time.Now().Add(-time.Second),
+	})
+
+	tests := []struct {
+		name    string
+		purpose grantPurpose
+		fromId  string
+		toId    string
+		matches func(string) bool
+		want    bool
+	}{
+		{"other purpose", resumeGrant, "1111", "2222", downloadOf("report.pdf"), false},
+		{"other sender", downloadGrant, "3333", "2222", downloadOf("report.pdf"), false},
+		{"reversed", downloadGrant, "2222", "1111", downloadOf("report.pdf"), false},
+		{"other file", downloadGrant, "1111", "2222", downloadOf("notes.txt"), false},
+		{"expired", downloadGrant, "1111", "2222", downloadOf("old.pdf"), false},
+		{"granted", downloadGrant, "1111", "2222", downloadOf("report.pdf"), true},
+		{"used up", downloadGrant, "1111", "2222", downloadOf("report.pdf"), false},
+	}
+	for _, tt := range tests {
+		if got := consumeGrant(server, tt.purpose, tt.fromId, tt.toId, tt.matches); got != tt.want {
+			t.Errorf("%s: consumeGrant() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if len(server.Grants) != 0 {
+		t.Fatalf("%d grants left, want none", len(server.Grants))
+	}
+}
+
+func TestLeaveRoomHandsOwnershipOn(t *testing.T) {
+	server := newTestServer()
+	owner, ownerClient := addTestUser(t, server, "3000", "carol")
+	first, firstClient := addTestUser(t, server, "2000", "bob")
+	second, _ := addTestUser(t, server, "1000", "alice")
+	room := &interfaces.Room{
+		RoomId:   "1",
+		Name:     "team",
+		OwnerId:  owner.UserId,
+		Members:  map[string]*interfaces.User{owner.UserId: owner, first.UserId: first, second.UserId: second},
+		Invited:  make(map[string]bool),
+		Requests: make(map[string]*interfaces.User),
+	}
+	server.Rooms[room.RoomId] = room
+	owner.ActiveRoomId = room.RoomId
+
+	HandleLeaveRoom(server, owner, room.RoomId)
+	ownerClient.expect(t, protocol.FrameCommand, "/ROOM_LEFT 1 team")
+	if owner.ActiveRoomId != "" {
+		t.Fatal("the room stayed selected after leaving it")
+	}
+	if room.OwnerId != second.UserId {
+		t.Fatalf("ownership went to %s, want the lowest ID %s", room.OwnerId, second.UserId)
+	}
+	firstClient.expect(t, protocol.FrameChat, "[Room: team] carol: User carol has left the room")
+
+	HandleLeaveRoom(server, owner, room.RoomId)
+	ownerClient.expect(t, protocol.FrameError, "You are not a member of room 1")
+
+	HandleLeaveRoom(server, second, room.RoomId)
+	HandleLeaveRoom(server, first, room.RoomId)
+	if _, exists := server.Rooms[room.RoomId]; exists {
+		t.Fatal("the room outlived its last member")
+	}
+}
+
+func TestRoomChatStaysInRoom(t *testing.T) {
+	server := newTestServer()
+	sender, _ := addTestUser(t, server, "1111", "alice")
+	member, memberClient := addTestUser(t, server, "2222", "bob")
+	outsider, outsiderClient := addTestUser(t, server, "3333", "carol")
+	away, _ := addTestUser(t, server, "4444", "dave")
+	away.IsOnline = false
+	room := &interfaces.Room{
+		RoomId:  "1",
+		Name:    "team",
+		OwnerId: sender.UserId,
+		Members: map[string]*interfaces.User{sender.UserId: sender, member.UserId: member, away.UserId: away},
+	}
+	server.Rooms[room.RoomId] = room
+
+	BroadcastRoomMessage("hello", server, room, sender)
+	memberClient.expect(t, protocol.FrameChat, "[Room: team] alice: hello")
+	_ = outsider.Outbox.SendCommand("/MARKER")
+	outsiderClient.expect(t, protocol.FrameCommand, "/MARKER")
+
+	HandleRoomInfo(server, outsider, room.RoomId)
+	outsiderClient.expect(t, protocol.FrameError, "You are not a member of room 1")
+	HandleRoomInfo(server, member, room.RoomId)
+	memberClient.expect(t, protocol.FrameCommand, "/ROOM_INFO 1|team|1111|alice|")
+}
@@ -0,0 +1,115 @@
+package connection
+
+import (
+	"ItShare/helper"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// How long a generated certificate stays valid. Clients pin it rather than checking
+// it against a CA, so it only has to outlive the server installation.
+const selfSignedValidity = 10 * 365 * 24 * time.Hour
+
+// LoadTLSConfig returns the TLS configuration of the server along with the fingerprint
+// of its certificate. Without a certificate and key of its own, the server uses the
+// self-signed pair it generated on its first run, so clients keep seeing the same one.
+func LoadTLSConfig(certFile, keyFile string) (*tls.Config, string, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, "", fmt.Errorf("--cert and --key must be given together")
+	}
+	if certFile == "" {
+		var err error
+		if certFile, keyFile, err = selfSignedPair(); err != nil {
+			return nil, "", err
+		}
+	}
+
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, "", err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, "", err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		MinVersion:   tls.VersionTLS12,
+	}
+	return config, helper.CertFingerprint(leaf), nil
+}
+
+// selfSignedPair returns the paths of the generated certificate and key, creating them
+// the first time
+func selfSignedPair() (string, string, error) {
+	base, err := os.UserConfigDir()
+	if err != nil {
+		return "", "", err
+	}
+	dir := filepath.Join(base, "itshare", "server")
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if _, err := os.Stat(certFile); err == nil {
+		return certFile, keyFile, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", err
+	}
+	if err := generateCertificate(certFile, keyFile); err != nil {
+		return "", "", err
+	}
+	fmt.Println("Generated a self-signed certificate in", dir)
+	return certFile, keyFile, nil
+}
+
+// generateCertificate writes a new self-signed certificate for this host and its key
+func generateCertificate(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "ItShare server " + hostname},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
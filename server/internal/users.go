@@ -0,0 +1,126 @@
+package connection
+
+import (
+	"ItShare/helper"
+	"ItShare/server/interfaces"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Usernames are unique on a server regardless of case, so commands can name a user
+// instead of giving their ID. A name stays taken while its session can be resumed,
+// unless its user is offline and someone logs in with the password of the account
+// of that name. The shared password does not prove a name is yours.
+
+// validateUsername checks that a username can stand in for a user ID in commands
+func validateUsername(username string) error {
+	switch {
+	case username == "", strings.HasPrefix(username, "/"), strings.ContainsAny(username, " \t"):
+		return errors.New("username must be a single word and cannot start with '/'")
+	case isNumeric(username):
+		return errors.New("username cannot be a number, numbers are user IDs")
+	}
+	return nil
+}
+
+func isNumeric(text string) bool {
+	_, err := strconv.Atoi(text)
+	return err == nil
+}
+
+// sameName reports whether two usernames are the same, which they are whatever their case
+func sameName(a, b string) bool {
+	return strings.EqualFold(a, b)
+}
+
+// findUser returns the user with the given ID or, failing that, username. Callers must
+// hold server.Mutex.
+func findUser(server *interfaces.Server, nameOrId string) (*interfaces.User, bool) {
+	if user, exists := server.Connections[nameOrId]; exists {
+		return user, true
+	}
+	for _, user := range server.Connections {
+		if sameName(user.Username, nameOrId) {
+			return user, true
+		}
+	}
+	return nil, false
+}
+
+// onlineUser returns the user with the given ID, nil when there is none, and the outbox
+// of that user if they are online. Resuming a session replaces the outbox and marks
+// the user online from another goroutine, so both are read under server.Mutex.
+func onlineUser(server *interfaces.Server, userId string) (*interfaces.User, *interfaces.Outbox) {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+	user := server.Connections[userId]
+	return user, outboxOf(user)
+}
+
+// outboxOf returns the outbox of a user who is online, nil otherwise. Callers must
+// hold server.Mutex.
+func outboxOf(user *interfaces.User) *interfaces.Outbox {
+	if user == nil || !user.IsOnline {
+		return nil
+	}
+	return user.Outbox
+}
+
+// registerUser gives a new user an ID no one else has and adds it to the server,
+// unless its username is already taken. A login that gave the password of the account
+// of its name takes the name over from an offline user, whose session and room
+// memberships end.
+func registerUser(server *interfaces.Server, user *interfaces.User, ownsName bool) error {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+	for _, existing := range server.Connections {
+		if !sameName(existing.Username, user.Username) {
+			continue
+		}
+		if !ownsName || existing.IsOnline {
+			return fmt.Errorf("username %s is already taken", user.Username)
+		}
+		fmt.Printf("Offline user %s (ID: %s) retired, its name was taken over from %s\n", existing.Username, existing.UserId, user.IpAddress)
+		retireUser(server, existing)
+	}
+
+	user.UserId = helper.GenerateUserId()
+	for {
+		if _, taken := server.Connections[user.UserId]; !taken {
+			break
+		}
+		user.UserId = helper.GenerateUserId()
+	}
+	server.Connections[user.UserId] = user
+	server.Sessions[user.SessionToken] = user
+	return nil
+}
+
+// retireUser removes an offline user from the server for good, callers must hold server.Mutex
+func retireUser(server *interfaces.Server, user *interfaces.User) {
+	delete(server.Connections, user.UserId)
+	delete(server.Sessions, user.SessionToken)
+	for _, room := range server.Rooms {
+		delete(room.Invited, user.UserId)
+		delete(room.Requests, user.UserId)
+		if _, isMember := room.Members[user.UserId]; isMember {
+			dropMember(server, room, user.UserId)
+		}
+	}
+}
+
+// HandleUserQuery tells a client which user a name or ID refers to, answering
+// "/USER_OF <nameOrId> <userId> <username>", or just "/USER_OF <nameOrId>" when
+// there is no such user
+func HandleUserQuery(server *interfaces.Server, requester *interfaces.User, nameOrId string) {
+	server.Mutex.Lock()
+	user, exists := findUser(server, nameOrId)
+	reply := "/USER_OF " + nameOrId
+	if exists {
+		reply += " " + user.UserId + " " + user.Username
+	}
+	server.Mutex.Unlock()
+	_ = requester.Outbox.SendCommand(reply)
+}
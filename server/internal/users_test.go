@@ -0,0 +1,42 @@
+package connection
+
+import (
+	"ItShare/server/interfaces"
+	"testing"
+)
+
+func TestRegisterUserTakeover(t *testing.T) {
+	tests := []struct {
+		name     string
+		online   bool
+		ownsName bool
+		wantErr  bool
+	}{
+		{"offline name with its account", false, true, false},
+		{"offline name with the shared password", false, false, true},
+		{"online name with its account", true, true, true},
+		{"online name with the shared password", true, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			existing := &interfaces.User{UserId: "1111", Username: "Alice", SessionToken: "old", IsOnline: tt.online}
+			server := &interfaces.Server{
+				Connections: map[string]*interfaces.User{existing.UserId: existing},
+				Sessions:    map[string]*interfaces.User{existing.SessionToken: existing},
+				Rooms:       map[string]*interfaces.Room{},
+			}
+			user := &interfaces.User{Username: "alice", SessionToken: "new"}
+			err := registerUser(server, user, tt.ownsName)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("registerUser() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			_, kept := server.Connections[existing.UserId]
+			if kept != tt.wantErr {
+				t.Fatalf("existing user kept = %v, want %v", kept, tt.wantErr)
+			}
+			if _, resumable := server.Sessions["old"]; resumable != tt.wantErr {
+				t.Fatalf("existing session kept = %v, want %v", resumable, tt.wantErr)
+			}
+		})
+	}
+}
@@ -22,6 +22,7 @@ var (
 	PausedColor  = color.New(color.FgYellow, color.Bold).SprintFunc()
 	AccentColor  = color.New(color.FgHiCyan, color.Bold).SprintFunc()
 	BorderColor  = color.New(color.FgHiBlack).SprintFunc()
+	RoomColor    = color.New(color.FgHiMagenta, color.Bold).SprintFunc()
 )
 
 type ProgressBar struct {
@@ -104,8 +105,21 @@ func PrintHelp() {
 	fmt.Printf("│  %s           Show online users and their status        │\n", CommandColor("/status"))
 	fmt.Printf("│  %s             Display this help message               │\n", CommandColor("/help"))
 	fmt.Printf("│  %s              Disconnect and exit application          │\n", CommandColor("exit"))
+	fmt.Printf("│  %s             Log out, ending the session              │\n", CommandColor("/exit"))
 	fmt.Println(BorderColor("└────────────────────────────────────────────────────────────────┘"))
 	
+	fmt.Println(BorderColor("\n┌────────────────────────────────────────────────────────────────┐"))
+	fmt.Println(HeaderColor("│                      Room Management                           │"))
+	fmt.Println(BorderColor("├────────────────────────────────────────────────────────────────┤"))
+	fmt.Printf("│  %s Create a room        │\n", CommandColor("/createroom <name> <userId1> [userId2]..."))
+	fmt.Printf("│  %s      Join a room or ask to be let in       │\n", CommandColor("/joinroom <roomId>"))
+	fmt.Printf("│  %s      Invite a user or let them in   │\n", CommandColor("/invite <roomId> <userId>"))
+	fmt.Printf("│  %s     Leave a room                             │\n", CommandColor("/leaveroom <roomId>"))
+	fmt.Printf("│  %s Select room for chat (or 'global')  │\n", CommandColor("/selectroom <roomId|global>"))
+	fmt.Printf("│  %s              List all rooms                           │\n", CommandColor("/listrooms"))
+	fmt.Printf("│  %s      Show members of a room you are in     │\n", CommandColor("/roominfo <roomId>"))
+	fmt.Println(BorderColor("└────────────────────────────────────────────────────────────────┘"))
+
 	fmt.Println(BorderColor("\n┌────────────────────────────────────────────────────────────────┐"))
 	fmt.Println(HeaderColor("│                      File Operations                           │"))
 	fmt.Println(BorderColor("├────────────────────────────────────────────────────────────────┤"))
@@ -113,6 +127,7 @@ func PrintHelp() {
 	fmt.Printf("│  %s Send a file to specific user              │\n", CommandColor("/sendfile <userId> <path>"))
 	fmt.Printf("│  %s Send entire folder to user               │\n", CommandColor("/sendfolder <userId> <path>"))
 	fmt.Printf("│  %s Download file from user's share          │\n", CommandColor("/download <userId> <fileName>"))
+	fmt.Println(InfoColor("│  Any <userId> can also be the user's name                      │"))
 	fmt.Println(BorderColor("└────────────────────────────────────────────────────────────────┘"))
 	
 	fmt.Println(BorderColor("\n┌────────────────────────────────────────────────────────────────┐"))
@@ -121,6 +136,13 @@ func PrintHelp() {
 	fmt.Printf("│  %s          Show all active transfers               │\n", CommandColor("/transfers"))
 	fmt.Printf("│  %s     Pause an active transfer                 │\n", CommandColor("/pause <transferId>"))
 	fmt.Printf("│  %s    Resume a paused transfer                 │\n", CommandColor("/resume <transferId>"))
+	fmt.Printf("│  %s    Cancel a transfer on both sides          │\n", CommandColor("/cancel <transferId>"))
+	fmt.Printf("│  %s Reorder a queued send            │\n", CommandColor("/priority <transferId> high|low"))
+	fmt.Printf("│  %s Limit an outgoing transfer            │\n", CommandColor("/limit <transferId> <rate>"))
+	fmt.Printf("│  %s    Accept an incoming transfer              │\n", CommandColor("/accept <transferId>"))
+	fmt.Printf("│  %s    Reject an incoming transfer              │\n", CommandColor("/reject <transferId>"))
+	fmt.Printf("│  %s Always accept (or 'off <name>')  │\n", CommandColor("/autoaccept [username]"))
+	fmt.Printf("│  %s        Show your key fingerprint               │\n", CommandColor("/fingerprint"))
 	fmt.Println(BorderColor("└────────────────────────────────────────────────────────────────┘"))
 	
 	fmt.Println(BorderColor("\n╔════════════════════════════════════════════════════════════════╗"))